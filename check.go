@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/minacio00/gdb/storageengine"
+)
+
+// runCheck implements `gdb check [-json] file.db` and returns the exit code:
+// 0 if the file is consistent, 1 if problems were found and 2 if it could not be checked
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gdb check [-json] file.db")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+
+	// The file may be a backup, it is never written to. Corrupt table pages
+	// are reported instead of stopping the check.
+	db, err := storageengine.NewDatabaseWithOptions(path, storageengine.Options{
+		CorruptPages: storageengine.QuarantineCorruptPages,
+		ReadOnly:     true,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gdb check: failed to open %s: %v\n", path, err)
+		return 2
+	}
+	defer db.Close()
+
+	if info, err := os.Stat(path + "-wal"); err == nil && info.Size() > 0 {
+		fmt.Fprintf(os.Stderr, "gdb check: %s-wal holds changes that are not checkpointed yet, only %s is checked\n", path, path)
+	}
+
+	report, err := db.Check()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gdb check: %v\n", err)
+		return 2
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "gdb check: %v\n", err)
+			return 2
+		}
+	} else {
+		fmt.Printf("%s: %d pages, %d tables, %d row versions checked\n", path, report.Pages, report.Tables, report.Rows)
+		for _, problem := range report.Problems {
+			fmt.Println(problem)
+		}
+		if report.OK() {
+			fmt.Println("no problems found")
+		} else {
+			fmt.Printf("%d problems found\n", len(report.Problems))
+		}
+	}
+
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
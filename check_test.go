@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/minacio00/gdb/storageengine"
+)
+
+// TestCheckLeavesFileUntouched tests that `gdb check` never writes to the file it checks
+func TestCheckLeavesFileUntouched(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "live.db")
+	backupPath := filepath.Join(dir, "backup.db")
+
+	db, err := storageengine.NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	columns := []storageengine.Column{{Name: "id", Type: storageengine.TInteger, NotNull: true}}
+	if err := db.CreateTable("items", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for i := 1; i <= 100; i++ {
+		if err := db.Insert("items", map[string]interface{}{"id": int64(i)}); err != nil {
+			t.Fatalf("Failed to insert row: %v", err)
+		}
+	}
+	// A log left next to the backup must not be replayed into it
+	wal, err := os.ReadFile(dbPath + "-wal")
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to read database: %v", err)
+	}
+	if err := os.WriteFile(backupPath, data, 0444); err != nil {
+		t.Fatalf("Failed to write backup: %v", err)
+	}
+	if err := os.WriteFile(backupPath+"-wal", wal, 0444); err != nil {
+		t.Fatalf("Failed to write backup WAL: %v", err)
+	}
+	// An mtime in the past shows any write, however fast
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, path := range []string{backupPath, backupPath + "-wal"} {
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatalf("Failed to set mtime: %v", err)
+		}
+	}
+
+	if code := runCheck([]string{backupPath}); code != 0 {
+		t.Fatalf("Expected the backup to pass the check, got exit code %d", code)
+	}
+
+	for path, want := range map[string][]byte{backupPath: data, backupPath + "-wal": wal} {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s after the check: %v", path, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("Expected %s to be unchanged by the check", path)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", path, err)
+		}
+		if !info.ModTime().Equal(past) {
+			t.Fatalf("Expected the mtime of %s to stay %v, got %v", path, past, info.ModTime())
+		}
+	}
+
+	// Without a log next to it, none is created either
+	if err := os.Remove(backupPath + "-wal"); err != nil {
+		t.Fatalf("Failed to remove backup WAL: %v", err)
+	}
+	if code := runCheck([]string{backupPath}); code != 0 {
+		t.Fatalf("Expected the backup to pass the check, got exit code %d", code)
+	}
+	if _, err := os.Stat(backupPath + "-wal"); !os.IsNotExist(err) {
+		t.Fatalf("Expected no WAL to be created, got %v", err)
+	}
+}
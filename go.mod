@@ -1,5 +1,3 @@
 module github.com/minacio00/gdb
 
 go 1.23.6
-
-require github.com/google/btree v1.1.3 // indirect
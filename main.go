@@ -3,11 +3,16 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/minacio00/gdb/storageengine"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
+
 	db, err := storageengine.NewDatabase("test.db", 4096)
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
@@ -0,0 +1,234 @@
+package storageengine
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Columns are added and dropped without rewriting any rows. Every column has
+// an ID that fixes its place in the row layout, and records the schema version
+// that added it and the one that dropped it. A row is stored with the columns
+// of the schema version it was written with, so reading it takes the layout of
+// that version: dropped columns stay in the table definition as long as rows
+// may still hold them, and columns added later read as their default value.
+// Rows move to the current layout whenever they are written again.
+
+// AddColumn adds a column to a table in a transaction of its own
+func (db *Database) AddColumn(tableName string, col Column) error {
+	return db.autocommit(func(tx *Tx) error {
+		return tx.AddColumn(tableName, col)
+	})
+}
+
+// AddColumn adds a column to a table as part of the transaction. Existing
+// rows read as the column's default value, which a NOT NULL column needs.
+func (tx *Tx) AddColumn(tableName string, col Column) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	table, exists := tx.tables[tableName]
+	if !exists {
+		return fmt.Errorf("table not found: %s", tableName)
+	}
+	if err := checkName("column", col.Name); err != nil {
+		return err
+	}
+	if err := checkColumnType(col); err != nil {
+		return err
+	}
+	if _, exists := table.column(col.Name); exists {
+		return fmt.Errorf("column already exists: %s", col.Name)
+	}
+	if col.NotNull && col.Default == nil {
+		return fmt.Errorf("NOT NULL column %s needs a default value", col.Name)
+	}
+
+	var err error
+	if col.Default, err = normalizeDefault(col); err != nil {
+		return err
+	}
+
+	table.SchemaVersion++
+	col.id = table.nextColumnID()
+	col.added = table.SchemaVersion
+	col.dropped = 0
+	table.Columns = append(table.Columns[:len(table.Columns):len(table.Columns)], col)
+
+	return tx.writeTablePage(table)
+}
+
+// DropColumn removes a column from a table in a transaction of its own
+func (db *Database) DropColumn(tableName string, columnName string) error {
+	return db.autocommit(func(tx *Tx) error {
+		return tx.DropColumn(tableName, columnName)
+	})
+}
+
+// DropColumn removes a column from a table as part of the transaction. The
+// primary key and indexed columns cannot be dropped. The values stay in the
+// existing rows until they are written again.
+func (tx *Tx) DropColumn(tableName string, columnName string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	table, exists := tx.tables[tableName]
+	if !exists {
+		return fmt.Errorf("table not found: %s", tableName)
+	}
+	col, exists := table.column(columnName)
+	if !exists {
+		return fmt.Errorf("column not found: %s", columnName)
+	}
+	if columnName == table.PK {
+		return fmt.Errorf("cannot drop the primary key column: %s", columnName)
+	}
+	for _, index := range table.Indexes {
+		for _, name := range index.Columns {
+			if indexed, _, _ := table.columnPath(name); indexed == col {
+				return fmt.Errorf("column %s is used by index %s", columnName, index.Name)
+			}
+		}
+	}
+	if len(table.Columns) == 1 {
+		return fmt.Errorf("cannot drop the last column of table %s", tableName)
+	}
+
+	table.SchemaVersion++
+	dropped := *col
+	dropped.dropped = table.SchemaVersion
+
+	columns := make([]Column, 0, len(table.Columns)-1)
+	for _, c := range table.Columns {
+		if c.Name != columnName {
+			columns = append(columns, c)
+		}
+	}
+	table.Columns = columns
+	table.dropped = append(table.dropped[:len(table.dropped):len(table.dropped)], dropped)
+
+	return tx.writeTablePage(table)
+}
+
+// RenameColumn renames a column in a transaction of its own
+func (db *Database) RenameColumn(tableName string, oldName string, newName string) error {
+	return db.autocommit(func(tx *Tx) error {
+		return tx.RenameColumn(tableName, oldName, newName)
+	})
+}
+
+// RenameColumn renames a column as part of the transaction, together with
+// its uses by the primary key and indexes. Rows are left alone.
+func (tx *Tx) RenameColumn(tableName string, oldName string, newName string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	table, exists := tx.tables[tableName]
+	if !exists {
+		return fmt.Errorf("table not found: %s", tableName)
+	}
+	if _, exists := table.column(oldName); !exists {
+		return fmt.Errorf("column not found: %s", oldName)
+	}
+	if err := checkName("column", newName); err != nil {
+		return err
+	}
+	if _, exists := table.column(newName); exists {
+		return fmt.Errorf("column already exists: %s", newName)
+	}
+
+	// Snapshots share the committed slices, change copies
+	table.Columns = append([]Column(nil), table.Columns...)
+	col, _ := table.column(oldName)
+
+	if table.PK == oldName {
+		table.PK = newName
+	}
+	for i := range table.Indexes {
+		index := &table.Indexes[i]
+		index.Columns = append([]string(nil), index.Columns...)
+		for j, name := range index.Columns {
+			// Paths into a JSON column follow it as well
+			if indexed, _, _ := table.columnPath(name); indexed == col {
+				index.Columns[j] = newName + name[len(oldName):]
+			}
+		}
+	}
+	col.Name = newName
+
+	return tx.writeTablePage(table)
+}
+
+// layout returns the columns of the rows written with a schema version, in
+// the order their values are stored
+func (t *Table) layout(version uint32) ([]Column, error) {
+	if version == t.SchemaVersion {
+		return t.Columns, nil
+	}
+	if version > t.SchemaVersion {
+		return nil, fmt.Errorf("row was written with schema version %d, the table is at version %d", version, t.SchemaVersion)
+	}
+
+	var layout []Column
+	for _, columns := range [][]Column{t.Columns, t.dropped} {
+		for _, col := range columns {
+			if col.added <= version && (col.dropped == 0 || col.dropped > version) {
+				layout = append(layout, col)
+			}
+		}
+	}
+	sort.Slice(layout, func(i, j int) bool {
+		return layout[i].id < layout[j].id
+	})
+	return layout, nil
+}
+
+// nextColumnID returns the ID of the next column added to the table
+func (t *Table) nextColumnID() uint32 {
+	var id uint32
+	for _, columns := range [][]Column{t.Columns, t.dropped} {
+		for _, col := range columns {
+			id = max(id, col.id)
+		}
+	}
+	return id + 1
+}
+
+// normalizeDefault checks a column's default value and converts it to the Go
+// type the column's values are read back as
+func normalizeDefault(col Column) (interface{}, error) {
+	val, err := normalizeValue(col, col.Default)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default value for column %s: %w", col.Name, err)
+	}
+	return val, nil
+}
+
+// withDefaults returns the values of a new row with the default value of
+// every column it leaves out. The caller's values are left alone.
+func withDefaults(table *Table, values map[string]interface{}) map[string]interface{} {
+	var filled map[string]interface{}
+	for _, col := range table.Columns {
+		if col.Default == nil {
+			continue
+		}
+		if _, exists := values[col.Name]; exists {
+			continue
+		}
+
+		if filled == nil {
+			filled = make(map[string]interface{}, len(values)+1)
+			for name, val := range values {
+				filled[name] = val
+			}
+		}
+		filled[col.Name] = col.Default
+	}
+
+	if filled == nil {
+		return values
+	}
+	return filled
+}
@@ -0,0 +1,239 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestAlterTable tests adding, dropping and renaming columns without rewriting rows
+func TestAlterTable(t *testing.T) {
+	dbPath := "alter_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+		{Name: "notes", Type: Tstring, NotNull: false},
+	}
+	if err := db.CreateTable("users", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := db.CreateIndex("users", "users_name", []string{"name"}, true); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	for i := 1; i <= 20; i++ {
+		err := db.Insert("users", map[string]interface{}{
+			"id":    int64(i),
+			"name":  fmt.Sprintf("user %d", i),
+			"notes": strings.Repeat("n", 2000), // stored out of line
+		})
+		if err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+
+	checkOK := func(t *testing.T) {
+		t.Helper()
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Failed to check database: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("Expected no problems, got %v", report.Problems)
+		}
+	}
+
+	// rowVersion returns the schema version the newest version of a row was written with
+	rowVersion := func(t *testing.T, rowID uint64) uint32 {
+		t.Helper()
+		table, _ := db.GetTableSchema("users")
+		var ptr RowPtr
+		key := rowKey(rowID)
+		err := bpScan(db, table.RowIndexRoot, key, prefixEnd(key), func(_ []byte, value uint64) bool {
+			ptr = unpackRowPtr(value)
+			return false
+		})
+		if err != nil {
+			t.Fatalf("Failed to scan row index: %v", err)
+		}
+		page, err := db.readPage(ptr.PageID)
+		if err != nil {
+			t.Fatalf("Failed to read data page: %v", err)
+		}
+		defer db.unpinPage(page)
+		record, err := readSlot(page, ptr.Slot)
+		if err != nil {
+			t.Fatalf("Failed to read row %d: %v", rowID, err)
+		}
+		return binary.LittleEndian.Uint32(record.payload[0:rowVersionSize])
+	}
+
+	// Test: existing rows read a new column as its default without being rewritten
+	t.Run("Add", func(t *testing.T) {
+		snap := db.acquireSnapshot()
+		defer db.releaseSnapshot(snap)
+
+		err := db.AddColumn("users", Column{Name: "score", Type: TInteger, NotNull: true, Default: 10})
+		if err != nil {
+			t.Fatalf("Failed to add column: %v", err)
+		}
+		if v := rowVersion(t, 1); v != 0 {
+			t.Fatalf("Expected row 1 to keep schema version 0, got %d", v)
+		}
+
+		row, err := db.SelectByPK("users", int64(1))
+		if err != nil {
+			t.Fatalf("Failed to select row: %v", err)
+		}
+		if row.Values["score"] != int64(10) {
+			t.Fatalf("Expected an old row to read the default 10, got %v (%T)", row.Values["score"], row.Values["score"])
+		}
+		if rows, err := db.SelectWhere("users", "score", "=", 10); err != nil || len(rows) != 20 {
+			t.Fatalf("Expected 20 rows to match the default, got %d, %v", len(rows), err)
+		}
+
+		// Inserts that leave the column out get the default as well
+		err = db.Insert("users", map[string]interface{}{"id": int64(21), "name": "user 21"})
+		if err != nil {
+			t.Fatalf("Failed to insert without the new column: %v", err)
+		}
+		err = db.Insert("users", map[string]interface{}{"id": int64(22), "name": "user 22", "score": int64(3)})
+		if err != nil {
+			t.Fatalf("Failed to insert with the new column: %v", err)
+		}
+		if rows, err := db.SelectWhere("users", "score", "<", 10); err != nil || len(rows) != 1 {
+			t.Fatalf("Expected 1 row below the default, got %d, %v", len(rows), err)
+		}
+
+		// A snapshot from before keeps the old columns
+		rows, err := db.scanRows(snap, snap.tables["users"], nil)
+		if err != nil || len(rows) != 20 {
+			t.Fatalf("Expected the snapshot to see 20 rows, got %d, %v", len(rows), err)
+		}
+		if _, ok := rows[0].Values["score"]; ok {
+			t.Fatal("Expected the snapshot not to see the new column")
+		}
+
+		if err := db.AddColumn("users", Column{Name: "rank", Type: TInteger, NotNull: true}); err == nil {
+			t.Fatal("Expected a NOT NULL column without a default to be rejected")
+		}
+		if err := db.AddColumn("users", Column{Name: "name", Type: Tstring}); err == nil {
+			t.Fatal("Expected a duplicate column name to be rejected")
+		}
+		if err := db.AddColumn("users", Column{Name: "rank", Type: TInteger, Default: "high"}); err == nil {
+			t.Fatal("Expected a default of the wrong type to be rejected")
+		}
+		checkOK(t)
+	})
+
+	// Test: a dropped column disappears from old rows and its name can be reused
+	t.Run("Drop", func(t *testing.T) {
+		if err := db.DropColumn("users", "notes"); err != nil {
+			t.Fatalf("Failed to drop column: %v", err)
+		}
+		row, err := db.SelectByPK("users", int64(2))
+		if err != nil {
+			t.Fatalf("Failed to select row: %v", err)
+		}
+		if _, ok := row.Values["notes"]; ok {
+			t.Fatal("Expected the dropped column to be gone")
+		}
+		if row.Values["name"] != "user 2" || row.Values["score"] != int64(10) {
+			t.Fatalf("Expected the other columns to be intact, got %v", row.Values)
+		}
+
+		if err := db.AddColumn("users", Column{Name: "notes", Type: Tbool, Default: false}); err != nil {
+			t.Fatalf("Failed to add a column with a dropped name: %v", err)
+		}
+		row, _ = db.SelectByPK("users", int64(2))
+		if row.Values["notes"] != false {
+			t.Fatalf("Expected the new column to read its default, got %v", row.Values["notes"])
+		}
+
+		if err := db.DropColumn("users", "id"); err == nil {
+			t.Fatal("Expected dropping the primary key column to fail")
+		}
+		if err := db.DropColumn("users", "name"); err == nil {
+			t.Fatal("Expected dropping an indexed column to fail")
+		}
+		if err := db.DropColumn("users", "missing"); err == nil {
+			t.Fatal("Expected dropping a missing column to fail")
+		}
+		checkOK(t)
+	})
+
+	// Test: writing a row moves it to the current layout, and the values of
+	// dropped columns go when the old version is pruned
+	t.Run("Rewrite", func(t *testing.T) {
+		if _, err := db.Update("users", func(row *Row) bool { return true }, map[string]interface{}{"score": int64(1)}); err != nil {
+			t.Fatalf("Failed to update rows: %v", err)
+		}
+		table, _ := db.GetTableSchema("users")
+		if v := rowVersion(t, 1); v != table.SchemaVersion {
+			t.Fatalf("Expected the updated row to have schema version %d, got %d", table.SchemaVersion, v)
+		}
+		if err := db.pruneVersions(); err != nil {
+			t.Fatalf("Failed to prune: %v", err)
+		}
+		checkOK(t)
+	})
+
+	// Test: a renamed column keeps its values, index and primary key
+	t.Run("Rename", func(t *testing.T) {
+		if err := db.RenameColumn("users", "name", "login"); err != nil {
+			t.Fatalf("Failed to rename column: %v", err)
+		}
+		if err := db.RenameColumn("users", "id", "user_id"); err != nil {
+			t.Fatalf("Failed to rename primary key column: %v", err)
+		}
+
+		rows, err := db.SelectWhere("users", "login", "=", "user 3")
+		if err != nil || len(rows) != 1 || rows[0].Values["user_id"] != int64(3) {
+			t.Fatalf("Expected to find user 3 by its renamed column, got %v, %v", rows, err)
+		}
+		if _, err := db.SelectByPK("users", int64(4)); err != nil {
+			t.Fatalf("Failed to select by renamed primary key: %v", err)
+		}
+		err = db.Insert("users", map[string]interface{}{"user_id": int64(23), "login": "user 3"})
+		if err == nil {
+			t.Fatal("Expected the unique index to follow the renamed column")
+		}
+
+		if err := db.RenameColumn("users", "login", "score"); err == nil {
+			t.Fatal("Expected renaming onto an existing column to fail")
+		}
+		checkOK(t)
+	})
+
+	// Test: the schema history survives reopening
+	t.Run("Reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+
+		rows, err := db.SelectAll("users")
+		if err != nil || len(rows) != 22 {
+			t.Fatalf("Expected 22 rows, got %d, %v", len(rows), err)
+		}
+		for _, row := range rows {
+			if row.Values["notes"] != false || row.Values["score"] != int64(1) {
+				t.Fatalf("Expected every row to have its defaults and updates, got %v", row.Values)
+			}
+		}
+		checkOK(t)
+	})
+}
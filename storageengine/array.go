@@ -0,0 +1,128 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+)
+
+// TArray columns hold lists of values of one element type, set by the
+// column's Elem. They are stored like other variable length values, the data
+// being the element count as a uvarint followed by every element encoded as
+// in a column of the element type. Elements cannot be NULL.
+//
+// Arrays are written as any Go slice or array, such as []int64, []string or
+// []interface{}, and read back as []interface{}.
+
+// elemColumn returns the column describing the elements of an array column
+func elemColumn(col Column) Column {
+	return Column{Name: col.Name, Type: col.Elem, Scale: col.Scale, NotNull: true}
+}
+
+// toArray returns the elements of a slice or array
+func toArray(value interface{}) ([]interface{}, error) {
+	if elems, ok := value.([]interface{}); ok {
+		return elems, nil
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a slice value")
+	}
+	elems := make([]interface{}, v.Len())
+	for i := range elems {
+		elems[i] = v.Index(i).Interface()
+	}
+	return elems, nil
+}
+
+// encodeArray returns the data an array is stored as
+func encodeArray(col Column, value interface{}) ([]byte, error) {
+	elems, err := toArray(value)
+	if err != nil {
+		return nil, fmt.Errorf("column %s: %w", col.Name, err)
+	}
+
+	elemCol := elemColumn(col)
+	data := binary.AppendUvarint(nil, uint64(len(elems)))
+	for i, elem := range elems {
+		if elem == nil {
+			return nil, fmt.Errorf("column %s: array element %d is NULL", col.Name, i)
+		}
+		if data, err = appendValue(data, elemCol, elem); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// decodeArray returns the elements of an array stored as data
+func decodeArray(col Column, data []byte) ([]interface{}, error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return nil, fmt.Errorf("array in column %s is truncated", col.Name)
+	}
+
+	elemCol := elemColumn(col)
+	elems := make([]interface{}, count)
+	offset := n
+	for i := range elems {
+		elem, size, err := readValue(data[offset:], elemCol)
+		if err != nil {
+			return nil, err
+		}
+		if _, isPtr := elem.(overflowPointer); isPtr {
+			return nil, fmt.Errorf("array in column %s has an element stored out of line", col.Name)
+		}
+		elems[i] = elem
+		offset += size
+	}
+	if offset != len(data) {
+		return nil, fmt.Errorf("array in column %s has %d bytes left over", col.Name, len(data)-offset)
+	}
+	return elems, nil
+}
+
+// arrayCondition builds the row predicate of an array operator. CONTAINS
+// matches arrays holding value, or every element of value if it is itself a
+// slice. ANY matches arrays sharing at least one element with value.
+func arrayCondition(col *Column, op string, value interface{}) (func(row *Row) bool, error) {
+	// A value of the element type is a list of one
+	if validateValueType(value, elemColumn(*col)) == nil {
+		value = []interface{}{value}
+	}
+	wanted, err := normalizeValue(*col, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for column %s: %w", col.Name, err)
+	}
+	if wanted == nil {
+		return nil, fmt.Errorf("%s operator requires a value", op)
+	}
+
+	// has reports whether an array holds an element equal to want
+	has := func(elems []interface{}, want interface{}) bool {
+		for _, elem := range elems {
+			if compareValues(elem, want) == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(row *Row) bool {
+		elems, ok := row.Values[col.Name].([]interface{})
+		if !ok {
+			return false
+		}
+		for _, want := range wanted.([]interface{}) {
+			found := has(elems, want)
+			if op == "ANY" && found {
+				return true
+			}
+			if op == "CONTAINS" && !found {
+				return false
+			}
+		}
+		return op == "CONTAINS"
+	}, nil
+}
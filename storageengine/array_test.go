@@ -0,0 +1,195 @@
+package storageengine
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestArrayColumns tests storing arrays and querying them with CONTAINS and ANY
+func TestArrayColumns(t *testing.T) {
+	dbPath := "array_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "tags", Type: TArray, Elem: Tstring, NotNull: true},
+		{Name: "scores", Type: TArray, Elem: TInteger},
+		{Name: "prices", Type: TArray, Elem: TDecimal, Scale: 2},
+	}
+	if err := db.CreateTable("posts", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// Any Go slice will do
+	for i := 1; i <= 20; i++ {
+		values := map[string]interface{}{
+			"id":     int64(i),
+			"tags":   []string{"post", fmt.Sprintf("mod%d", i%3)},
+			"scores": []int{i, i * 10},
+			"prices": []interface{}{"1.50", NewDecimal(int64(i), 0)},
+		}
+		if i == 20 {
+			tags := make([]string, 500) // stored out of line
+			for j := range tags {
+				tags[j] = fmt.Sprintf("tag%d", j)
+			}
+			values["tags"] = tags
+		}
+		if i%5 == 0 {
+			values["scores"] = nil
+		}
+		if err := db.Insert("posts", values); err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+
+	checkOK := func(t *testing.T) {
+		t.Helper()
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Failed to check database: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("Expected no problems, got %v", report.Problems)
+		}
+	}
+
+	// count runs a SelectWhere and returns the number of rows
+	count := func(t *testing.T, column, op string, value interface{}) int {
+		t.Helper()
+		rows, err := db.SelectWhere("posts", column, op, value)
+		if err != nil {
+			t.Fatalf("Failed to select %s %s %v: %v", column, op, value, err)
+		}
+		return len(rows)
+	}
+
+	// queries checks the operators against the rows inserted above
+	queries := func(t *testing.T) {
+		t.Helper()
+		for _, q := range []struct {
+			column, op string
+			value      interface{}
+			want       int
+		}{
+			{"tags", "CONTAINS", "mod1", 7},
+			{"tags", "CONTAINS", []string{"post", "mod1"}, 7},
+			{"tags", "CONTAINS", []string{"mod1", "mod2"}, 0},
+			{"tags", "ANY", []string{"mod1", "mod2"}, 13},
+			{"tags", "ANY", "tag499", 1},
+			{"scores", "CONTAINS", 30, 1},
+			{"scores", "ANY", []int64{1, 2, 3}, 3},
+			{"prices", "CONTAINS", "7", 1},
+			{"prices", "CONTAINS", "1.5", 20},
+			{"tags", "=", []string{"post", "mod0"}, 6},
+			{"scores", "!=", []int{3, 30}, 15},
+		} {
+			if got := count(t, q.column, q.op, q.value); got != q.want {
+				t.Fatalf("Expected %d rows where %s %s %v, got %d", q.want, q.column, q.op, q.value, got)
+			}
+		}
+	}
+
+	// Test: arrays read back as []interface{} of their element values
+	t.Run("Query", func(t *testing.T) {
+		row, err := db.SelectByPK("posts", int64(4))
+		if err != nil {
+			t.Fatalf("Failed to select row: %v", err)
+		}
+		want := map[string]interface{}{
+			"tags":   []interface{}{"post", "mod1"},
+			"scores": []interface{}{int64(4), int64(40)},
+			"prices": []interface{}{NewDecimal(150, 2), NewDecimal(400, 2)},
+		}
+		for name, value := range want {
+			if !reflect.DeepEqual(row.Values[name], value) {
+				t.Fatalf("Expected %s to be %v, got %#v", name, value, row.Values[name])
+			}
+		}
+		row, _ = db.SelectByPK("posts", int64(20))
+		if tags := row.Values["tags"].([]interface{}); len(tags) != 500 || tags[499] != "tag499" {
+			t.Fatalf("Expected the array stored out of line to read back whole, got %d elements", len(tags))
+		}
+
+		queries(t)
+
+		if _, err := db.SelectWhere("posts", "id", "CONTAINS", 1); err == nil {
+			t.Fatal("Expected CONTAINS on a column that is not an array to be rejected")
+		}
+		if _, err := db.SelectWhere("posts", "scores", ">", []int{1}); err == nil {
+			t.Fatal("Expected ordering arrays to be rejected")
+		}
+		if _, err := db.SelectWhere("posts", "scores", "CONTAINS", "high"); err == nil {
+			t.Fatal("Expected a value of another element type to be rejected")
+		}
+		checkOK(t)
+	})
+
+	// Test: invalid arrays and array columns are rejected
+	t.Run("Invalid", func(t *testing.T) {
+		invalid := map[string]interface{}{
+			"tags":   []interface{}{"post", nil},
+			"scores": []string{"one"},
+			"prices": []string{"1.001"},
+		}
+		for column, value := range invalid {
+			values := map[string]interface{}{"id": int64(30), "tags": []string{}, column: value}
+			if err := db.Insert("posts", values); err == nil {
+				t.Fatalf("Expected %v to be rejected for column %s", value, column)
+			}
+		}
+		if err := db.Insert("posts", map[string]interface{}{"id": int64(30), "tags": "post"}); err == nil {
+			t.Fatal("Expected a value that is not a slice to be rejected")
+		}
+
+		if err := db.CreateIndex("posts", "posts_tags", []string{"tags"}, false); err == nil {
+			t.Fatal("Expected indexing an array column to be rejected")
+		}
+		for _, elem := range []ColumnType{TArray, TJSON, TArray + 1} {
+			if err := db.AddColumn("posts", Column{Name: "nested", Type: TArray, Elem: elem}); err == nil {
+				t.Fatalf("Expected an array of type %d to be rejected", elem)
+			}
+		}
+		checkOK(t)
+	})
+
+	// Test: array columns can be added with a default and updated
+	t.Run("Alter", func(t *testing.T) {
+		err := db.AddColumn("posts", Column{Name: "flags", Type: TArray, Elem: Tbool, NotNull: true, Default: []bool{}})
+		if err != nil {
+			t.Fatalf("Failed to add column: %v", err)
+		}
+		if got := count(t, "flags", "=", []bool{}); got != 20 {
+			t.Fatalf("Expected every row to read the empty default, got %d", got)
+		}
+		if err := db.UpdateByID("posts", 3, map[string]interface{}{"flags": []bool{true}}); err != nil {
+			t.Fatalf("Failed to update row: %v", err)
+		}
+		if got := count(t, "flags", "CONTAINS", true); got != 1 {
+			t.Fatalf("Expected the updated row to contain true, got %d", got)
+		}
+		checkOK(t)
+	})
+
+	// Test: element types and arrays survive reopening
+	t.Run("Reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+		queries(t)
+		checkOK(t)
+	})
+}
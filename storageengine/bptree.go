@@ -0,0 +1,603 @@
+package storageengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// B+tree nodes live in PTIndex pages. They share the common page header,
+// where RowCount holds the number of keys and the next page ID links a leaf
+// to its right sibling, followed by a leaf flag and the entries:
+//
+//	leaf:  [keyLen][key][value] ...
+//	inner: [child0] [keyLen][key][child] ...
+//
+// In an inner node, child i holds the keys below key i and child i+1 the
+// keys from key i up. Keys are unique byte strings; values are row IDs in
+// leaves and page IDs in inner nodes.
+//
+// Nodes are never merged, and a split keeps the lower half in the original
+// page and links it to the new upper half. A reader that follows right links
+// along the leaves therefore finds every key, even if the tree was split
+// between two of its page reads. Vacuum gets the space of emptied nodes back
+// by writing the whole tree anew, see compactBPTree.
+const (
+	bpLeafFlagOffset = pageHeaderSize
+	bpEntriesOffset  = pageHeaderSize + 1
+)
+
+// bpNode is a decoded B+tree node
+type bpNode struct {
+	id      uint64
+	tableID uint32
+	leaf    bool
+	next    uint64
+	keys    [][]byte
+	values  []uint64 // row IDs in a leaf, len(keys)+1 child page IDs in an inner node
+}
+
+// bpSplit describes the new right sibling created by a split
+type bpSplit struct {
+	key    []byte
+	pageID uint64
+}
+
+// maxIndexKeySize keeps at least four entries in every node
+func (db *Database) maxIndexKeySize() int {
+	return (db.pageSize-bpEntriesOffset)/4 - 2 - 8
+}
+
+// decodeBPNode decodes a B+tree node from an index page
+func decodeBPNode(page *Page) (*bpNode, error) {
+	if PageType(page.Data[0]) != PTIndex {
+		return nil, fmt.Errorf("page %d is not an index page", page.ID)
+	}
+
+	node := &bpNode{
+		id:      page.ID,
+		tableID: binary.LittleEndian.Uint32(page.Data[1:5]),
+		leaf:    page.Data[bpLeafFlagOffset] == 1,
+		next:    binary.LittleEndian.Uint64(page.Data[7:15]),
+	}
+	count := int(binary.LittleEndian.Uint16(page.Data[5:7]))
+
+	offset := bpEntriesOffset
+	readUint64 := func() (uint64, error) {
+		if offset+8 > len(page.Data) {
+			return 0, fmt.Errorf("index page %d is truncated", page.ID)
+		}
+		v := binary.LittleEndian.Uint64(page.Data[offset : offset+8])
+		offset += 8
+		return v, nil
+	}
+
+	if !node.leaf {
+		child, err := readUint64()
+		if err != nil {
+			return nil, err
+		}
+		node.values = append(node.values, child)
+	}
+
+	for i := 0; i < count; i++ {
+		if offset+2 > len(page.Data) {
+			return nil, fmt.Errorf("index page %d is truncated", page.ID)
+		}
+		keyLen := int(binary.LittleEndian.Uint16(page.Data[offset : offset+2]))
+		offset += 2
+		if offset+keyLen > len(page.Data) {
+			return nil, fmt.Errorf("index page %d is truncated", page.ID)
+		}
+		key := append([]byte(nil), page.Data[offset:offset+keyLen]...)
+		offset += keyLen
+
+		value, err := readUint64()
+		if err != nil {
+			return nil, err
+		}
+
+		node.keys = append(node.keys, key)
+		node.values = append(node.values, value)
+	}
+
+	return node, nil
+}
+
+// size returns the number of page bytes the encoded node needs
+func (n *bpNode) size() int {
+	size := bpEntriesOffset
+	if !n.leaf {
+		size += 8
+	}
+	for _, key := range n.keys {
+		size += 2 + len(key) + 8
+	}
+	return size
+}
+
+// encode writes the node into a fresh page image
+func (n *bpNode) encode(pageSize int) *Page {
+	page := &Page{
+		ID:   n.id,
+		Data: make([]byte, pageSize),
+	}
+
+	page.Data[0] = byte(PTIndex)
+	binary.LittleEndian.PutUint32(page.Data[1:5], n.tableID)
+	binary.LittleEndian.PutUint16(page.Data[5:7], uint16(len(n.keys)))
+	binary.LittleEndian.PutUint64(page.Data[7:15], n.next)
+	if n.leaf {
+		page.Data[bpLeafFlagOffset] = 1
+	}
+
+	offset := bpEntriesOffset
+	values := n.values
+	if !n.leaf {
+		binary.LittleEndian.PutUint64(page.Data[offset:offset+8], values[0])
+		offset += 8
+		values = values[1:]
+	}
+
+	for i, key := range n.keys {
+		binary.LittleEndian.PutUint16(page.Data[offset:offset+2], uint16(len(key)))
+		offset += 2
+		copy(page.Data[offset:], key)
+		offset += len(key)
+		binary.LittleEndian.PutUint64(page.Data[offset:offset+8], values[i])
+		offset += 8
+	}
+
+	binary.LittleEndian.PutUint16(page.Data[15:17], uint16(offset))
+	return page
+}
+
+// childIndex returns which child of an inner node covers key
+func (n *bpNode) childIndex(key []byte) int {
+	return sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) > 0
+	})
+}
+
+// createBPTree allocates an empty tree and returns its root page ID
+func (tx *Tx) createBPTree(tableID uint32) (uint64, error) {
+	page, err := tx.newPage()
+	if err != nil {
+		return 0, err
+	}
+	root := &bpNode{
+		id:      page.ID,
+		tableID: tableID,
+		leaf:    true,
+	}
+	if err := tx.writeBPNode(root); err != nil {
+		return 0, err
+	}
+	return root.id, nil
+}
+
+// readBPNode reads and decodes a node through src
+func readBPNode(src pageReader, pageID uint64) (*bpNode, error) {
+	page, err := src.readPage(pageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index page %d: %w", pageID, err)
+	}
+	defer src.unpinPage(page)
+
+	return decodeBPNode(page)
+}
+
+// writeBPNode stages an encoded node
+func (tx *Tx) writeBPNode(node *bpNode) error {
+	return tx.writePage(node.encode(tx.db.pageSize))
+}
+
+// bpInsert inserts or replaces a key and returns the root page ID, which
+// changes when the root splits
+func (tx *Tx) bpInsert(root uint64, key []byte, value uint64) (uint64, error) {
+	if len(key) > tx.db.maxIndexKeySize() {
+		return 0, fmt.Errorf("index key of %d bytes exceeds the maximum of %d", len(key), tx.db.maxIndexKeySize())
+	}
+
+	split, err := tx.bpInsertAt(root, key, value)
+	if err != nil || split == nil {
+		return root, err
+	}
+
+	// Grow the tree by one level
+	oldRoot, err := readBPNode(tx, root)
+	if err != nil {
+		return 0, err
+	}
+	page, err := tx.newPage()
+	if err != nil {
+		return 0, err
+	}
+	newRoot := &bpNode{
+		id:      page.ID,
+		tableID: oldRoot.tableID,
+		keys:    [][]byte{split.key},
+		values:  []uint64{root, split.pageID},
+	}
+	if err := tx.writeBPNode(newRoot); err != nil {
+		return 0, err
+	}
+	return newRoot.id, nil
+}
+
+// bpInsertAt inserts into the subtree rooted at pageID and reports a split to the parent
+func (tx *Tx) bpInsertAt(pageID uint64, key []byte, value uint64) (*bpSplit, error) {
+	node, err := readBPNode(tx, pageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.leaf {
+		i := sort.Search(len(node.keys), func(i int) bool {
+			return bytes.Compare(node.keys[i], key) >= 0
+		})
+		if i < len(node.keys) && bytes.Equal(node.keys[i], key) {
+			node.values[i] = value
+		} else {
+			node.keys = insertAt(node.keys, i, key)
+			node.values = insertAt(node.values, i, value)
+		}
+	} else {
+		i := node.childIndex(key)
+		split, err := tx.bpInsertAt(node.values[i], key, value)
+		if err != nil {
+			return nil, err
+		}
+		if split == nil {
+			return nil, nil
+		}
+		node.keys = insertAt(node.keys, i, split.key)
+		node.values = insertAt(node.values, i+1, split.pageID)
+	}
+
+	if node.size() <= tx.db.pageSize {
+		return nil, tx.writeBPNode(node)
+	}
+	return tx.splitBPNode(node)
+}
+
+// splitBPNode moves the upper half of a node into a new right sibling
+func (tx *Tx) splitBPNode(node *bpNode) (*bpSplit, error) {
+	mid := len(node.keys) / 2
+
+	page, err := tx.newPage()
+	if err != nil {
+		return nil, err
+	}
+	right := &bpNode{
+		id:      page.ID,
+		tableID: node.tableID,
+		leaf:    node.leaf,
+		next:    node.next,
+	}
+
+	var sepKey []byte
+	if node.leaf {
+		sepKey = node.keys[mid]
+		right.keys = append([][]byte(nil), node.keys[mid:]...)
+		right.values = append([]uint64(nil), node.values[mid:]...)
+		node.keys = node.keys[:mid]
+		node.values = node.values[:mid]
+	} else {
+		// The middle key moves up, it separates the two halves
+		sepKey = node.keys[mid]
+		right.keys = append([][]byte(nil), node.keys[mid+1:]...)
+		right.values = append([]uint64(nil), node.values[mid+1:]...)
+		node.keys = node.keys[:mid]
+		node.values = node.values[:mid+1]
+	}
+	node.next = right.id
+
+	// Write the new sibling first so the link never points at an empty page
+	if err := tx.writeBPNode(right); err != nil {
+		return nil, err
+	}
+	if err := tx.writeBPNode(node); err != nil {
+		return nil, err
+	}
+
+	return &bpSplit{key: sepKey, pageID: right.id}, nil
+}
+
+// bpDelete removes a key from the tree if it is present
+func (tx *Tx) bpDelete(root uint64, key []byte) error {
+	node, err := readBPNode(tx, root)
+	if err != nil {
+		return err
+	}
+
+	for !node.leaf {
+		node, err = readBPNode(tx, node.values[node.childIndex(key)])
+		if err != nil {
+			return err
+		}
+	}
+
+	i := sort.Search(len(node.keys), func(i int) bool {
+		return bytes.Compare(node.keys[i], key) >= 0
+	})
+	if i == len(node.keys) || !bytes.Equal(node.keys[i], key) {
+		return nil
+	}
+
+	node.keys = append(node.keys[:i], node.keys[i+1:]...)
+	node.values = append(node.values[:i], node.values[i+1:]...)
+	return tx.writeBPNode(node)
+}
+
+// freeBPTree frees every page of a tree
+func (tx *Tx) freeBPTree(root uint64) error {
+	node, err := readBPNode(tx, root)
+	if err != nil {
+		return err
+	}
+
+	if !node.leaf {
+		for _, child := range node.values {
+			if err := tx.freeBPTree(child); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.freePage(root)
+}
+
+// bpTreePages returns every page of a tree
+func bpTreePages(src pageReader, root uint64) ([]uint64, error) {
+	node, err := readBPNode(src, root)
+	if err != nil {
+		return nil, err
+	}
+
+	pageIDs := []uint64{root}
+	if !node.leaf {
+		for _, child := range node.values {
+			childPages, err := bpTreePages(src, child)
+			if err != nil {
+				return nil, err
+			}
+			pageIDs = append(pageIDs, childPages...)
+		}
+	}
+	return pageIDs, nil
+}
+
+// compactBPTree writes a tree anew with every node filled up and frees its old
+// pages, if that takes fewer pages. It returns the root page ID, which is new
+// if the tree was written.
+//
+// Readers that still use the old root keep finding everything there, freed
+// pages are left untouched until no snapshot can read them.
+func (tx *Tx) compactBPTree(root uint64) (uint64, error) {
+	pageIDs, err := bpTreePages(tx, root)
+	if err != nil {
+		return 0, err
+	}
+	node, err := readBPNode(tx, root)
+	if err != nil {
+		return 0, err
+	}
+
+	var keys [][]byte
+	var values []uint64
+	err = bpScan(tx, root, nil, nil, func(key []byte, value uint64) bool {
+		keys = append(keys, key)
+		values = append(values, value)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	levels := packBPTree(node.tableID, keys, values, tx.db.pageSize)
+	count := 0
+	for _, level := range levels {
+		count += len(level)
+	}
+	if count >= len(pageIDs) {
+		return root, nil
+	}
+
+	// Parents point at their children, so the leaves get their pages first
+	for i, level := range levels {
+		for _, node := range level {
+			page, err := tx.newPage()
+			if err != nil {
+				return 0, err
+			}
+			node.id = page.ID
+		}
+		for j, node := range level {
+			if j+1 < len(level) {
+				node.next = level[j+1].id
+			}
+			if i > 0 {
+				for k, child := range node.values {
+					node.values[k] = levels[i-1][child].id
+				}
+			}
+		}
+		for _, node := range level {
+			if err := tx.writeBPNode(node); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for _, pageID := range pageIDs {
+		if err := tx.freePage(pageID); err != nil {
+			return 0, err
+		}
+	}
+	return levels[len(levels)-1][0].id, nil
+}
+
+// moveBPTree moves the nodes of a tree that lie at or past end with move, and
+// points their parents and left siblings at the new pages. It returns the
+// root page ID, which is new if the root moved.
+func (tx *Tx) moveBPTree(root uint64, end uint64, move func(pageID uint64) (uint64, error)) (uint64, error) {
+	if root >= end {
+		var err error
+		if root, err = move(root); err != nil {
+			return 0, err
+		}
+	}
+
+	// Every level is linked from left to right, the children of a level are
+	// the next level in order
+	level := []uint64{root}
+	for {
+		var children []uint64
+		moved := make(map[uint64]uint64)
+		for _, pageID := range level {
+			node, err := readBPNode(tx, pageID)
+			if err != nil {
+				return 0, err
+			}
+			if node.leaf {
+				return root, nil
+			}
+
+			changed := false
+			for i, child := range node.values {
+				if child < end {
+					continue
+				}
+				newID, err := move(child)
+				if err != nil {
+					return 0, err
+				}
+				moved[child], node.values[i], changed = newID, newID, true
+			}
+			if changed {
+				if err := tx.writeBPNode(node); err != nil {
+					return 0, err
+				}
+			}
+			children = append(children, node.values...)
+		}
+
+		for _, pageID := range children {
+			node, err := readBPNode(tx, pageID)
+			if err != nil {
+				return 0, err
+			}
+			if newID, ok := moved[node.next]; ok {
+				node.next = newID
+				if err := tx.writeBPNode(node); err != nil {
+					return 0, err
+				}
+			}
+		}
+		level = children
+	}
+}
+
+// packBPTree lays out the nodes of a tree holding sorted keys, filling every
+// node up. It returns the levels from the leaves up to the root. Pages are not
+// assigned yet: the children of inner nodes are positions in the level below.
+func packBPTree(tableID uint32, keys [][]byte, values []uint64, pageSize int) [][]*bpNode {
+	level := []*bpNode{{tableID: tableID, leaf: true}}
+	lows := [][]byte{nil} // lowest key below every node
+	for i, key := range keys {
+		node := level[len(level)-1]
+		if len(node.keys) > 0 && node.size()+2+len(key)+8 > pageSize {
+			node = &bpNode{tableID: tableID, leaf: true}
+			level = append(level, node)
+			lows = append(lows, key)
+		}
+		node.keys = append(node.keys, key)
+		node.values = append(node.values, values[i])
+	}
+
+	levels := [][]*bpNode{level}
+	for len(level) > 1 {
+		var parents []*bpNode
+		var parentLows [][]byte
+		for i := range level {
+			parent := (*bpNode)(nil)
+			if len(parents) > 0 {
+				parent = parents[len(parents)-1]
+			}
+			if parent == nil || parent.size()+2+len(lows[i])+8 > pageSize {
+				parents = append(parents, &bpNode{tableID: tableID, values: []uint64{uint64(i)}})
+				parentLows = append(parentLows, lows[i])
+				continue
+			}
+			parent.keys = append(parent.keys, lows[i])
+			parent.values = append(parent.values, uint64(i))
+		}
+
+		// An inner node needs a key, the last one borrows a child from its neighbour
+		if n := len(parents); n > 1 && len(parents[n-1].keys) == 0 {
+			prev, last := parents[n-2], parents[n-1]
+			borrowed := len(prev.keys) - 1
+			last.keys = [][]byte{parentLows[n-1]}
+			last.values = []uint64{prev.values[borrowed+1], last.values[0]}
+			parentLows[n-1] = prev.keys[borrowed]
+			prev.keys = prev.keys[:borrowed]
+			prev.values = prev.values[:borrowed+1]
+		}
+
+		level, lows = parents, parentLows
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// bpScan calls fn for every key from lo (inclusive) up to hi (exclusive) in order.
+// A nil bound leaves that side open. Returning false from fn stops the scan.
+func bpScan(src pageReader, root uint64, lo, hi []byte, fn func(key []byte, value uint64) bool) error {
+	node, err := readBPNode(src, root)
+	if err != nil {
+		return err
+	}
+
+	for !node.leaf {
+		child := node.values[0]
+		if lo != nil {
+			child = node.values[node.childIndex(lo)]
+		}
+		node, err = readBPNode(src, child)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		for i, key := range node.keys {
+			if lo != nil && bytes.Compare(key, lo) < 0 {
+				continue
+			}
+			if hi != nil && bytes.Compare(key, hi) >= 0 {
+				return nil
+			}
+			if !fn(key, node.values[i]) {
+				return nil
+			}
+		}
+
+		if node.next == 0 {
+			return nil
+		}
+		node, err = readBPNode(src, node.next)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// insertAt inserts v into s at position i
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
@@ -0,0 +1,252 @@
+package storageengine
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// DefaultCacheSize is the buffer pool memory budget used when none is configured
+const DefaultCacheSize = 8 << 20
+
+// minPoolPages keeps the buffer pool usable with tiny budgets
+const minPoolPages = 16
+
+// BufferPoolStats reports how well the buffer pool fits a workload
+type BufferPoolStats struct {
+	Hits       uint64 // reads served from memory
+	Misses     uint64 // reads that went to the file
+	Evictions  uint64 // pages dropped to make room
+	WriteBacks uint64 // dirty pages written to the file
+	Pages      int    // pages currently cached
+	DirtyPages int    // cached pages not written to the file yet
+	Capacity   int    // pages the memory budget allows
+}
+
+// bufferPool caches page images in a fixed number of frames.
+//
+// Cached images are never modified in place. A commit installs new images for
+// the pages it changed, so a reader holding an older image keeps a consistent
+// copy of it. Readers pin a page while they use it; only unpinned frames are
+// evicted, and only their buffers are reused for other pages.
+//
+// Committed pages stay dirty in the pool until they are evicted or a checkpoint
+// flushes them. They are always in the WAL by then, so writing them back in any
+// order is safe.
+type bufferPool struct {
+	db       *Database
+	mu       sync.Mutex
+	capacity int
+	frames   map[uint64]*frame
+	lru      *list.List // frames, most recently used first
+	free     [][]byte   // buffers of evicted frames, ready for reuse
+	stats    BufferPoolStats
+}
+
+// frame holds one cached page
+type frame struct {
+	pageID uint64
+	data   []byte
+	pins   int
+	dirty  bool
+	elem   *list.Element
+}
+
+// newBufferPool creates a pool with room for cacheSize bytes of pages
+func newBufferPool(db *Database, cacheSize int) *bufferPool {
+	capacity := cacheSize / db.pageSize
+	if capacity < minPoolPages {
+		capacity = minPoolPages
+	}
+
+	return &bufferPool{
+		db:       db,
+		capacity: capacity,
+		frames:   make(map[uint64]*frame),
+		lru:      list.New(),
+	}
+}
+
+// fetch returns a pinned page, reading it from the file if it is not cached.
+// The page must not be modified and must be unpinned once the caller is done.
+func (p *bufferPool) fetch(pageID uint64) (*Page, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if f, ok := p.frames[pageID]; ok {
+		p.stats.Hits++
+		f.pins++
+		p.lru.MoveToFront(f.elem)
+		return &Page{ID: pageID, Data: f.data}, nil
+	}
+
+	p.stats.Misses++
+	if err := p.makeRoom(); err != nil {
+		return nil, err
+	}
+
+	data := p.buffer()
+	if err := p.db.readPageFromFile(pageID, data); err != nil {
+		p.free = append(p.free, data)
+		return nil, err
+	}
+
+	f := &frame{pageID: pageID, data: data, pins: 1}
+	f.elem = p.lru.PushFront(f)
+	p.frames[pageID] = f
+
+	return &Page{ID: pageID, Data: data}, nil
+}
+
+// unpin releases a page returned by fetch
+func (p *bufferPool) unpin(pageID uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if f, ok := p.frames[pageID]; ok && f.pins > 0 {
+		f.pins--
+	}
+}
+
+// install makes committed page images the cached ones. The pages must not be
+// modified afterwards; they are written back later.
+func (p *bufferPool) install(pages []*Page) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, page := range pages {
+		if f, ok := p.frames[page.ID]; ok {
+			// A pinned image may still be read, let the collector have it
+			if f.pins == 0 {
+				p.free = append(p.free, f.data)
+			}
+			f.data = page.Data
+			f.dirty = true
+			p.lru.MoveToFront(f.elem)
+			continue
+		}
+
+		if err := p.makeRoom(); err != nil {
+			return err
+		}
+		f := &frame{pageID: page.ID, data: page.Data, dirty: true}
+		f.elem = p.lru.PushFront(f)
+		p.frames[page.ID] = f
+	}
+
+	return nil
+}
+
+// flush writes every dirty page back to the file
+func (p *bufferPool) flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, f := range p.frames {
+		if err := p.writeBack(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cached reports whether a page is in the pool
+func (p *bufferPool) cached(pageID uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok := p.frames[pageID]
+	return ok
+}
+
+// discard drops the cached pages from pageID on without writing them back,
+// before the file is cut off there
+func (p *bufferPool) discard(pageID uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, f := range p.frames {
+		if id < pageID {
+			continue
+		}
+		p.lru.Remove(f.elem)
+		delete(p.frames, id)
+		if f.pins == 0 {
+			p.free = append(p.free, f.data)
+		}
+	}
+}
+
+// makeRoom evicts the least recently used unpinned page if the pool is full.
+// When every page is pinned the pool grows past its capacity for a while.
+// The caller must hold p.mu.
+func (p *bufferPool) makeRoom() error {
+	if len(p.frames) < p.capacity {
+		return nil
+	}
+
+	for elem := p.lru.Back(); elem != nil; elem = elem.Prev() {
+		f := elem.Value.(*frame)
+		if f.pins > 0 {
+			continue
+		}
+
+		if err := p.writeBack(f); err != nil {
+			return err
+		}
+
+		p.lru.Remove(elem)
+		delete(p.frames, f.pageID)
+		p.free = append(p.free, f.data)
+		p.stats.Evictions++
+		return nil
+	}
+
+	return nil
+}
+
+// writeBack writes a dirty frame to the file. The caller must hold p.mu.
+func (p *bufferPool) writeBack(f *frame) error {
+	if !f.dirty {
+		return nil
+	}
+
+	if err := p.db.writePage(&Page{ID: f.pageID, Data: f.data}); err != nil {
+		return fmt.Errorf("failed to write back page %d: %w", f.pageID, err)
+	}
+	f.dirty = false
+	p.stats.WriteBacks++
+	return nil
+}
+
+// buffer returns a page-sized buffer, reusing one of an evicted page if possible.
+// The caller must hold p.mu.
+func (p *bufferPool) buffer() []byte {
+	if n := len(p.free); n > 0 {
+		data := p.free[n-1]
+		p.free = p.free[:n-1]
+		return data
+	}
+	return make([]byte, p.db.pageSize)
+}
+
+// snapshotStats returns the counters together with the current fill level
+func (p *bufferPool) snapshotStats() BufferPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Pages = len(p.frames)
+	stats.Capacity = p.capacity
+	for _, f := range p.frames {
+		if f.dirty {
+			stats.DirtyPages++
+		}
+	}
+	return stats
+}
+
+// BufferPoolStats returns the buffer pool counters
+func (db *Database) BufferPoolStats() BufferPoolStats {
+	return db.pool.snapshotStats()
+}
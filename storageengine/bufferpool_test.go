@@ -0,0 +1,154 @@
+package storageengine
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestBufferPool tests caching, eviction and write-back with a pool smaller than the data
+func TestBufferPool(t *testing.T) {
+	dbPath := "bufferpool_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	const poolPages = 16
+	db, err := NewDatabaseWithOptions(dbPath, Options{PageSize: 4096, CacheSize: poolPages * 4096})
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+	}
+	if err := db.CreateTable("users", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// Enough rows to spread over several times the pool's pages
+	const rowCount = 3000
+	for i := 1; i <= rowCount; i += 100 {
+		tx := db.Begin()
+		for j := i; j < i+100; j++ {
+			err := tx.Insert("users", map[string]interface{}{
+				"id":   int64(j),
+				"name": fmt.Sprintf("user %04d with some padding to fill pages", j),
+			})
+			if err != nil {
+				t.Fatalf("Failed to insert row %d: %v", j, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+	}
+
+	// checkPins fails if a reader forgot to release a page
+	checkPins := func(t *testing.T) {
+		t.Helper()
+		db.pool.mu.Lock()
+		defer db.pool.mu.Unlock()
+		for id, f := range db.pool.frames {
+			if f.pins != 0 {
+				t.Fatalf("Page %d is still pinned %d times", id, f.pins)
+			}
+		}
+	}
+
+	// Test: the pool stays within its budget and writes back what it evicts
+	t.Run("Eviction", func(t *testing.T) {
+		rows, err := db.SelectAll("users")
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		if len(rows) != rowCount {
+			t.Fatalf("Expected %d rows, got %d", rowCount, len(rows))
+		}
+		checkPins(t)
+
+		stats := db.BufferPoolStats()
+		if stats.Capacity != poolPages {
+			t.Fatalf("Expected capacity %d, got %d", poolPages, stats.Capacity)
+		}
+		if stats.Pages > stats.Capacity {
+			t.Fatalf("Pool holds %d pages, more than its capacity of %d", stats.Pages, stats.Capacity)
+		}
+		if stats.Evictions == 0 || stats.WriteBacks == 0 {
+			t.Fatalf("Expected evictions and write-backs, got %+v", stats)
+		}
+	})
+
+	// Test: repeated reads of the same pages are served from memory
+	t.Run("Hits", func(t *testing.T) {
+		if _, err := db.SelectByID("users", 42); err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		before := db.BufferPoolStats()
+		for i := 0; i < 10; i++ {
+			row, err := db.SelectByID("users", 42)
+			if err != nil {
+				t.Fatalf("Failed to select: %v", err)
+			}
+			if row.Values["id"] != int64(42) {
+				t.Fatalf("Expected row 42, got %v", row.Values["id"])
+			}
+		}
+		after := db.BufferPoolStats()
+
+		if after.Misses != before.Misses {
+			t.Fatalf("Expected no misses, got %d", after.Misses-before.Misses)
+		}
+		if after.Hits <= before.Hits {
+			t.Fatal("Expected hits for repeated reads")
+		}
+		checkPins(t)
+	})
+
+	// Test: a checkpoint writes every dirty page back
+	t.Run("Checkpoint", func(t *testing.T) {
+		if err := db.UpdateByID("users", 7, map[string]interface{}{"name": "changed"}); err != nil {
+			t.Fatalf("Failed to update: %v", err)
+		}
+		if db.BufferPoolStats().DirtyPages == 0 {
+			t.Fatal("Expected dirty pages after an update")
+		}
+
+		if err := db.checkpoint(); err != nil {
+			t.Fatalf("Failed to checkpoint: %v", err)
+		}
+		if dirty := db.BufferPoolStats().DirtyPages; dirty != 0 {
+			t.Fatalf("Expected no dirty pages after a checkpoint, got %d", dirty)
+		}
+	})
+
+	// Test: everything written through the pool is found after a restart
+	t.Run("Reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+
+		count, err := db.GetRowCount("users")
+		if err != nil {
+			t.Fatalf("Failed to count rows: %v", err)
+		}
+		if count != rowCount {
+			t.Fatalf("Expected %d rows after reopen, got %d", rowCount, count)
+		}
+
+		row, err := db.SelectByID("users", 7)
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		if row.Values["name"] != "changed" {
+			t.Fatalf("Expected updated name, got %v", row.Values["name"])
+		}
+		checkPins(t)
+	})
+
+	db.Close()
+}
@@ -0,0 +1,521 @@
+package storageengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The catalog is the chain of table pages starting at the meta page, linked
+// through the next page ID in their header. A table definition that does not
+// fit on its table page continues on a chain of PTCatalog pages:
+//
+//	table page                      catalog page
+//	[21:29] first catalog page      [21:] next part of the definition,
+//	[29:33] definition length             up to the free offset
+//	[33:]   start of the definition
+//
+// Catalog pages are linked through the next page ID in their header.
+const (
+	tableDefNextOffset   = pageHeaderSize
+	tableDefLengthOffset = pageHeaderSize + 8
+	tableDefOffset       = pageHeaderSize + 12
+)
+
+// A definition is a list of entries, each a tag, a payload length and the
+// payload. New kinds of metadata, such as constraints, defaults or comments,
+// get a tag of their own. Unknown tags are rejected rather than skipped, so an
+// engine never rewrites a definition and silently drops what it did not read.
+//
+// The storage entry changes with most writes and comes first, so those writes
+// usually leave the catalog pages untouched.
+const (
+	catalogStorage byte = 1 // [next row ID][first page][last page][row index root]
+	catalogTable   byte = 2 // [name][primary key][schema version u32]
+	catalogColumn  byte = 3 // [name][type][flags][scale][element type][dimensions u16][distance][id u32][added u32][dropped u32][default], one per column in order
+	catalogIndex   byte = 4 // [name][flags][root page][column count u16][column names], then for a vector index [centroid page][centroid bytes u32][probes u16]
+)
+
+// Column definition flags. A column with a default value ends with its
+// encoding, see appendValue.
+const (
+	columnNotNull    byte = 1 << 0
+	columnHasDefault byte = 1 << 1
+)
+
+// Index definition flags
+const (
+	indexUnique  byte = 1 << 0
+	indexPrimary byte = 1 << 1
+	indexVector  byte = 1 << 2
+)
+
+// maxNameLength bounds the names of tables, columns and indexes in bytes
+const maxNameLength = 255
+
+// checkName checks that a table, column or index name can be stored
+func checkName(kind string, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s name cannot be empty", kind)
+	}
+	if len(name) > maxNameLength {
+		return fmt.Errorf("%s name is longer than %d bytes: %.20s...", kind, maxNameLength, name)
+	}
+	return nil
+}
+
+// catalogWriter appends entries to a table definition
+type catalogWriter struct {
+	buf   []byte
+	entry int // start of the open entry
+	err   error
+}
+
+func (w *catalogWriter) begin(tag byte) {
+	w.buf = append(w.buf, tag, 0, 0, 0, 0)
+	w.entry = len(w.buf)
+}
+
+func (w *catalogWriter) end() {
+	length := len(w.buf) - w.entry
+	binary.LittleEndian.PutUint32(w.buf[w.entry-4:w.entry], uint32(length))
+}
+
+func (w *catalogWriter) byte(v byte) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *catalogWriter) uint16(v uint16) {
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, v)
+}
+
+func (w *catalogWriter) uint32(v uint32) {
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, v)
+}
+
+func (w *catalogWriter) uint64(v uint64) {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, v)
+}
+
+func (w *catalogWriter) bytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+func (w *catalogWriter) string(s string) {
+	if len(s) > math.MaxUint16 {
+		if w.err == nil {
+			w.err = fmt.Errorf("name of %d bytes is too long", len(s))
+		}
+		s = ""
+	}
+	w.uint16(uint16(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// catalogReader reads a table definition, failing once it runs out of data
+type catalogReader struct {
+	data []byte
+	err  error
+}
+
+func (r *catalogReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = errors.New("table definition is truncated")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *catalogReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *catalogReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *catalogReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *catalogReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *catalogReader) string() string {
+	return string(r.next(int(r.uint16())))
+}
+
+// encodeTableDef encodes a table definition
+func encodeTableDef(table *Table) ([]byte, error) {
+	w := &catalogWriter{}
+
+	w.begin(catalogStorage)
+	w.uint64(table.NextRowID)
+	w.uint64(table.FirstPageID)
+	w.uint64(table.LastPageID)
+	w.uint64(table.RowIndexRoot)
+	w.end()
+
+	w.begin(catalogTable)
+	w.string(table.Name)
+	w.string(table.PK)
+	w.uint32(table.SchemaVersion)
+	w.end()
+
+	// Dropped columns follow the live ones, rows written before the drop still hold them
+	for _, columns := range [][]Column{table.Columns, table.dropped} {
+		for _, col := range columns {
+			var def []byte
+			var flags byte
+			if col.NotNull {
+				flags |= columnNotNull
+			}
+			if col.Default != nil {
+				flags |= columnHasDefault
+				var err error
+				if def, err = appendValue(nil, col, col.Default); err != nil {
+					return nil, fmt.Errorf("default value of column %s: %w", col.Name, err)
+				}
+			}
+			w.begin(catalogColumn)
+			w.string(col.Name)
+			w.byte(byte(col.Type))
+			w.byte(flags)
+			w.byte(col.Scale)
+			w.byte(byte(col.Elem))
+			w.uint16(col.Dim)
+			w.byte(byte(col.Distance))
+			w.uint32(col.id)
+			w.uint32(col.added)
+			w.uint32(col.dropped)
+			w.bytes(def)
+			w.end()
+		}
+	}
+
+	for _, index := range table.Indexes {
+		if len(index.Columns) > math.MaxUint16 {
+			return nil, fmt.Errorf("index %s has too many columns", index.Name)
+		}
+		var flags byte
+		if index.Unique {
+			flags |= indexUnique
+		}
+		if index.Primary {
+			flags |= indexPrimary
+		}
+		if index.Vector {
+			flags |= indexVector
+		}
+		w.begin(catalogIndex)
+		w.string(index.Name)
+		w.byte(flags)
+		w.uint64(index.RootPageID)
+		w.uint16(uint16(len(index.Columns)))
+		for _, name := range index.Columns {
+			w.string(name)
+		}
+		if index.Vector {
+			w.uint64(index.centroidChain.pageID)
+			w.uint32(index.centroidChain.length)
+			w.uint16(uint16(index.probes))
+		}
+		w.end()
+	}
+
+	if w.err != nil {
+		return nil, w.err
+	}
+	if len(w.buf) > math.MaxUint32 {
+		return nil, fmt.Errorf("table definition of %d bytes is too large", len(w.buf))
+	}
+	return w.buf, nil
+}
+
+// decodeTableDef decodes a table definition. Every entry must be read to its
+// end and the storage and table entries must be present.
+func decodeTableDef(data []byte) (*Table, error) {
+	table := &Table{}
+	seen := make(map[byte]bool)
+
+	r := &catalogReader{data: data}
+	for len(r.data) > 0 && r.err == nil {
+		tag := r.byte()
+		length := r.uint32()
+		payload := r.next(int(length))
+		if r.err != nil {
+			break
+		}
+
+		e := &catalogReader{data: payload}
+		switch tag {
+		case catalogStorage:
+			table.NextRowID = e.uint64()
+			table.FirstPageID = e.uint64()
+			table.LastPageID = e.uint64()
+			table.RowIndexRoot = e.uint64()
+		case catalogTable:
+			table.Name = e.string()
+			table.PK = e.string()
+			table.SchemaVersion = e.uint32()
+		case catalogColumn:
+			col := Column{Name: e.string(), Type: ColumnType(e.byte())}
+			flags := e.byte()
+			col.NotNull = flags&columnNotNull != 0
+			col.Scale = e.byte()
+			col.Elem = ColumnType(e.byte())
+			col.Dim = e.uint16()
+			col.Distance = VectorDistance(e.byte())
+			col.id = e.uint32()
+			col.added = e.uint32()
+			col.dropped = e.uint32()
+			if flags&columnHasDefault != 0 && e.err == nil {
+				val, n, err := readValue(e.data, col)
+				if err != nil {
+					return nil, fmt.Errorf("default value of column %s: %w", col.Name, err)
+				}
+				col.Default = val
+				e.next(n)
+			}
+			if col.dropped != 0 {
+				table.dropped = append(table.dropped, col)
+			} else {
+				table.Columns = append(table.Columns, col)
+			}
+		case catalogIndex:
+			index := Index{Name: e.string()}
+			flags := e.byte()
+			index.Unique = flags&indexUnique != 0
+			index.Primary = flags&indexPrimary != 0
+			index.RootPageID = e.uint64()
+			index.Columns = make([]string, 0, e.uint16())
+			for i := 0; i < cap(index.Columns) && e.err == nil; i++ {
+				index.Columns = append(index.Columns, e.string())
+			}
+			if index.Vector = flags&indexVector != 0; index.Vector {
+				index.centroidChain.pageID = e.uint64()
+				index.centroidChain.length = e.uint32()
+				index.probes = int(e.uint16())
+			}
+			table.Indexes = append(table.Indexes, index)
+		default:
+			return nil, fmt.Errorf("unknown table definition entry %d", tag)
+		}
+		if e.err != nil {
+			return nil, fmt.Errorf("table definition entry %d: %w", tag, e.err)
+		}
+		if len(e.data) != 0 {
+			return nil, fmt.Errorf("table definition entry %d has %d bytes left over", tag, len(e.data))
+		}
+		seen[tag] = true
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if !seen[catalogStorage] || !seen[catalogTable] {
+		return nil, errors.New("table definition is incomplete")
+	}
+	return table, nil
+}
+
+// readTableDef reads the definition starting on a table page, following its
+// catalog pages
+func readTableDef(src pageReader, page *Page) (*Table, error) {
+	length := int(binary.LittleEndian.Uint32(page.Data[tableDefLengthOffset : tableDefLengthOffset+4]))
+	first := min(length, len(page.Data)-tableDefOffset)
+	if freeOffset := int(binary.LittleEndian.Uint16(page.Data[15:17])); freeOffset != tableDefOffset+first {
+		return nil, fmt.Errorf("free offset %d does not match a definition of %d bytes", freeOffset, length)
+	}
+
+	def := make([]byte, 0, length)
+	def = append(def, page.Data[tableDefOffset:tableDefOffset+first]...)
+
+	pageID := binary.LittleEndian.Uint64(page.Data[tableDefNextOffset : tableDefNextOffset+8])
+	for len(def) < length {
+		if pageID == 0 {
+			return nil, fmt.Errorf("table definition ends after %d of %d bytes", len(def), length)
+		}
+		cont, err := src.readPage(pageID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read catalog page %d: %w", pageID, err)
+		}
+		pageType := PageType(cont.Data[0])
+		freeOffset := int(binary.LittleEndian.Uint16(cont.Data[15:17]))
+		next := binary.LittleEndian.Uint64(cont.Data[7:15])
+		// Every page holds part of the definition, which bounds the chain
+		valid := pageType == PTCatalog && freeOffset > pageHeaderSize && freeOffset <= len(cont.Data) &&
+			freeOffset-pageHeaderSize <= length-len(def)
+		if valid {
+			def = append(def, cont.Data[pageHeaderSize:freeOffset]...)
+		}
+		src.unpinPage(cont)
+		if !valid {
+			return nil, fmt.Errorf("catalog page %d does not continue the table definition", pageID)
+		}
+		pageID = next
+	}
+	if pageID != 0 {
+		return nil, fmt.Errorf("table definition continues past its length on page %d", pageID)
+	}
+
+	table, err := decodeTableDef(def)
+	if err != nil {
+		return nil, err
+	}
+	table.ID = binary.LittleEndian.Uint32(page.Data[1:5])
+	table.pageID = page.ID
+
+	for i := range table.Indexes {
+		if table.Indexes[i].Vector {
+			if err := loadCentroids(src, table, &table.Indexes[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return table, nil
+}
+
+// catalogPages returns the catalog pages a table definition continues on
+func catalogPages(src pageReader, page *Page) ([]uint64, error) {
+	var pageIDs []uint64
+	seen := make(map[uint64]bool)
+	for pageID := binary.LittleEndian.Uint64(page.Data[tableDefNextOffset : tableDefNextOffset+8]); pageID != 0; {
+		if seen[pageID] {
+			return nil, fmt.Errorf("catalog page %d loops back into the table definition", pageID)
+		}
+		seen[pageID] = true
+
+		cont, err := src.readPage(pageID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read catalog page %d: %w", pageID, err)
+		}
+		pageType := PageType(cont.Data[0])
+		next := binary.LittleEndian.Uint64(cont.Data[7:15])
+		src.unpinPage(cont)
+		if pageType != PTCatalog {
+			return nil, fmt.Errorf("table definition continues on page %d of type %d", pageID, pageType)
+		}
+
+		pageIDs = append(pageIDs, pageID)
+		pageID = next
+	}
+	return pageIDs, nil
+}
+
+// writeTablePage rewrites the table definition after its metadata changed
+func (tx *Tx) writeTablePage(table *Table) error {
+	page, err := tx.modifyPage(table.pageID)
+	if err != nil {
+		return fmt.Errorf("failed to read table page: %w", err)
+	}
+	return tx.writeTableDef(table, page)
+}
+
+// writeTableDef stores a table definition on its table page and as many
+// catalog pages as it needs. Catalog pages whose part of the definition did
+// not change are left alone, surplus ones are freed.
+func (tx *Tx) writeTableDef(table *Table, page *Page) error {
+	def, err := encodeTableDef(table)
+	if err != nil {
+		return fmt.Errorf("failed to serialize table %s: %w", table.Name, err)
+	}
+
+	chain, err := catalogPages(tx, page)
+	if err != nil {
+		return err
+	}
+
+	first := min(len(def), len(page.Data)-tableDefOffset)
+	rest := def[first:]
+	capacity := tx.db.pageSize - pageHeaderSize
+	needed := (len(rest) + capacity - 1) / capacity
+
+	for _, pageID := range chain[min(needed, len(chain)):] {
+		if err := tx.freePage(pageID); err != nil {
+			return err
+		}
+	}
+	if len(chain) > needed {
+		chain = chain[:needed]
+	}
+	existing := len(chain)
+	for len(chain) < needed {
+		newPage, err := tx.newPage()
+		if err != nil {
+			return err
+		}
+		chain = append(chain, newPage.ID)
+	}
+
+	for i, pageID := range chain {
+		part := rest[i*capacity : min((i+1)*capacity, len(rest))]
+		var next uint64
+		if i+1 < len(chain) {
+			next = chain[i+1]
+		}
+
+		var cont *Page
+		if i < existing {
+			cont, err = tx.readPage(pageID)
+			if err != nil {
+				return fmt.Errorf("failed to read catalog page %d: %w", pageID, err)
+			}
+			unchanged := binary.LittleEndian.Uint64(cont.Data[7:15]) == next &&
+				int(binary.LittleEndian.Uint16(cont.Data[15:17])) == pageHeaderSize+len(part) &&
+				bytes.Equal(cont.Data[pageHeaderSize:pageHeaderSize+len(part)], part)
+			tx.unpinPage(cont)
+			if unchanged {
+				continue
+			}
+			if cont, err = tx.modifyPage(pageID); err != nil {
+				return fmt.Errorf("failed to read catalog page %d: %w", pageID, err)
+			}
+		} else {
+			cont = &Page{ID: pageID, Data: make([]byte, tx.db.pageSize)}
+		}
+
+		clear(cont.Data)
+		cont.Data[0] = byte(PTCatalog)
+		binary.LittleEndian.PutUint32(cont.Data[1:5], table.ID)
+		binary.LittleEndian.PutUint64(cont.Data[7:15], next)
+		binary.LittleEndian.PutUint16(cont.Data[15:17], uint16(pageHeaderSize+len(part)))
+		copy(cont.Data[pageHeaderSize:], part)
+		if err := tx.writePage(cont); err != nil {
+			return err
+		}
+	}
+
+	// The header keeps the table's place in the catalog
+	clear(page.Data[tableDefNextOffset:])
+	var next uint64
+	if len(chain) > 0 {
+		next = chain[0]
+	}
+	binary.LittleEndian.PutUint64(page.Data[tableDefNextOffset:tableDefNextOffset+8], next)
+	binary.LittleEndian.PutUint32(page.Data[tableDefLengthOffset:tableDefLengthOffset+4], uint32(len(def)))
+	copy(page.Data[tableDefOffset:], def[:first])
+	binary.LittleEndian.PutUint16(page.Data[15:17], uint16(tableDefOffset+first))
+
+	return tx.writePage(page)
+}
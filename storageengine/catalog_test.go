@@ -0,0 +1,173 @@
+package storageengine
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestCatalog tests table definitions that need more than one page
+func TestCatalog(t *testing.T) {
+	dbPath := "catalog_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	// Many columns with long names, several pages worth of schema
+	var columns []Column
+	for i := 0; i < 100; i++ {
+		columns = append(columns, Column{
+			Name:    fmt.Sprintf("column_%03d_%s", i, strings.Repeat("x", 150)),
+			Type:    ColumnType(i % 4),
+			NotNull: i == 0,
+		})
+	}
+	if err := db.CreateTable("wide", columns, columns[0].Name); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for i := 1; i <= 10; i++ {
+		err := db.Insert("wide", map[string]interface{}{
+			columns[0].Name: int64(i),
+			columns[1].Name: fmt.Sprintf("row %d", i),
+		})
+		if err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+
+	// catalogPageCount returns how many catalog pages the definition continues on
+	catalogPageCount := func(t *testing.T) int {
+		t.Helper()
+		table, _ := db.GetTableSchema("wide")
+		page, err := db.readPage(table.pageID)
+		if err != nil {
+			t.Fatalf("Failed to read table page: %v", err)
+		}
+		defer db.unpinPage(page)
+		pageIDs, err := catalogPages(db, page)
+		if err != nil {
+			t.Fatalf("Failed to walk catalog pages: %v", err)
+		}
+		return len(pageIDs)
+	}
+
+	checkOK := func(t *testing.T) {
+		t.Helper()
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Failed to check database: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("Expected no problems, got %v", report.Problems)
+		}
+	}
+
+	if catalogPageCount(t) < 3 {
+		t.Fatalf("Expected the definition to span several catalog pages, got %d", catalogPageCount(t))
+	}
+	checkOK(t)
+
+	// Test: names are bounded and checked up front
+	t.Run("Names", func(t *testing.T) {
+		long := strings.Repeat("n", maxNameLength+1)
+		if err := db.CreateTable(long, columns[:1], ""); err == nil {
+			t.Fatal("Expected an error for a table name that is too long")
+		}
+		if err := db.CreateTable("bad", []Column{{Name: long, Type: TInteger}}, ""); err == nil {
+			t.Fatal("Expected an error for a column name that is too long")
+		}
+		if err := db.CreateTable("bad", []Column{{Name: "", Type: TInteger}}, ""); err == nil {
+			t.Fatal("Expected an error for an empty column name")
+		}
+		if err := db.CreateIndex("wide", long, []string{columns[1].Name}, false); err == nil {
+			t.Fatal("Expected an error for an index name that is too long")
+		}
+	})
+
+	// Test: the definition grows and shrinks its chain of catalog pages
+	t.Run("GrowShrink", func(t *testing.T) {
+		before := catalogPageCount(t)
+		for i := 1; i <= 20; i++ {
+			name := fmt.Sprintf("wide_%02d_%s", i, strings.Repeat("i", 200))
+			if err := db.CreateIndex("wide", name, []string{columns[i].Name, columns[i+20].Name}, false); err != nil {
+				t.Fatalf("Failed to create index %d: %v", i, err)
+			}
+		}
+		grown := catalogPageCount(t)
+		if grown <= before {
+			t.Fatalf("Expected more than %d catalog pages with the indexes, got %d", before, grown)
+		}
+		checkOK(t)
+
+		for i := 1; i <= 10; i++ {
+			name := fmt.Sprintf("wide_%02d_%s", i, strings.Repeat("i", 200))
+			if err := db.DropIndex("wide", name); err != nil {
+				t.Fatalf("Failed to drop index %d: %v", i, err)
+			}
+		}
+		if catalogPageCount(t) >= grown {
+			t.Fatalf("Expected fewer than %d catalog pages after dropping indexes, got %d", grown, catalogPageCount(t))
+		}
+		checkOK(t)
+	})
+
+	// Test: the whole definition is read back after a restart
+	t.Run("Reopen", func(t *testing.T) {
+		before, _ := db.GetTableSchema("wide")
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+
+		after, err := db.GetTableSchema("wide")
+		if err != nil {
+			t.Fatalf("Failed to get schema: %v", err)
+		}
+		if !reflect.DeepEqual(after, before) {
+			t.Fatalf("Expected the definition to survive a restart:\nbefore %+v\nafter  %+v", before, after)
+		}
+
+		rows, err := db.SelectWhere("wide", columns[1].Name, "=", "row 7")
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		if len(rows) != 1 || rows[0].Values[columns[0].Name] != int64(7) {
+			t.Fatalf("Expected row 7, got %v", rows)
+		}
+		checkOK(t)
+	})
+
+	// Test: damaged definitions are rejected instead of read past their end
+	t.Run("Decode", func(t *testing.T) {
+		table, _ := db.GetTableSchema("wide")
+		def, err := encodeTableDef(table)
+		if err != nil {
+			t.Fatalf("Failed to encode definition: %v", err)
+		}
+		for n := 0; n < len(def); n++ {
+			// Only a cut between two entries leaves something that decodes
+			cut, err := decodeTableDef(def[:n])
+			if err != nil {
+				continue
+			}
+			if encoded, _ := encodeTableDef(cut); string(encoded) != string(def[:n]) {
+				t.Fatalf("Expected an error for a definition cut to %d of %d bytes", n, len(def))
+			}
+		}
+		unknown := append(append([]byte(nil), def...), 99, 0, 0, 0, 0)
+		if _, err := decodeTableDef(unknown); err == nil {
+			t.Fatal("Expected an error for an unknown definition entry")
+		}
+	})
+
+	db.Close()
+}
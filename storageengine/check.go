@@ -0,0 +1,467 @@
+package storageengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// CheckProblem is an inconsistency found by Check
+type CheckProblem struct {
+	PageID  uint64 // page the problem was found on
+	Table   string // table the page belongs to, empty if none
+	Message string
+}
+
+func (p CheckProblem) String() string {
+	if p.Table == "" {
+		return fmt.Sprintf("page %d: %s", p.PageID, p.Message)
+	}
+	return fmt.Sprintf("page %d (%s): %s", p.PageID, p.Table, p.Message)
+}
+
+// CheckReport is the result of checking a database file
+type CheckReport struct {
+	Pages    int // pages in the file
+	Tables   int
+	Rows     int // row records decoded, old versions included
+	Problems []CheckProblem
+}
+
+// OK reports whether the check found no problems
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// checker holds the state of a single Check run
+type checker struct {
+	db         *Database
+	report     *CheckReport
+	nextPageID uint64
+	owners     map[uint64]string // page ID -> what uses it
+	corrupt    map[uint64]bool
+	missing    map[uint64]bool // pages past the end of a file that was cut short
+}
+
+// Check walks the whole database file and reports what is inconsistent: pages
+// failing their checksum, broken or cyclic data page chains, page headers that
+// disagree with the records on the page, rows that do not decode against their
+// table's schema, row index entries pointing nowhere and pages that are used
+// twice or not at all.
+//
+// Writers wait while the check runs. The returned error is only set if the
+// file cannot be read at all, everything else ends up in the report. That
+// includes a file cut short, whose missing pages are reported like corrupt
+// ones.
+func (db *Database) Check() (*CheckReport, error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	db.mu.RLock()
+	tables := db.tables
+	nextPageID := db.nextPageID
+	db.mu.RUnlock()
+
+	info, err := db.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checker{
+		db:         db,
+		report:     &CheckReport{Pages: int(nextPageID), Tables: len(tables)},
+		nextPageID: nextPageID,
+		owners:     map[uint64]string{metaPageID: "meta page"},
+		corrupt:    make(map[uint64]bool),
+		missing:    make(map[uint64]bool),
+	}
+
+	// Pages committed since the last checkpoint may only be in the buffer
+	// pool, the others must be in the file
+	fileEnd := uint64(info.Size()) / uint64(db.pageSize)
+	for pageID := fileEnd; pageID < nextPageID; pageID++ {
+		if !db.pool.cached(pageID) {
+			c.missing[pageID] = true
+		}
+	}
+	if len(c.missing) > 0 {
+		c.problem(fileEnd, "", "file ends at page %d, the meta page expects %d pages", fileEnd, nextPageID)
+	}
+
+	for _, pageID := range db.quarantined {
+		c.problem(pageID, "", "catalog page was quarantined when the database was opened")
+		c.corrupt[pageID] = true
+	}
+
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := c.checkTable(tables[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.checkFreeList(); err != nil {
+		return nil, err
+	}
+
+	// Every page must belong to something
+	for pageID := uint64(0); pageID < nextPageID; pageID++ {
+		if _, used := c.owners[pageID]; used || c.corrupt[pageID] || c.missing[pageID] {
+			continue
+		}
+		page, err := c.readPage(pageID, "")
+		if err != nil {
+			return nil, err
+		}
+		if page != nil {
+			db.unpinPage(page)
+			c.problem(pageID, "", "page is not used by any table or the free list")
+		}
+	}
+
+	return c.report, nil
+}
+
+// problem adds a problem to the report
+func (c *checker) problem(pageID uint64, table string, format string, args ...interface{}) {
+	c.report.Problems = append(c.report.Problems, CheckProblem{
+		PageID:  pageID,
+		Table:   table,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// readPage reads a page, reporting it once if it is corrupt. It returns a nil
+// page if the page cannot be used and an error only for failed reads.
+func (c *checker) readPage(pageID uint64, table string) (*Page, error) {
+	if pageID >= c.nextPageID {
+		c.problem(pageID, table, "page is past the end of the file")
+		return nil, nil
+	}
+	if c.corrupt[pageID] {
+		return nil, nil
+	}
+	if c.missing[pageID] {
+		c.corrupt[pageID] = true
+		c.problem(pageID, table, "page is missing, the file ends before it")
+		return nil, nil
+	}
+
+	page, err := c.db.readPage(pageID)
+	if errors.Is(err, ErrCorruptPage) {
+		c.corrupt[pageID] = true
+		c.problem(pageID, table, "page fails its checksum")
+		return nil, nil
+	}
+	return page, err
+}
+
+// claim records that owner uses a page and reports pages used twice
+func (c *checker) claim(pageID uint64, table string, owner string) bool {
+	if other, used := c.owners[pageID]; used {
+		c.problem(pageID, table, "page is used by %s and %s", other, owner)
+		return false
+	}
+	c.owners[pageID] = owner
+	return true
+}
+
+// checkTable checks a table's definition pages, data pages and indexes
+func (c *checker) checkTable(table *Table) error {
+	if err := c.checkCatalogPages(table); err != nil {
+		return err
+	}
+
+	versions, err := c.checkDataPages(table)
+	if err != nil {
+		return err
+	}
+
+	if err := c.checkTree(table, table.RowIndexRoot, "row index of "+table.Name); err != nil {
+		return err
+	}
+	for _, index := range table.Indexes {
+		if err := c.checkTree(table, index.RootPageID, "index "+index.Name); err != nil {
+			return err
+		}
+		if index.centroidChain.pageID != 0 {
+			err := walkChain(c.db, PTIndex, index.centroidChain, func(pageID uint64, _ []byte) {
+				c.claim(pageID, table.Name, "index "+index.Name)
+			})
+			if err != nil {
+				c.problem(index.centroidChain.pageID, table.Name, "centroids of index %s: %v", index.Name, err)
+			}
+		}
+	}
+
+	// Every row index entry must point at a version of its own row
+	err = bpScan(c.db, table.RowIndexRoot, nil, nil, func(key []byte, value uint64) bool {
+		rowID := rowKeyID(key)
+		ptr := unpackRowPtr(value)
+		if id, ok := versions[ptr]; !ok || id != rowID {
+			c.problem(ptr.PageID, table.Name, "row index entry for row %d points at slot %d, which holds no version of it", rowID, ptr.Slot)
+		}
+		return true
+	})
+	if errors.Is(err, ErrCorruptPage) || errors.Is(err, io.EOF) {
+		return nil // Already reported by checkTree
+	}
+	return err
+}
+
+// checkCatalogPages claims the table page and the catalog pages its
+// definition continues on
+func (c *checker) checkCatalogPages(table *Table) error {
+	owner := "table " + table.Name
+	c.claim(table.pageID, table.Name, owner)
+
+	page, err := c.readPage(table.pageID, table.Name)
+	if err != nil || page == nil {
+		return err
+	}
+	pageID := binary.LittleEndian.Uint64(page.Data[tableDefNextOffset : tableDefNextOffset+8])
+	c.db.unpinPage(page)
+
+	last := table.pageID
+	for pageID != 0 {
+		page, err := c.readPage(pageID, table.Name)
+		if err != nil || page == nil {
+			return err
+		}
+		pageType := PageType(page.Data[0])
+		next := binary.LittleEndian.Uint64(page.Data[7:15])
+		c.db.unpinPage(page)
+
+		if pageType != PTCatalog {
+			c.problem(last, table.Name, "table definition continues on page %d of type %d", pageID, pageType)
+			return nil
+		}
+		if !c.claim(pageID, table.Name, owner) {
+			return nil // Also stops a loop
+		}
+		last, pageID = pageID, next
+	}
+	return nil
+}
+
+// checkDataPages walks a table's chain of data pages and checks every record.
+// It returns the row ID of every record found by its position.
+func (c *checker) checkDataPages(table *Table) (map[RowPtr]uint64, error) {
+	versions := make(map[RowPtr]uint64)
+	visited := make(map[uint64]bool)
+
+	var last uint64
+	for pageID := table.FirstPageID; pageID != 0; {
+		if visited[pageID] {
+			c.problem(last, table.Name, "next page %d loops back into the data page chain", pageID)
+			return versions, nil
+		}
+		visited[pageID] = true
+
+		page, err := c.readPage(pageID, table.Name)
+		if err != nil {
+			return nil, err
+		}
+		if page == nil {
+			c.problem(pageID, table.Name, "data page chain is broken at this page")
+			return versions, nil
+		}
+
+		next := binary.LittleEndian.Uint64(page.Data[7:15])
+		if PageType(page.Data[0]) != PTData {
+			c.problem(pageID, table.Name, "data page chain reaches a page of type %d", page.Data[0])
+			c.db.unpinPage(page)
+			return versions, nil
+		}
+		if c.claim(pageID, table.Name, "table "+table.Name) {
+			c.checkDataPage(table, page, versions)
+		}
+		c.db.unpinPage(page)
+
+		last = pageID
+		pageID = next
+	}
+
+	if last != table.LastPageID {
+		c.problem(last, table.Name, "data page chain ends here instead of at the last page %d", table.LastPageID)
+	}
+	return versions, nil
+}
+
+// checkDataPage checks that a data page's slots agree with its records and
+// that every record decodes against the table's schema
+func (c *checker) checkDataPage(table *Table, page *Page, versions map[RowPtr]uint64) {
+	if id := binary.LittleEndian.Uint32(page.Data[1:5]); id != table.ID {
+		c.problem(page.ID, table.Name, "data page belongs to table ID %d instead of %d", id, table.ID)
+	}
+
+	count := slotCount(page)
+	freeOffset := binary.LittleEndian.Uint16(page.Data[15:17])
+	if int(freeOffset) < pageHeaderSize || int(freeOffset) > directoryStart(page, count) {
+		c.problem(page.ID, table.Name, "free offset %d is outside the space left by a row count of %d slots", freeOffset, count)
+		return
+	}
+	if count > 0 && slotOffset(page, count-1) == 0 {
+		c.problem(page.ID, table.Name, "row count %d ends in an unused slot", count)
+	}
+
+	type extent struct {
+		slot       uint16
+		start, end uint16
+	}
+	var extents []extent
+	for slot := uint16(0); slot < count; slot++ {
+		offset := slotOffset(page, slot)
+		if offset == 0 {
+			continue
+		}
+		record, err := readRowRecord(page, offset)
+		if err != nil || offset < pageHeaderSize || offset+record.size() > freeOffset {
+			c.problem(page.ID, table.Name, "slot %d points at offset %d, outside of the records ending at the free offset %d", slot, offset, freeOffset)
+			continue
+		}
+		extents = append(extents, extent{slot: slot, start: offset, end: offset + record.size()})
+		c.report.Rows++
+
+		if record.rowID == 0 || record.rowID >= table.NextRowID {
+			c.problem(page.ID, table.Name, "record in slot %d has row ID %d outside of 1 to %d", slot, record.rowID, table.NextRowID-1)
+		}
+		versions[RowPtr{PageID: page.ID, Slot: slot}] = record.rowID
+
+		version, layout, values, err := decodeRow(record.payload, table)
+		if err == nil {
+			// A record that decodes must also be exactly what its values encode to
+			var data []byte
+			data, err = encodeRow(version, layout, values)
+			if err == nil && !bytes.Equal(data, record.payload) {
+				err = fmt.Errorf("%d bytes of row data encode to %d", len(record.payload), len(data))
+			}
+		}
+		if err != nil {
+			c.problem(page.ID, table.Name, "row %d in slot %d does not match the schema: %v", record.rowID, slot, err)
+		} else {
+			c.checkOverflow(table, page.ID, record.rowID, layout, values)
+		}
+	}
+
+	// Records are packed together right after the header
+	sort.Slice(extents, func(i, j int) bool { return extents[i].start < extents[j].start })
+	end := uint16(pageHeaderSize)
+	for i, e := range extents {
+		if e.start < end {
+			c.problem(page.ID, table.Name, "record in slot %d overlaps the record in slot %d", e.slot, extents[i-1].slot)
+		} else if e.start > end {
+			c.problem(page.ID, table.Name, "%d bytes at offset %d belong to no slot", e.start-end, end)
+		}
+		end = max(end, e.end)
+	}
+	if end != freeOffset {
+		c.problem(page.ID, table.Name, "free offset %d does not match the end of the records at %d", freeOffset, end)
+	}
+}
+
+// checkOverflow claims the overflow pages of a row's values stored out of line
+// and checks that each chain holds its whole value
+func (c *checker) checkOverflow(table *Table, pageID uint64, rowID uint64, layout []Column, values []interface{}) {
+	for i, col := range layout {
+		ptr, ok := values[i].(overflowPointer)
+		if !ok {
+			continue
+		}
+		err := walkOverflow(c.db, ptr, func(pageID uint64, _ []byte) {
+			c.claim(pageID, table.Name, "table "+table.Name)
+		})
+		if err != nil {
+			c.problem(pageID, table.Name, "row %d column %s: %v", rowID, col.Name, err)
+		}
+	}
+}
+
+// checkTree checks that every node of a B+tree can be read and claims its pages
+func (c *checker) checkTree(table *Table, pageID uint64, owner string) error {
+	page, err := c.readPage(pageID, table.Name)
+	if err != nil || page == nil {
+		return err
+	}
+	node, err := decodeBPNode(page)
+	c.db.unpinPage(page)
+	if err != nil {
+		c.problem(pageID, table.Name, "%s: %v", owner, err)
+		return nil
+	}
+	if !c.claim(pageID, table.Name, owner) || node.leaf {
+		return nil
+	}
+
+	for _, child := range node.values {
+		if err := c.checkTree(table, child, owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFreeList claims the free list's pages and the pages it holds
+func (c *checker) checkFreeList() error {
+	page, err := c.readPage(metaPageID, "")
+	if err != nil || page == nil {
+		return err
+	}
+	meta, err := decodeMeta(page)
+	c.db.unpinPage(page)
+	if err != nil {
+		c.problem(metaPageID, "", "%v", err)
+		return nil
+	}
+
+	visited := make(map[uint64]bool)
+	for trunkID := meta.freeHead; trunkID != 0; {
+		if visited[trunkID] {
+			c.problem(trunkID, "", "free list loops back to this page")
+			return nil
+		}
+		visited[trunkID] = true
+
+		trunk, err := c.readPage(trunkID, "")
+		if err != nil || trunk == nil {
+			return err
+		}
+		if PageType(trunk.Data[0]) != PTFree {
+			c.problem(trunkID, "", "free list reaches a page of type %d", trunk.Data[0])
+			c.db.unpinPage(trunk)
+			return nil
+		}
+		c.claim(trunkID, "", "the free list")
+
+		start := int(binary.LittleEndian.Uint16(trunk.Data[freeStartOffset : freeStartOffset+2]))
+		count := int(binary.LittleEndian.Uint16(trunk.Data[5:7]))
+		if freeEntriesOffset+count*freeEntrySize > len(trunk.Data) {
+			c.problem(trunkID, "", "free list page holds more entries than fit")
+			count = start
+		}
+		for i := start; i < count; i++ {
+			offset := freeEntriesOffset + i*freeEntrySize
+			pageID := binary.LittleEndian.Uint64(trunk.Data[offset : offset+8])
+			if pageID >= c.nextPageID {
+				c.problem(trunkID, "", "free list holds page %d past the end of the file", pageID)
+				continue
+			}
+			c.claim(pageID, "", "the free list")
+		}
+
+		next := binary.LittleEndian.Uint64(trunk.Data[7:15])
+		c.db.unpinPage(trunk)
+		if next == 0 && trunkID != meta.freeTail {
+			c.problem(trunkID, "", "free list ends here instead of at page %d", meta.freeTail)
+		}
+		trunkID = next
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestCheck tests that a healthy database passes the check and damage is reported
+func TestCheck(t *testing.T) {
+	dbPath := "check_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+		{Name: "score", Type: Tfloat, NotNull: false},
+	}
+	if err := db.CreateTable("players", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	tx := db.Begin()
+	for i := 1; i <= 400; i++ {
+		err := tx.Insert("players", map[string]interface{}{
+			"id":    int64(i),
+			"name":  fmt.Sprintf("player %03d", i),
+			"score": float64(i) / 2,
+		})
+		if err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	// Leave old versions, freed pages and a dropped index behind
+	if err := db.CreateIndex("players", "players_name", []string{"name"}, true); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	if _, err := db.Update("players", func(row *Row) bool {
+		return row.Values["id"].(int64)%3 == 0
+	}, map[string]interface{}{"score": nil}); err != nil {
+		t.Fatalf("Failed to update rows: %v", err)
+	}
+	if _, err := db.Delete("players", func(row *Row) bool {
+		return row.Values["id"].(int64) <= 100
+	}); err != nil {
+		t.Fatalf("Failed to delete rows: %v", err)
+	}
+	if err := db.pruneVersions(); err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	if err := db.DropIndex("players", "players_name"); err != nil {
+		t.Fatalf("Failed to drop index: %v", err)
+	}
+
+	// Test: a healthy database has nothing to report
+	report, err := db.Check()
+	if err != nil {
+		t.Fatalf("Failed to check database: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("Expected no problems, got %v", report.Problems)
+	}
+	if report.Tables != 1 || report.Rows < 300 {
+		t.Fatalf("Expected 1 table and at least 300 rows checked, got %+v", report)
+	}
+
+	table, _ := db.GetTableSchema("players")
+	firstPageID, lastPageID := table.FirstPageID, table.LastPageID
+	if firstPageID == lastPageID {
+		t.Fatal("Expected the table to span several data pages")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	original, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to read database file: %v", err)
+	}
+
+	// checkDamaged damages a page, checks the file and restores it
+	checkDamaged := func(t *testing.T, pageID uint64, damage func(data []byte), keepChecksum bool, want string) {
+		t.Helper()
+		damaged := append([]byte(nil), original...)
+		page := &Page{ID: pageID, Data: damaged[pageID*4096 : (pageID+1)*4096]}
+		damage(page.Data)
+		if keepChecksum {
+			setPageChecksum(page)
+		}
+		if err := os.WriteFile(dbPath, damaged, 0666); err != nil {
+			t.Fatalf("Failed to write database file: %v", err)
+		}
+		defer os.WriteFile(dbPath, original, 0666)
+
+		db, err := NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to open damaged database: %v", err)
+		}
+		defer db.Close()
+
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Failed to check database: %v", err)
+		}
+		for _, problem := range report.Problems {
+			if problem.PageID == pageID && strings.Contains(problem.Message, want) {
+				return
+			}
+		}
+		t.Fatalf("Expected a problem on page %d mentioning %q, got %v", pageID, want, report.Problems)
+	}
+
+	t.Run("Checksum", func(t *testing.T) {
+		checkDamaged(t, firstPageID, func(data []byte) { data[200] ^= 0xFF }, false, "checksum")
+	})
+
+	t.Run("RowCount", func(t *testing.T) {
+		checkDamaged(t, firstPageID, func(data []byte) {
+			count := binary.LittleEndian.Uint16(data[5:7])
+			binary.LittleEndian.PutUint16(data[5:7], count+1)
+		}, true, "row count")
+	})
+
+	t.Run("FreeOffset", func(t *testing.T) {
+		checkDamaged(t, firstPageID, func(data []byte) {
+			offset := binary.LittleEndian.Uint16(data[15:17])
+			binary.LittleEndian.PutUint16(data[15:17], offset+10)
+		}, true, "free offset")
+	})
+
+	t.Run("Slot", func(t *testing.T) {
+		checkDamaged(t, firstPageID, func(data []byte) {
+			offset := binary.LittleEndian.Uint16(data[15:17])
+			binary.LittleEndian.PutUint16(data[len(data)-2:], offset)
+		}, true, "slot 0")
+	})
+
+	t.Run("Cycle", func(t *testing.T) {
+		checkDamaged(t, lastPageID, func(data []byte) {
+			binary.LittleEndian.PutUint64(data[7:15], firstPageID)
+		}, true, "loops")
+	})
+
+	t.Run("Schema", func(t *testing.T) {
+		checkDamaged(t, firstPageID, func(data []byte) {
+			// Claim the first record's name is much longer than the record
+			payload := pageHeaderSize + rowHeaderSize + rowVersionSize + 1 + 8
+			binary.LittleEndian.PutUint16(data[payload:payload+2], 1000)
+		}, true, "schema")
+	})
+
+	// Test: a file cut short is reported, not an error, as gdb check opens it
+	t.Run("Truncated", func(t *testing.T) {
+		end := len(original)/2 + 100
+		if err := os.WriteFile(dbPath, original[:end], 0666); err != nil {
+			t.Fatalf("Failed to write database file: %v", err)
+		}
+		defer os.WriteFile(dbPath, original, 0666)
+
+		db, err := NewDatabaseWithOptions(dbPath, Options{CorruptPages: QuarantineCorruptPages, ReadOnly: true})
+		if err != nil {
+			t.Fatalf("Failed to open truncated database: %v", err)
+		}
+		defer db.Close()
+
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Expected a report for a truncated file, got %v", err)
+		}
+		want := fmt.Sprintf("file ends at page %d, the meta page expects %d pages", end/4096, len(original)/4096)
+		var missing bool
+		for _, problem := range report.Problems {
+			missing = missing || strings.Contains(problem.Message, "missing")
+		}
+		if len(report.Problems) == 0 || report.Problems[0].Message != want || !missing {
+			t.Fatalf("Expected %q and missing pages, got %v", want, report.Problems)
+		}
+	})
+}
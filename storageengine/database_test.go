@@ -1,6 +1,8 @@
 package storageengine
 
 import (
+	"bytes"
+	"errors"
 	"os"
 	"testing"
 )
@@ -170,7 +172,12 @@ func TestDatabasePersistence(t *testing.T) {
 			t.Fatalf("Failed to insert data: %v", err)
 		}
 
-		db.Close()
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		if err := db.Close(); !errors.Is(err, ErrClosed) {
+			t.Fatalf("Expected ErrClosed from closing twice, got %v", err)
+		}
 	}
 
 	// Reopen database and verify data
@@ -260,3 +267,424 @@ func TestInvalidOperations(t *testing.T) {
 		t.Fatal("Expected error when querying non-existent table, got nil")
 	}
 }
+
+// TestPrimaryKey tests that primary keys are unique and can be looked up directly
+func TestPrimaryKey(t *testing.T) {
+	dbPath := "pk_test.db"
+	defer os.Remove(dbPath)
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	columns := []Column{
+		{Name: "email", Type: Tstring, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+	}
+	if err := db.CreateTable("users", columns, "email"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		err := db.Insert("users", map[string]interface{}{"email": email, "name": "user " + email})
+		if err != nil {
+			t.Fatalf("Failed to insert %s: %v", email, err)
+		}
+	}
+
+	// Test inserting a duplicate primary key
+	err = db.Insert("users", map[string]interface{}{"email": "b@example.com", "name": "duplicate"})
+	var dupErr *DuplicateKeyError
+	if !errors.As(err, &dupErr) {
+		t.Fatalf("Expected DuplicateKeyError, got %v", err)
+	}
+	if dupErr.Table != "users" || dupErr.Column != "email" {
+		t.Fatalf("Unexpected duplicate key error: %v", dupErr)
+	}
+
+	// Test updating a row to an existing primary key
+	_, err = db.Update("users", func(row *Row) bool {
+		return row.Values["email"] == "c@example.com"
+	}, map[string]interface{}{"email": "a@example.com"})
+	if !errors.As(err, &dupErr) {
+		t.Fatalf("Expected DuplicateKeyError on update, got %v", err)
+	}
+
+	// Test moving a row to a new primary key and reusing the old one
+	_, err = db.Update("users", func(row *Row) bool {
+		return row.Values["email"] == "c@example.com"
+	}, map[string]interface{}{"email": "d@example.com"})
+	if err != nil {
+		t.Fatalf("Failed to update primary key: %v", err)
+	}
+	if err := db.Insert("users", map[string]interface{}{"email": "c@example.com", "name": "new c"}); err != nil {
+		t.Fatalf("Failed to insert freed primary key: %v", err)
+	}
+	if _, err := db.Delete("users", func(row *Row) bool { return row.Values["email"] == "a@example.com" }); err != nil {
+		t.Fatalf("Failed to delete row: %v", err)
+	}
+
+	check := func() {
+		t.Helper()
+
+		user, err := db.SelectByPK("users", "d@example.com")
+		if err != nil {
+			t.Fatalf("Failed to select by primary key: %v", err)
+		}
+		if user.Values["name"] != "user c@example.com" {
+			t.Fatalf("Expected moved row, got %v", user.Values)
+		}
+
+		user, err = db.SelectByPK("users", "c@example.com")
+		if err != nil {
+			t.Fatalf("Failed to select by primary key: %v", err)
+		}
+		if user.Values["name"] != "new c" {
+			t.Fatalf("Expected new row, got %v", user.Values)
+		}
+
+		if _, err := db.SelectByPK("users", "a@example.com"); err == nil {
+			t.Fatal("Expected deleted primary key to be gone")
+		}
+	}
+	check()
+
+	// Test that the primary key index is still there after reopening
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db, err = NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	check()
+	err = db.Insert("users", map[string]interface{}{"email": "d@example.com", "name": "duplicate"})
+	if !errors.As(err, &dupErr) {
+		t.Fatalf("Expected DuplicateKeyError after reopen, got %v", err)
+	}
+}
+
+// TestOnDiskIndexes tests that opening a database only reads its catalog and
+// that rows are found through the indexes stored on disk
+func TestOnDiskIndexes(t *testing.T) {
+	dbPath := "ondisk_test.db"
+	defer os.Remove(dbPath)
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+	}
+	if err := db.CreateTable("users", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// Enough rows to split the row index and spread rows over many pages
+	const numRows = 1000
+	tx := db.Begin()
+	for i := 1; i <= numRows; i++ {
+		if err := tx.Insert("users", map[string]interface{}{"id": int64(i), "name": "user"}); err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	table, _ := db.GetTableSchema("users")
+	firstPageID := table.FirstPageID
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	// Wreck the first data page, opening must not notice
+	file, err := os.OpenFile(dbPath, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("Failed to open database file: %v", err)
+	}
+	garbage := make([]byte, 4096)
+	for i := range garbage {
+		garbage[i] = 0xFF
+	}
+	if _, err := file.WriteAt(garbage, int64(firstPageID)*4096); err != nil {
+		t.Fatalf("Failed to overwrite page: %v", err)
+	}
+	file.Close()
+
+	db, err = NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to open database with a damaged data page: %v", err)
+	}
+	defer db.Close()
+
+	// Rows on other pages are still reachable through the indexes
+	user, err := db.SelectByPK("users", int64(numRows))
+	if err != nil {
+		t.Fatalf("Failed to select by primary key: %v", err)
+	}
+	if user.RowID != numRows {
+		t.Fatalf("Expected row %d, got %d", numRows, user.RowID)
+	}
+	rows, err := db.SelectRange("users", numRows-9, numRows)
+	if err != nil {
+		t.Fatalf("Failed to select range: %v", err)
+	}
+	if len(rows) != 10 {
+		t.Fatalf("Expected 10 rows, got %d", len(rows))
+	}
+
+	var corruptErr *CorruptPageError
+	if _, err := db.SelectAll("users"); !errors.As(err, &corruptErr) || corruptErr.PageID != firstPageID {
+		t.Fatalf("Expected a full scan to report page %d as corrupt, got %v", firstPageID, err)
+	}
+
+	// Test: an old snapshot follows the version chain back to the values it saw
+	snap := db.acquireSnapshot()
+	defer db.releaseSnapshot(snap)
+
+	for _, name := range []string{"first", "second"} {
+		if err := db.UpdateByID("users", numRows, map[string]interface{}{"name": name}); err != nil {
+			t.Fatalf("Failed to update row: %v", err)
+		}
+	}
+	if err := db.DeleteByID("users", numRows-1); err != nil {
+		t.Fatalf("Failed to delete row: %v", err)
+	}
+
+	old, err := db.selectRange(snap, "users", numRows-1, numRows)
+	if err != nil {
+		t.Fatalf("Failed to select from snapshot: %v", err)
+	}
+	if len(old) != 2 || old[1].Values["name"] != "user" {
+		t.Fatalf("Expected snapshot to see both rows unchanged, got %d rows", len(old))
+	}
+
+	current, err := db.SelectRange("users", numRows-1, numRows)
+	if err != nil {
+		t.Fatalf("Failed to select range: %v", err)
+	}
+	if len(current) != 1 || current[0].Values["name"] != "second" {
+		t.Fatalf("Expected only the updated row, got %d rows", len(current))
+	}
+}
+
+// TestFileHeader tests that the meta page identifies the file and decides its page size
+func TestFileHeader(t *testing.T) {
+	dbPath := "header_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 8192)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+	}
+	if err := db.CreateTable("users", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := db.Insert("users", map[string]interface{}{"id": int64(1), "name": "Alice"}); err != nil {
+		t.Fatalf("Failed to insert row: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	// Test: an existing file keeps its page size whatever the caller asks for
+	db, err = NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if db.PageSize() != 8192 {
+		t.Fatalf("Expected page size 8192 from the file, got %d", db.PageSize())
+	}
+	row, err := db.SelectByPK("users", int64(1))
+	if err != nil || row.Values["name"] != "Alice" {
+		t.Fatalf("Expected to find Alice after reopen, got %v, %v", row, err)
+	}
+	// A second table must not reuse the first one's ID
+	if err := db.CreateTable("orders", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	users, _ := db.GetTableSchema("users")
+	orders, _ := db.GetTableSchema("orders")
+	if users.ID == orders.ID {
+		t.Fatalf("Expected distinct table IDs, both are %d", users.ID)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	// Test: a file from a newer format version is refused
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to read database file: %v", err)
+	}
+	data[29]++
+	if err := os.WriteFile(dbPath, data, 0666); err != nil {
+		t.Fatalf("Failed to write database file: %v", err)
+	}
+	if _, err := NewDatabase(dbPath, 4096); err == nil {
+		t.Fatal("Expected error opening an unsupported format version, got nil")
+	}
+
+	// Test: a file that is not a database is refused
+	if err := os.WriteFile(dbPath, []byte("just some text, certainly not a database"), 0666); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := NewDatabase(dbPath, 4096); !errors.Is(err, ErrNotDatabase) {
+		t.Fatalf("Expected ErrNotDatabase, got %v", err)
+	}
+
+	// Test: page sizes that cannot be addressed are refused for new files
+	os.Remove(dbPath)
+	for _, pageSize := range []int{100, 5000, 65536} {
+		if _, err := NewDatabase(dbPath, pageSize); err == nil {
+			t.Fatalf("Expected error creating a database with page size %d, got nil", pageSize)
+		}
+	}
+}
+
+// TestPageChecksums tests that damaged pages are detected and can be quarantined on open
+func TestPageChecksums(t *testing.T) {
+	dbPath := "checksum_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+	}
+	// Later tables come first in the catalog
+	for _, name := range []string{"damaged", "intact"} {
+		if err := db.CreateTable(name, columns, "id"); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+		if err := db.Insert(name, map[string]interface{}{"id": int64(1)}); err != nil {
+			t.Fatalf("Failed to insert row: %v", err)
+		}
+	}
+	damaged, _ := db.GetTableSchema("damaged")
+	tablePageID := damaged.pageID
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	// Flip a single bit in the table page
+	file, err := os.OpenFile(dbPath, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("Failed to open database file: %v", err)
+	}
+	b := make([]byte, 1)
+	offset := int64(tablePageID)*4096 + 100
+	file.ReadAt(b, offset)
+	b[0] ^= 0x10
+	if _, err := file.WriteAt(b, offset); err != nil {
+		t.Fatalf("Failed to damage page: %v", err)
+	}
+	file.Close()
+
+	// Test: by default opening fails with the ID of the damaged page
+	_, err = NewDatabase(dbPath, 4096)
+	var corruptErr *CorruptPageError
+	if !errors.Is(err, ErrCorruptPage) || !errors.As(err, &corruptErr) || corruptErr.PageID != tablePageID {
+		t.Fatalf("Expected corrupt page %d, got %v", tablePageID, err)
+	}
+
+	// Test: with quarantine the damaged table is left out and the rest stays usable
+	db, err = NewDatabaseWithOptions(dbPath, Options{CorruptPages: QuarantineCorruptPages})
+	if err != nil {
+		t.Fatalf("Failed to open database with quarantine: %v", err)
+	}
+	defer db.Close()
+
+	if pages := db.QuarantinedPages(); len(pages) != 1 || pages[0] != tablePageID {
+		t.Fatalf("Expected page %d to be quarantined, got %v", tablePageID, pages)
+	}
+	if _, err := db.GetTableSchema("damaged"); err == nil {
+		t.Fatal("Expected the damaged table to be missing")
+	}
+	if row, err := db.SelectByPK("intact", int64(1)); err != nil || row == nil {
+		t.Fatalf("Expected to read the intact table, got %v, %v", row, err)
+	}
+}
+
+// TestReadOnlyOpen tests that a read-only database can be read and checked but never written
+func TestReadOnlyOpen(t *testing.T) {
+	dbPath := "readonly_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	columns := []Column{{Name: "id", Type: TInteger, NotNull: true}}
+	if err := db.CreateTable("items", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for i := 1; i <= 10; i++ {
+		if err := db.Insert("items", map[string]interface{}{"id": int64(i)}); err != nil {
+			t.Fatalf("Failed to insert row: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	before, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to read database file: %v", err)
+	}
+
+	db, err = NewDatabaseWithOptions(dbPath, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open database read-only: %v", err)
+	}
+	if count, err := db.GetRowCount("items"); err != nil || count != 10 {
+		t.Fatalf("Expected 10 rows, got %d, %v", count, err)
+	}
+	if report, err := db.Check(); err != nil || !report.OK() {
+		t.Fatalf("Expected the check to pass, got %v, %v", report, err)
+	}
+	if _, err := os.Stat(dbPath + "-wal"); !os.IsNotExist(err) {
+		t.Fatalf("Expected no WAL to be created, got %v", err)
+	}
+
+	if err := db.Insert("items", map[string]interface{}{"id": int64(11)}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly from an insert, got %v", err)
+	}
+	if err := db.VacuumAll(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly from a vacuum, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	if err := db.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected ErrClosed from closing twice, got %v", err)
+	}
+
+	after, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to read database file: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("Expected the file to be left untouched")
+	}
+
+	if _, err := NewDatabaseWithOptions("missing_test.db", Options{ReadOnly: true}); err == nil {
+		os.Remove("missing_test.db")
+		t.Fatal("Expected opening a missing file read-only to fail")
+	}
+}
@@ -0,0 +1,134 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Data pages use a slotted layout. Records are packed upwards from the page
+// header to the free offset, and a directory of slots grows downwards from the
+// end of the page, with the row count holding the number of slots:
+//
+//	[21:freeOffset]       records
+//	[freeOffset:dirStart] free space
+//	[dirStart:]           slots, the last one first, each the offset of its record
+//
+// A RowPtr addresses a record by its slot, so records can move inside the page
+// without the row index noticing. An unused slot holds 0 and is handed out to
+// the next record added to the page.
+const slotSize = 2
+
+// slotCount returns the number of slots in the directory of a data page
+func slotCount(page *Page) uint16 {
+	return binary.LittleEndian.Uint16(page.Data[5:7])
+}
+
+// directoryStart returns where a directory of count slots starts
+func directoryStart(page *Page, count uint16) int {
+	return len(page.Data) - int(count)*slotSize
+}
+
+// slotPosition returns where a slot is stored on the page
+func slotPosition(page *Page, slot uint16) int {
+	return directoryStart(page, slot+1)
+}
+
+// slotOffset returns the offset of the record in a slot, or 0 if it is unused
+func slotOffset(page *Page, slot uint16) uint16 {
+	pos := slotPosition(page, slot)
+	return binary.LittleEndian.Uint16(page.Data[pos : pos+slotSize])
+}
+
+// setSlotOffset points a slot at a record, or marks it unused with 0
+func setSlotOffset(page *Page, slot uint16, offset uint16) {
+	pos := slotPosition(page, slot)
+	binary.LittleEndian.PutUint16(page.Data[pos:pos+slotSize], offset)
+}
+
+// readSlot returns the record in a slot
+func readSlot(page *Page, slot uint16) (rowRecord, error) {
+	if slot >= slotCount(page) {
+		return rowRecord{}, fmt.Errorf("slot %d is past the end of the directory of page %d", slot, page.ID)
+	}
+	offset := slotOffset(page, slot)
+	if offset == 0 {
+		return rowRecord{}, fmt.Errorf("slot %d of page %d is unused", slot, page.ID)
+	}
+	return readRowRecord(page, offset)
+}
+
+// freeSlot returns the first unused slot and whether there is one
+func freeSlot(page *Page) (uint16, bool) {
+	for slot := uint16(0); slot < slotCount(page); slot++ {
+		if slotOffset(page, slot) == 0 {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+// canHold reports whether a record of the given size fits on a data page
+func canHold(page *Page, recordSize int) bool {
+	freeOffset := int(binary.LittleEndian.Uint16(page.Data[15:17]))
+	needed := recordSize
+	if _, ok := freeSlot(page); !ok {
+		needed += slotSize
+	}
+	return freeOffset+needed <= directoryStart(page, slotCount(page))
+}
+
+// insertRecord copies a record to the end of the records of a data page and
+// returns its slot. The caller checks that it fits with canHold.
+func insertRecord(page *Page, record []byte) uint16 {
+	slot, ok := freeSlot(page)
+	if !ok {
+		slot = slotCount(page)
+		binary.LittleEndian.PutUint16(page.Data[5:7], slot+1)
+	}
+
+	freeOffset := binary.LittleEndian.Uint16(page.Data[15:17])
+	copy(page.Data[freeOffset:], record)
+	setSlotOffset(page, slot, freeOffset)
+	binary.LittleEndian.PutUint16(page.Data[15:17], freeOffset+uint16(len(record)))
+
+	return slot
+}
+
+// compactDataPage packs the records of the used slots together after records
+// were removed and drops the unused slots at the end of the directory
+func compactDataPage(page *Page) error {
+	count := slotCount(page)
+	for count > 0 && slotOffset(page, count-1) == 0 {
+		count--
+	}
+	dirStart := directoryStart(page, count)
+
+	// Records keep their order, so each one only ever moves down
+	slots := make([]uint16, 0, count)
+	for slot := uint16(0); slot < count; slot++ {
+		if slotOffset(page, slot) != 0 {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		return slotOffset(page, slots[i]) < slotOffset(page, slots[j])
+	})
+
+	offset := uint16(pageHeaderSize)
+	for _, slot := range slots {
+		from := slotOffset(page, slot)
+		record, err := readRowRecord(page, from)
+		if err != nil {
+			return err
+		}
+		copy(page.Data[offset:], page.Data[from:from+record.size()])
+		setSlotOffset(page, slot, offset)
+		offset += record.size()
+	}
+
+	clear(page.Data[offset:dirStart])
+	binary.LittleEndian.PutUint16(page.Data[5:7], count)
+	binary.LittleEndian.PutUint16(page.Data[15:17], offset)
+	return nil
+}
@@ -0,0 +1,123 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestSlottedPages tests that pruning moves records inside a page while row pointers stay valid
+func TestSlottedPages(t *testing.T) {
+	dbPath := "datapage_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+	}
+	if err := db.CreateTable("items", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for i := 1; i <= 20; i++ {
+		err := db.Insert("items", map[string]interface{}{"id": int64(i), "name": fmt.Sprintf("item %d", i)})
+		if err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+
+	// rowPtrs returns where the row index points for every row
+	rowPtrs := func(t *testing.T) map[uint64]RowPtr {
+		t.Helper()
+		table, _ := db.GetTableSchema("items")
+		ptrs := make(map[uint64]RowPtr)
+		err := bpScan(db, table.RowIndexRoot, nil, nil, func(key []byte, value uint64) bool {
+			ptrs[rowKeyID(key)] = unpackRowPtr(value)
+			return true
+		})
+		if err != nil {
+			t.Fatalf("Failed to scan row index: %v", err)
+		}
+		return ptrs
+	}
+
+	// pageLayout returns the slot count and free offset of the only data page
+	pageLayout := func(t *testing.T) (uint16, uint16) {
+		t.Helper()
+		table, _ := db.GetTableSchema("items")
+		if table.FirstPageID != table.LastPageID {
+			t.Fatal("Expected the rows to fit on one data page")
+		}
+		page, err := db.readPage(table.FirstPageID)
+		if err != nil {
+			t.Fatalf("Failed to read data page: %v", err)
+		}
+		defer db.unpinPage(page)
+		return slotCount(page), binary.LittleEndian.Uint16(page.Data[15:17])
+	}
+
+	// Delete rows in the middle of the page and keep the last one live
+	if _, err := db.Delete("items", func(row *Row) bool {
+		id := row.Values["id"].(int64)
+		return id >= 5 && id <= 10
+	}); err != nil {
+		t.Fatalf("Failed to delete rows: %v", err)
+	}
+	before := rowPtrs(t)
+	slots, freeOffset := pageLayout(t)
+
+	if err := db.pruneVersions(); err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+
+	// Test: the space of records in the middle of the page is reclaimed
+	_, pruned := pageLayout(t)
+	if pruned >= freeOffset {
+		t.Fatalf("Expected dead records in the middle of the page to be reclaimed, free offset went from %d to %d", freeOffset, pruned)
+	}
+
+	// Test: rows that moved keep their row pointers and are read back
+	after := rowPtrs(t)
+	if len(after) != 14 {
+		t.Fatalf("Expected 14 rows in the row index, got %d", len(after))
+	}
+	for rowID, ptr := range after {
+		if before[rowID] != ptr {
+			t.Fatalf("Expected row %d to stay at %v, got %v", rowID, before[rowID], ptr)
+		}
+	}
+	row, err := db.SelectByPK("items", int64(20))
+	if err != nil || row == nil || row.Values["name"] != "item 20" {
+		t.Fatalf("Expected to read item 20 after it moved, got %v, %v", row, err)
+	}
+
+	// Test: new rows take the freed slots before the directory grows
+	for i := 21; i <= 23; i++ {
+		err := db.Insert("items", map[string]interface{}{"id": int64(i), "name": fmt.Sprintf("item %d", i)})
+		if err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+	if count, _ := pageLayout(t); count != slots {
+		t.Fatalf("Expected new rows to reuse free slots, slot count went from %d to %d", slots, count)
+	}
+	rows, err := db.SelectAll("items")
+	if err != nil || len(rows) != 17 {
+		t.Fatalf("Expected 17 rows, got %d, %v", len(rows), err)
+	}
+
+	report, err := db.Check()
+	if err != nil {
+		t.Fatalf("Failed to check database: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("Expected no problems, got %v", report.Problems)
+	}
+}
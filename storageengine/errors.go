@@ -0,0 +1,40 @@
+package storageengine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrReadOnly is returned when a database opened with Options.ReadOnly is written to
+var ErrReadOnly = errors.New("database is opened read-only")
+
+// ErrClosed is returned when a database is closed a second time
+var ErrClosed = errors.New("database is already closed")
+
+// ErrCorruptPage matches every CorruptPageError
+var ErrCorruptPage = errors.New("corrupt page")
+
+// CorruptPageError is returned when a page read from disk fails its checksum
+type CorruptPageError struct {
+	PageID uint64
+}
+
+func (e *CorruptPageError) Error() string {
+	return fmt.Sprintf("corrupt page %d: checksum mismatch", e.PageID)
+}
+
+// Is makes errors.Is(err, ErrCorruptPage) match any corrupt page
+func (e *CorruptPageError) Is(target error) bool {
+	return target == ErrCorruptPage
+}
+
+// DuplicateKeyError is returned when a write would store a key that must be unique twice
+type DuplicateKeyError struct {
+	Table  string
+	Column string
+	Value  interface{}
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("duplicate key in table %s: %s = %v", e.Table, e.Column, e.Value)
+}
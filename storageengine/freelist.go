@@ -0,0 +1,447 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Pages that are no longer used are recorded in the free list. Older
+// snapshots may still read a page after the transaction that freed it
+// commits, so the page itself is left untouched and is only handed out again
+// once that transaction is behind the horizon.
+//
+// The list is a queue of PTFree trunk pages linked through the next page ID in
+// their header, with RowCount holding the number of entries. The meta page
+// points at the first and last trunk. Entries are appended at the tail and
+// taken from the head, which keeps them ordered by the freeing transaction.
+// Vacuum rewrites the list with the pages everybody may reuse first, lowest
+// page first, so that new pages fill the start of the file:
+//
+//	[21:23] index of the first entry still in the list
+//	[23:]   entries of [page ID][transaction that freed it]
+const (
+	freeStartOffset   = pageHeaderSize
+	freeEntriesOffset = pageHeaderSize + 2
+	freeEntrySize     = 16
+)
+
+// popFreePage takes the first page of the free list if no snapshot can read it anymore
+func (tx *Tx) popFreePage() (uint64, bool, error) {
+	metaPage, err := tx.readPage(metaPageID)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read meta page: %w", err)
+	}
+	meta, err := decodeMeta(metaPage)
+	tx.unpinPage(metaPage)
+	if err != nil || meta.freeHead == 0 {
+		return 0, false, err
+	}
+
+	trunk, err := tx.readPage(meta.freeHead)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read free list page %d: %w", meta.freeHead, err)
+	}
+	pageType := PageType(trunk.Data[0])
+	count := binary.LittleEndian.Uint16(trunk.Data[5:7])
+	next := binary.LittleEndian.Uint64(trunk.Data[7:15])
+	start := binary.LittleEndian.Uint16(trunk.Data[freeStartOffset : freeStartOffset+2])
+	var pageID, freedBy uint64
+	if start < count {
+		offset := freeEntriesOffset + int(start)*freeEntrySize
+		pageID = binary.LittleEndian.Uint64(trunk.Data[offset : offset+8])
+		freedBy = binary.LittleEndian.Uint64(trunk.Data[offset+8 : offset+16])
+	}
+	tx.unpinPage(trunk)
+
+	if pageType != PTFree {
+		return 0, false, fmt.Errorf("free list page %d is not a free page", meta.freeHead)
+	}
+
+	if start == count {
+		if next == 0 {
+			return 0, false, nil
+		}
+		// A drained trunk is only read by writers, it can be reused right away
+		err := tx.updateMeta(func(meta *dbMeta) {
+			meta.freeHead = next
+		})
+		return meta.freeHead, err == nil, err
+	}
+
+	if freedBy > tx.horizon {
+		return 0, false, nil
+	}
+
+	trunk, err = tx.modifyPage(meta.freeHead)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read free list page %d: %w", meta.freeHead, err)
+	}
+	start++
+	if start == count && next == 0 {
+		// The last trunk starts over once it is drained
+		start, count = 0, 0
+		clear(trunk.Data[freeEntriesOffset:])
+	}
+	binary.LittleEndian.PutUint16(trunk.Data[5:7], count)
+	binary.LittleEndian.PutUint16(trunk.Data[freeStartOffset:freeStartOffset+2], start)
+	binary.LittleEndian.PutUint16(trunk.Data[15:17], uint16(freeEntriesOffset+int(count)*freeEntrySize))
+
+	return pageID, true, tx.writePage(trunk)
+}
+
+// freePage records that the transaction stopped using a page
+func (tx *Tx) freePage(pageID uint64) error {
+	metaPage, err := tx.readPage(metaPageID)
+	if err != nil {
+		return fmt.Errorf("failed to read meta page: %w", err)
+	}
+	meta, err := decodeMeta(metaPage)
+	tx.unpinPage(metaPage)
+	if err != nil {
+		return err
+	}
+
+	var trunk *Page
+	if meta.freeTail != 0 {
+		if trunk, err = tx.modifyPage(meta.freeTail); err != nil {
+			return fmt.Errorf("failed to read free list page %d: %w", meta.freeTail, err)
+		}
+	}
+
+	capacity := (tx.db.pageSize - freeEntriesOffset) / freeEntrySize
+	if trunk == nil || int(binary.LittleEndian.Uint16(trunk.Data[5:7])) == capacity {
+		// Trunks come from the end of the file, taking one from the list could recurse
+		newTrunk := &Page{
+			ID:   tx.nextPageID,
+			Data: make([]byte, tx.db.pageSize),
+		}
+		tx.nextPageID++
+		newTrunk.Data[0] = byte(PTFree)
+		binary.LittleEndian.PutUint16(newTrunk.Data[15:17], freeEntriesOffset)
+
+		if trunk != nil {
+			binary.LittleEndian.PutUint64(trunk.Data[7:15], newTrunk.ID)
+			if err := tx.writePage(trunk); err != nil {
+				return err
+			}
+		}
+		err := tx.updateMeta(func(meta *dbMeta) {
+			if meta.freeHead == 0 {
+				meta.freeHead = newTrunk.ID
+			}
+			meta.freeTail = newTrunk.ID
+		})
+		if err != nil {
+			return err
+		}
+		trunk = newTrunk
+	}
+
+	count := binary.LittleEndian.Uint16(trunk.Data[5:7])
+	offset := freeEntriesOffset + int(count)*freeEntrySize
+	binary.LittleEndian.PutUint64(trunk.Data[offset:offset+8], pageID)
+	binary.LittleEndian.PutUint64(trunk.Data[offset+8:offset+16], tx.id)
+	binary.LittleEndian.PutUint16(trunk.Data[5:7], count+1)
+	binary.LittleEndian.PutUint16(trunk.Data[15:17], uint16(offset+freeEntrySize))
+
+	tx.freed[pageID] = true
+	return tx.writePage(trunk)
+}
+
+// releaseDataPages unlinks emptied data pages from their tables and frees them
+func (tx *Tx) releaseDataPages(pageIDs []uint64) error {
+	empty := make(map[uint32]map[uint64]bool)
+	for _, pageID := range pageIDs {
+		page, err := tx.readPage(pageID)
+		if err != nil {
+			return err
+		}
+		tableID := binary.LittleEndian.Uint32(page.Data[1:5])
+		tx.unpinPage(page)
+
+		if empty[tableID] == nil {
+			empty[tableID] = make(map[uint64]bool)
+		}
+		empty[tableID][pageID] = true
+	}
+
+	for tableID, pages := range empty {
+		table, exists := tx.tableByID(tableID)
+		if !exists {
+			return fmt.Errorf("data page references unknown table %d", tableID)
+		}
+
+		// Walk the table's chain of data pages once, skipping the empty ones
+		var prevID uint64
+		for pageID := table.FirstPageID; pageID != 0; {
+			page, err := tx.readPage(pageID)
+			if err != nil {
+				return fmt.Errorf("failed to read data page %d: %w", pageID, err)
+			}
+			next := binary.LittleEndian.Uint64(page.Data[7:15])
+			tx.unpinPage(page)
+
+			if !pages[pageID] {
+				prevID = pageID
+				pageID = next
+				continue
+			}
+
+			if prevID == 0 {
+				table.FirstPageID = next
+			} else {
+				prev, err := tx.modifyPage(prevID)
+				if err != nil {
+					return fmt.Errorf("failed to read data page %d: %w", prevID, err)
+				}
+				binary.LittleEndian.PutUint64(prev.Data[7:15], next)
+				if err := tx.writePage(prev); err != nil {
+					return err
+				}
+			}
+
+			if err := tx.freePage(pageID); err != nil {
+				return err
+			}
+			pageID = next
+		}
+
+		if err := tx.writeTablePage(table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// freeEntry is a page on the free list and the transaction that freed it
+type freeEntry struct {
+	pageID  uint64
+	freedBy uint64
+}
+
+// readFreeList returns the trunks of the free list and the entries they hold, in order
+func (tx *Tx) readFreeList() (trunks []uint64, entries []freeEntry, err error) {
+	metaPage, err := tx.readPage(metaPageID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read meta page: %w", err)
+	}
+	meta, err := decodeMeta(metaPage)
+	tx.unpinPage(metaPage)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for pageID := meta.freeHead; pageID != 0; {
+		trunk, err := tx.readPage(pageID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read free list page %d: %w", pageID, err)
+		}
+		if PageType(trunk.Data[0]) != PTFree {
+			tx.unpinPage(trunk)
+			return nil, nil, fmt.Errorf("free list page %d is not a free page", pageID)
+		}
+		count := binary.LittleEndian.Uint16(trunk.Data[5:7])
+		start := binary.LittleEndian.Uint16(trunk.Data[freeStartOffset : freeStartOffset+2])
+		for i := start; i < count; i++ {
+			offset := freeEntriesOffset + int(i)*freeEntrySize
+			entries = append(entries, freeEntry{
+				pageID:  binary.LittleEndian.Uint64(trunk.Data[offset : offset+8]),
+				freedBy: binary.LittleEndian.Uint64(trunk.Data[offset+8 : offset+16]),
+			})
+		}
+		next := binary.LittleEndian.Uint64(trunk.Data[7:15])
+		tx.unpinPage(trunk)
+
+		trunks = append(trunks, pageID)
+		pageID = next
+	}
+	return trunks, entries, nil
+}
+
+// freeTrunk is a trunk page of a new free list and the entries it holds
+type freeTrunk struct {
+	pageID  uint64
+	entries []freeEntry
+}
+
+// layoutFreeList orders the entries of a new free list and picks the pages of
+// its trunks. Entries no snapshot can read anymore come first, lowest page
+// first, so new pages fill the start of the file; the rest follow in the order
+// they were freed. The trunks are taken from the first entries, or from end,
+// the end of the file, while the entries cannot be handed out yet. It returns
+// the trunks and the new end of the file.
+func (tx *Tx) layoutFreeList(entries []freeEntry, end uint64) ([]freeTrunk, uint64) {
+	entries = append([]freeEntry(nil), entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if reusable := a.freedBy <= tx.horizon; reusable != (b.freedBy <= tx.horizon) {
+			return reusable
+		}
+		if a.freedBy <= tx.horizon {
+			return a.pageID < b.pageID
+		}
+		return a.freedBy < b.freedBy
+	})
+
+	capacity := (tx.db.pageSize - freeEntriesOffset) / freeEntrySize
+	var trunks []freeTrunk
+	for len(entries) > len(trunks)*capacity {
+		if entries[0].freedBy <= tx.horizon {
+			trunks = append(trunks, freeTrunk{pageID: entries[0].pageID})
+			entries = entries[1:]
+		} else {
+			trunks = append(trunks, freeTrunk{pageID: end})
+			end++
+		}
+	}
+	for i := range trunks {
+		trunks[i].entries = entries[i*capacity : min((i+1)*capacity, len(entries))]
+	}
+	return trunks, end
+}
+
+// writeFreeList replaces the free list with the given trunks
+func (tx *Tx) writeFreeList(trunks []freeTrunk) error {
+	for i, t := range trunks {
+		trunk := &Page{ID: t.pageID, Data: make([]byte, tx.db.pageSize)}
+		trunk.Data[0] = byte(PTFree)
+		if i+1 < len(trunks) {
+			binary.LittleEndian.PutUint64(trunk.Data[7:15], trunks[i+1].pageID)
+		}
+
+		for j, entry := range t.entries {
+			offset := freeEntriesOffset + j*freeEntrySize
+			binary.LittleEndian.PutUint64(trunk.Data[offset:offset+8], entry.pageID)
+			binary.LittleEndian.PutUint64(trunk.Data[offset+8:offset+16], entry.freedBy)
+		}
+		binary.LittleEndian.PutUint16(trunk.Data[5:7], uint16(len(t.entries)))
+		binary.LittleEndian.PutUint16(trunk.Data[15:17], uint16(freeEntriesOffset+len(t.entries)*freeEntrySize))
+
+		if err := tx.writePage(trunk); err != nil {
+			return err
+		}
+	}
+
+	return tx.updateMeta(func(meta *dbMeta) {
+		meta.freeHead, meta.freeTail = 0, 0
+		if len(trunks) > 0 {
+			meta.freeHead, meta.freeTail = trunks[0].pageID, trunks[len(trunks)-1].pageID
+		}
+	})
+}
+
+// sortFreeList prepares the free list for moving the pages in use at the end
+// of the file into free pages before them. It returns the page from which on
+// the file is to be left free: the pages in use from there on fit into the
+// free pages before it, which the list hands out first, lowest page first.
+func (tx *Tx) sortFreeList() (uint64, error) {
+	trunks, entries, err := tx.readFreeList()
+	if err != nil {
+		return 0, err
+	}
+
+	// Trunks are only read by writers, they are free for everybody
+	free := make(map[uint64]bool)
+	for _, pageID := range trunks {
+		free[pageID] = true
+	}
+	var waiting []freeEntry
+	for _, entry := range entries {
+		if entry.freedBy <= tx.horizon {
+			free[entry.pageID] = true
+		} else {
+			waiting = append(waiting, entry)
+		}
+	}
+
+	// One free page before the end is kept back: the last trunk of the list
+	// is never handed out
+	end, below, inUse := tx.nextPageID, len(free), 0
+	for end > metaPageID+1 {
+		if free[end-1] {
+			below--
+		} else {
+			inUse++
+		}
+		if inUse >= below {
+			break
+		}
+		end--
+	}
+
+	// The free pages past the end get trunks of their own, from among them,
+	// so that the trunks holding the pages handed out are drained
+	var head, tail []freeEntry
+	for pageID := range free {
+		if pageID < end {
+			head = append(head, freeEntry{pageID: pageID})
+		} else {
+			tail = append(tail, freeEntry{pageID: pageID})
+		}
+	}
+	headTrunks, _ := tx.layoutFreeList(head, tx.nextPageID)
+	tailTrunks, next := tx.layoutFreeList(append(tail, waiting...), tx.nextPageID)
+	if err := tx.writeFreeList(append(headTrunks, tailTrunks...)); err != nil {
+		return 0, err
+	}
+	tx.nextPageID = next
+	return end, nil
+}
+
+// shrinkFreeTail gives the free pages at the end of the file back to it: it
+// rebuilds the free list without them and lowers the next page ID, and returns
+// the number of pages dropped. Only pages no snapshot can read anymore are
+// dropped, the file itself is truncated by the caller once the transaction
+// is committed.
+func (tx *Tx) shrinkFreeTail() (int, error) {
+	trunks, entries, err := tx.readFreeList()
+	if err != nil {
+		return 0, err
+	}
+
+	// Trunks are only read by writers
+	reusable := make(map[uint64]bool)
+	for _, pageID := range trunks {
+		reusable[pageID] = true
+	}
+	for _, entry := range entries {
+		if entry.freedBy <= tx.horizon {
+			reusable[entry.pageID] = true
+		}
+	}
+
+	cut := tx.nextPageID
+	for cut > metaPageID+1 && reusable[cut-1] {
+		cut--
+	}
+	if cut == tx.nextPageID {
+		return 0, nil
+	}
+
+	var kept []freeEntry
+	for _, pageID := range trunks {
+		if pageID < cut {
+			kept = append(kept, freeEntry{pageID: pageID})
+		}
+	}
+	for _, entry := range entries {
+		if entry.pageID < cut {
+			kept = append(kept, entry)
+		}
+	}
+
+	// The new trunks are taken from the pages they would list
+	newTrunks, cut := tx.layoutFreeList(kept, cut)
+	if cut >= tx.nextPageID {
+		return 0, nil
+	}
+	if err := tx.writeFreeList(newTrunks); err != nil {
+		return 0, err
+	}
+
+	dropped := int(tx.nextPageID - cut)
+	tx.nextPageID = cut
+	return dropped, nil
+}
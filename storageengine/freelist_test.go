@@ -0,0 +1,218 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestFreeList tests that dropped indexes and emptied data pages are reused
+func TestFreeList(t *testing.T) {
+	dbPath := "freelist_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+	}
+	if err := db.CreateTable("items", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	insertRows := func(t *testing.T, from, to int) {
+		t.Helper()
+		tx := db.Begin()
+		for i := from; i <= to; i++ {
+			err := tx.Insert("items", map[string]interface{}{
+				"id":   int64(i),
+				"name": fmt.Sprintf("item %04d with a name long enough to need several pages", i),
+			})
+			if err != nil {
+				t.Fatalf("Failed to insert row %d: %v", i, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+	}
+
+	// freePages walks the free list and returns its pages
+	freePages := func(t *testing.T) map[uint64]bool {
+		t.Helper()
+		page, err := db.readPage(metaPageID)
+		if err != nil {
+			t.Fatalf("Failed to read meta page: %v", err)
+		}
+		meta, err := decodeMeta(page)
+		db.unpinPage(page)
+		if err != nil {
+			t.Fatalf("Failed to decode meta page: %v", err)
+		}
+
+		pages := make(map[uint64]bool)
+		for trunkID := meta.freeHead; trunkID != 0; {
+			trunk, err := db.readPage(trunkID)
+			if err != nil {
+				t.Fatalf("Failed to read free list page: %v", err)
+			}
+			if PageType(trunk.Data[0]) != PTFree {
+				t.Fatalf("Page %d in the free list is not a free list page", trunkID)
+			}
+
+			start := int(binary.LittleEndian.Uint16(trunk.Data[freeStartOffset:]))
+			count := int(binary.LittleEndian.Uint16(trunk.Data[5:7]))
+			for i := start; i < count; i++ {
+				offset := freeEntriesOffset + i*freeEntrySize
+				pageID := binary.LittleEndian.Uint64(trunk.Data[offset:])
+				if pages[pageID] {
+					t.Fatalf("Page %d is in the free list twice", pageID)
+				}
+				pages[pageID] = true
+			}
+			next := binary.LittleEndian.Uint64(trunk.Data[7:15])
+			db.unpinPage(trunk)
+
+			if next == 0 && trunkID != meta.freeTail {
+				t.Fatalf("Free list ends at %d, expected %d", trunkID, meta.freeTail)
+			}
+			trunkID = next
+		}
+		return pages
+	}
+
+	nextPageID := func() uint64 {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return db.nextPageID
+	}
+
+	const rowCount = 500
+	insertRows(t, 1, rowCount)
+	if err := db.CreateIndex("items", "items_name", []string{"name"}, false); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+
+	// Test: pages are not reused while an older snapshot may read them
+	t.Run("Deferred", func(t *testing.T) {
+		snap := db.acquireSnapshot()
+		defer db.releaseSnapshot(snap)
+
+		if err := db.DropIndex("items", "items_name"); err != nil {
+			t.Fatalf("Failed to drop index: %v", err)
+		}
+		freed := freePages(t)
+		if len(freed) == 0 {
+			t.Fatal("Expected the dropped index to free its pages")
+		}
+
+		before := nextPageID()
+		if err := db.CreateIndex("items", "items_name", []string{"name"}, false); err != nil {
+			t.Fatalf("Failed to create index: %v", err)
+		}
+		if nextPageID() == before {
+			t.Fatal("Expected a new index to extend the file while a snapshot holds the freed pages")
+		}
+
+		// The snapshot still reads the dropped index intact
+		index, _ := snap.tables["items"].index("items_name")
+		entries := 0
+		if err := bpScan(snap, index.RootPageID, nil, nil, func([]byte, uint64) bool {
+			entries++
+			return true
+		}); err != nil {
+			t.Fatalf("Failed to scan dropped index: %v", err)
+		}
+		if entries != rowCount {
+			t.Fatalf("Expected %d entries in the dropped index, got %d", rowCount, entries)
+		}
+	})
+
+	// Test: once the snapshot is gone the pages are reused
+	t.Run("Reuse", func(t *testing.T) {
+		if err := db.DropIndex("items", "items_name"); err != nil {
+			t.Fatalf("Failed to drop index: %v", err)
+		}
+
+		before := nextPageID()
+		if err := db.CreateIndex("items", "items_name", []string{"name"}, false); err != nil {
+			t.Fatalf("Failed to create index: %v", err)
+		}
+		if nextPageID() != before {
+			t.Fatalf("Expected the index to reuse free pages, file grew by %d pages", nextPageID()-before)
+		}
+
+		rows, err := db.SelectWhere("items", "name", "=", "item 0042 with a name long enough to need several pages")
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		if len(rows) != 1 {
+			t.Fatalf("Expected 1 row, got %d", len(rows))
+		}
+	})
+
+	// Test: data pages emptied by the pruner are unlinked and reused
+	t.Run("DataPages", func(t *testing.T) {
+		if _, err := db.Delete("items", nil); err != nil {
+			t.Fatalf("Failed to delete rows: %v", err)
+		}
+		before := freePages(t)
+		if err := db.pruneVersions(); err != nil {
+			t.Fatalf("Failed to prune: %v", err)
+		}
+		var emptied []uint64
+		for pageID := range freePages(t) {
+			if !before[pageID] {
+				emptied = append(emptied, pageID)
+			}
+		}
+		if len(emptied) == 0 {
+			t.Fatal("Expected emptied data pages to be freed")
+		}
+
+		table, _ := db.GetTableSchema("items")
+		if table.FirstPageID != table.LastPageID {
+			t.Fatalf("Expected only the last data page to stay linked, chain starts at %d", table.FirstPageID)
+		}
+
+		// The new rows need about as many pages as the old ones, plus index pages
+		insertRows(t, rowCount+1, 2*rowCount)
+		free := freePages(t)
+		for _, pageID := range emptied {
+			if free[pageID] {
+				t.Fatalf("Expected freed page %d to be reused", pageID)
+			}
+		}
+	})
+
+	// Test: the free list and the reused pages survive a restart
+	t.Run("Reopen", func(t *testing.T) {
+		free := len(freePages(t))
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+
+		if len(freePages(t)) != free {
+			t.Fatalf("Expected %d free pages after reopen, got %d", free, len(freePages(t)))
+		}
+		count, err := db.GetRowCount("items")
+		if err != nil {
+			t.Fatalf("Failed to count rows: %v", err)
+		}
+		if count != rowCount {
+			t.Fatalf("Expected %d rows after reopen, got %d", rowCount, count)
+		}
+	})
+
+	db.Close()
+}
@@ -0,0 +1,463 @@
+package storageengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CreateIndex builds a secondary index over columns in a transaction of its own
+func (db *Database) CreateIndex(tableName string, indexName string, columns []string, unique bool) error {
+	return db.autocommit(func(tx *Tx) error {
+		return tx.CreateIndex(tableName, indexName, columns, unique)
+	})
+}
+
+// CreateIndex builds a secondary index over columns as part of the transaction.
+// A unique index fails with a DuplicateKeyError if two rows already share a key.
+func (tx *Tx) CreateIndex(tableName string, indexName string, columns []string, unique bool) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	table, exists := tx.tables[tableName]
+	if !exists {
+		return fmt.Errorf("table not found: %s", tableName)
+	}
+
+	if err := checkName("index", indexName); err != nil {
+		return err
+	}
+	if _, exists := table.index(indexName); exists {
+		return fmt.Errorf("index already exists: %s", indexName)
+	}
+
+	if len(columns) == 0 {
+		return fmt.Errorf("index %s needs at least one column", indexName)
+	}
+	for i, name := range columns {
+		col, path, ok := table.columnPath(name)
+		if !ok {
+			return fmt.Errorf("column not found: %s", name)
+		}
+		if col.Type == TJSON && path == nil {
+			return fmt.Errorf("JSON column %s can only be indexed by a path into it, such as %s.id", name, name)
+		}
+		if col.Type == TArray {
+			return fmt.Errorf("array column %s cannot be indexed", name)
+		}
+		if col.Type == TVector {
+			return fmt.Errorf("vector column %s can only be indexed with CreateVectorIndex", name)
+		}
+		for _, other := range columns[:i] {
+			if other == name {
+				return fmt.Errorf("column %s appears twice in index %s", name, indexName)
+			}
+		}
+	}
+
+	rootPageID, err := tx.createBPTree(table.ID)
+	if err != nil {
+		return err
+	}
+
+	table.Indexes = append(table.Indexes, Index{
+		Name:       indexName,
+		Columns:    append([]string(nil), columns...),
+		Unique:     unique,
+		RootPageID: rootPageID,
+	})
+	index := &table.Indexes[len(table.Indexes)-1]
+
+	matches, err := tx.matchRows(table, nil)
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		if err := tx.checkUniqueIndex(table, index, match.row.Values, match.index.RowID); err != nil {
+			return err
+		}
+		if err := tx.insertIndexEntry(table, index, match.row.Values, match.index.RowID); err != nil {
+			return err
+		}
+	}
+
+	return tx.writeTablePage(table)
+}
+
+// DropIndex removes a secondary index in a transaction of its own
+func (db *Database) DropIndex(tableName string, indexName string) error {
+	return db.autocommit(func(tx *Tx) error {
+		return tx.DropIndex(tableName, indexName)
+	})
+}
+
+// DropIndex removes a secondary index as part of the transaction. The tree's
+// pages, and the centroids of a vector index, go to the free list. They are
+// reused once no older snapshot can read them.
+func (tx *Tx) DropIndex(tableName string, indexName string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	table, exists := tx.tables[tableName]
+	if !exists {
+		return fmt.Errorf("table not found: %s", tableName)
+	}
+
+	for i := range table.Indexes {
+		if table.Indexes[i].Name == indexName {
+			if table.Indexes[i].Primary {
+				return fmt.Errorf("cannot drop the primary key index: %s", indexName)
+			}
+			if err := tx.freeBPTree(table.Indexes[i].RootPageID); err != nil {
+				return err
+			}
+			if err := tx.freeCentroids(&table.Indexes[i]); err != nil {
+				return err
+			}
+			table.Indexes = append(table.Indexes[:i:i], table.Indexes[i+1:]...)
+			return tx.writeTablePage(table)
+		}
+	}
+
+	return fmt.Errorf("index not found: %s", indexName)
+}
+
+// index returns the definition of an index by name
+func (t *Table) index(name string) (*Index, bool) {
+	for i := range t.Indexes {
+		if t.Indexes[i].Name == name {
+			return &t.Indexes[i], true
+		}
+	}
+	return nil, false
+}
+
+// primaryIndex returns the index enforcing the primary key
+func (t *Table) primaryIndex() (*Index, bool) {
+	for i := range t.Indexes {
+		if t.Indexes[i].Primary {
+			return &t.Indexes[i], true
+		}
+	}
+	return nil, false
+}
+
+// indexPrefix encodes the indexed columns of a row. hasNull reports whether
+// any of them is NULL, such rows never conflict in a unique index.
+func indexPrefix(table *Table, index *Index, values map[string]interface{}) (prefix []byte, hasNull bool, err error) {
+	if index.Vector {
+		return vectorIndexPrefix(table, index, values)
+	}
+	for _, name := range index.Columns {
+		col, value, err := indexValue(table, name, values)
+		if err != nil {
+			return nil, false, err
+		}
+		if value == nil {
+			hasNull = true
+		}
+
+		prefix, err = appendKey(prefix, value, *col)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid value for column %s: %w", name, err)
+		}
+	}
+	return prefix, hasNull, nil
+}
+
+// indexValue returns a row's value for an index column, which is either a
+// column of the table or a path into a JSON column
+func indexValue(table *Table, name string, values map[string]interface{}) (*Column, interface{}, error) {
+	col, path, ok := table.columnPath(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("column not found: %s", name)
+	}
+	if path == nil {
+		return col, values[name], nil
+	}
+	value, err := jsonPathValue(values[col.Name], path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid value for column %s: %w", col.Name, err)
+	}
+	return col, value, nil
+}
+
+// indexKey returns the index entry key of a row. The row ID is appended so
+// every entry is unique, even in an index that allows duplicate values.
+func indexKey(table *Table, index *Index, values map[string]interface{}, rowID uint64) ([]byte, error) {
+	prefix, _, err := indexPrefix(table, index, values)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint64(prefix, rowID), nil
+}
+
+// indexKeyRowID returns the row ID at the end of an index entry key
+func indexKeyRowID(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(key)-8:])
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// checkUnique fails with a DuplicateKeyError if values would break the primary key or a unique index
+func (tx *Tx) checkUnique(table *Table, values map[string]interface{}, rowID uint64) error {
+	for i := range table.Indexes {
+		if err := tx.checkUniqueIndex(table, &table.Indexes[i], values, rowID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUniqueIndex fails with a DuplicateKeyError if another row than rowID
+// currently has the same key in a unique index
+func (tx *Tx) checkUniqueIndex(table *Table, index *Index, values map[string]interface{}, rowID uint64) error {
+	if !index.Unique {
+		return nil
+	}
+
+	prefix, hasNull, err := indexPrefix(table, index, values)
+	if err != nil || hasNull {
+		return err
+	}
+
+	// Entries of old versions linger until pruned, so check what the rows hold now
+	var duplicate bool
+	var scanErr error
+	err = bpScan(tx, index.RootPageID, prefix, prefixEnd(prefix), func(key []byte, other uint64) bool {
+		if other == rowID {
+			return true
+		}
+
+		_, row, err := tx.db.lookupRow(tx, table, other)
+		if err != nil {
+			scanErr = err
+			return false
+		}
+		if row == nil {
+			return true // Deleted since the entry was written
+		}
+
+		current, _, err := indexPrefix(table, index, row.Values)
+		if err != nil {
+			scanErr = err
+			return false
+		}
+		duplicate = bytes.Equal(current, prefix)
+		return !duplicate
+	})
+	if err != nil {
+		return err
+	}
+	if scanErr != nil {
+		return scanErr
+	}
+
+	if duplicate {
+		dupErr := &DuplicateKeyError{Table: table.Name, Column: strings.Join(index.Columns, ", ")}
+		if len(index.Columns) == 1 {
+			_, dupErr.Value, _ = indexValue(table, index.Columns[0], values)
+		} else {
+			dupValues := make([]interface{}, len(index.Columns))
+			for i, name := range index.Columns {
+				_, dupValues[i], _ = indexValue(table, name, values)
+			}
+			dupErr.Value = dupValues
+		}
+		return dupErr
+	}
+	return nil
+}
+
+// indexRow adds a row's new values to the table's indexes. Entries for the old
+// values stay in place for older snapshots and are handed to the pruner instead.
+// Either side may be nil for an insert or a delete.
+func (tx *Tx) indexRow(table *Table, oldValues, newValues map[string]interface{}, rowID uint64) error {
+	for i := range table.Indexes {
+		index := &table.Indexes[i]
+
+		var oldKey, newKey []byte
+		var err error
+		if oldValues != nil {
+			if oldKey, err = indexKey(table, index, oldValues, rowID); err != nil {
+				return err
+			}
+		}
+		if newValues != nil {
+			if newKey, err = indexKey(table, index, newValues, rowID); err != nil {
+				return err
+			}
+		}
+
+		if oldKey != nil && bytes.Equal(oldKey, newKey) {
+			continue
+		}
+
+		if newKey != nil {
+			if err := tx.insertIndexEntry(table, index, newValues, rowID); err != nil {
+				return err
+			}
+		}
+		if oldKey != nil {
+			tx.indexGarbage = append(tx.indexGarbage, indexGarbage{
+				tableID: table.ID,
+				index:   index.Name,
+				key:     oldKey,
+				xmax:    tx.id,
+			})
+		}
+	}
+	return nil
+}
+
+// insertIndexEntry adds a row to an index
+func (tx *Tx) insertIndexEntry(table *Table, index *Index, values map[string]interface{}, rowID uint64) error {
+	key, err := indexKey(table, index, values, rowID)
+	if err != nil {
+		return err
+	}
+
+	root, err := tx.bpInsert(index.RootPageID, key, rowID)
+	if err != nil {
+		return fmt.Errorf("failed to update index %s: %w", index.Name, err)
+	}
+
+	if root != index.RootPageID {
+		index.RootPageID = root
+		return tx.writeTablePage(table)
+	}
+	return nil
+}
+
+// pruneIndexEntry removes an index entry no snapshot can need anymore,
+// unless the row has since gone back to the same key
+func (tx *Tx) pruneIndexEntry(entry indexGarbage) error {
+	table, exists := tx.tableByID(entry.tableID)
+	if !exists {
+		return nil
+	}
+	index, exists := table.index(entry.index)
+	if !exists {
+		return nil
+	}
+
+	rowID := indexKeyRowID(entry.key)
+	_, row, err := tx.db.lookupRow(tx, table, rowID)
+	if err != nil {
+		return err
+	}
+	if row != nil {
+		current, err := indexKey(table, index, row.Values, rowID)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(current, entry.key) {
+			return nil
+		}
+	}
+
+	return tx.bpDelete(index.RootPageID, entry.key)
+}
+
+// indexRange returns the part of an index holding the rows where its first
+// column compares to value with op. ok is false if the index cannot help.
+func indexRange(table *Table, index *Index, op string, value interface{}) (lo, hi []byte, ok bool) {
+	if value == nil {
+		return nil, nil, false
+	}
+
+	col, _, exists := table.columnPath(index.Columns[0])
+	if !exists {
+		return nil, nil, false
+	}
+	key, err := encodeKey(value, *col)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	// The bounds may be slightly wider than op, the rows are checked again anyway
+	switch op {
+	case "=", "==":
+		return key, prefixEnd(key), true
+	case ">", ">=":
+		return key, nil, true
+	case "<", "<=":
+		return []byte{keyNotNull}, prefixEnd(key), true
+	}
+	return nil, nil, false
+}
+
+// selectWhereIndexed answers a column comparison through an index on
+// that column. ok is false if no index can serve the query.
+func (db *Database) selectWhereIndexed(src rowSource, table *Table, columnName string, op string, value interface{}, condition func(row *Row) bool) (rows []*Row, ok bool, err error) {
+	for i := range table.Indexes {
+		index := &table.Indexes[i]
+		if index.Columns[0] != columnName {
+			continue
+		}
+
+		lo, hi, ok := indexRange(table, index, op, value)
+		if !ok {
+			continue
+		}
+
+		rows, err := db.indexScan(src, table, index, lo, hi, condition)
+		return rows, true, err
+	}
+	return nil, false, nil
+}
+
+// indexScan reads the rows of an index range that are visible to src and match condition.
+//
+// The index may still hold entries for old versions of a row, or already hold
+// entries of newer ones, so every row is read through the row index and the
+// condition is checked against the version src actually sees.
+func (db *Database) indexScan(src rowSource, table *Table, index *Index, lo, hi []byte, condition func(row *Row) bool) ([]*Row, error) {
+	var result []*Row
+	var scanErr error
+	seen := make(map[uint64]bool)
+
+	err := bpScan(src, index.RootPageID, lo, hi, func(key []byte, rowID uint64) bool {
+		if seen[rowID] {
+			return true
+		}
+		seen[rowID] = true
+
+		_, row, err := db.lookupRow(src, table, rowID)
+		if err != nil {
+			scanErr = err
+			return false
+		}
+		if row != nil && condition(row) {
+			result = append(result, row)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if scanErr != nil {
+		return nil, scanErr
+	}
+
+	// Return rows in the same order as a table scan
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].RowID < result[j].RowID
+	})
+	return result, nil
+}
@@ -0,0 +1,235 @@
+package storageengine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestSecondaryIndex tests building, maintaining and querying secondary indexes
+func TestSecondaryIndex(t *testing.T) {
+	dbPath := "index_test.db"
+	defer os.Remove(dbPath)
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "email", Type: Tstring, NotNull: false},
+		{Name: "age", Type: TInteger, NotNull: false},
+	}
+	if err := db.CreateTable("users", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// Enough rows to split the index pages several times
+	const rowCount = 1000
+	tx := db.Begin()
+	for i := 1; i <= rowCount; i++ {
+		err := tx.Insert("users", map[string]interface{}{
+			"id":    int64(i),
+			"email": fmt.Sprintf("user%04d@example.com", i),
+			"age":   int64(i % 50),
+		})
+		if err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	if err := db.CreateIndex("users", "users_age", []string{"age"}, false); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	if err := db.CreateIndex("users", "users_email", []string{"email"}, true); err != nil {
+		t.Fatalf("Failed to create unique index: %v", err)
+	}
+
+	// checkIndexed compares an indexed query with a full table scan
+	checkIndexed := func(t *testing.T, column, op string, value interface{}) []*Row {
+		t.Helper()
+
+		snap := db.acquireSnapshot()
+		defer db.releaseSnapshot(snap)
+
+		table := snap.tables["users"]
+		condition, err := whereCondition(table, column, op, value)
+		if err != nil {
+			t.Fatalf("Failed to build condition: %v", err)
+		}
+		rows, ok, err := db.selectWhereIndexed(snap, table, column, op, value, condition)
+		if err != nil {
+			t.Fatalf("Failed to select through index: %v", err)
+		}
+		if !ok {
+			t.Fatalf("Expected an index to serve %s %s %v", column, op, value)
+		}
+
+		scanned, err := db.scanRows(snap, table, condition)
+		if err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		if len(rows) != len(scanned) {
+			t.Fatalf("%s %s %v: index returned %d rows, scan %d", column, op, value, len(rows), len(scanned))
+		}
+		for i := range rows {
+			if rows[i].RowID != scanned[i].RowID {
+				t.Fatalf("%s %s %v: row %d differs between index and scan", column, op, value, i)
+			}
+		}
+		return rows
+	}
+
+	// Test: equality and range predicates go through the index
+	t.Run("Query", func(t *testing.T) {
+		if rows := checkIndexed(t, "age", "=", int64(7)); len(rows) != rowCount/50 {
+			t.Fatalf("Expected %d rows with age 7, got %d", rowCount/50, len(rows))
+		}
+		checkIndexed(t, "age", ">", int64(45))
+		checkIndexed(t, "age", "<=", int64(3))
+		if rows := checkIndexed(t, "email", "=", "user0500@example.com"); len(rows) != 1 {
+			t.Fatalf("Expected 1 row, got %d", len(rows))
+		}
+
+		rows, err := db.SelectWhere("users", "age", ">=", int64(48))
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		if len(rows) != 2*rowCount/50 {
+			t.Fatalf("Expected %d rows, got %d", 2*rowCount/50, len(rows))
+		}
+	})
+
+	// Test: unique indexes reject duplicates but allow any number of NULLs
+	t.Run("Unique", func(t *testing.T) {
+		err := db.Insert("users", map[string]interface{}{"id": int64(rowCount + 1), "email": "user0001@example.com"})
+		var dupErr *DuplicateKeyError
+		if !errors.As(err, &dupErr) || dupErr.Column != "email" {
+			t.Fatalf("Expected duplicate email error, got %v", err)
+		}
+
+		if err := db.UpdateByID("users", 2, map[string]interface{}{"email": "user0003@example.com"}); !errors.As(err, &dupErr) {
+			t.Fatalf("Expected duplicate email error on update, got %v", err)
+		}
+
+		for i := 1; i <= 2; i++ {
+			if err := db.Insert("users", map[string]interface{}{"id": int64(rowCount + i)}); err != nil {
+				t.Fatalf("Failed to insert row without email: %v", err)
+			}
+		}
+
+		// A freed key can be taken by another row
+		if err := db.UpdateByID("users", 1, map[string]interface{}{"email": "first@example.com"}); err != nil {
+			t.Fatalf("Failed to update email: %v", err)
+		}
+		if err := db.UpdateByID("users", 2, map[string]interface{}{"email": "user0001@example.com"}); err != nil {
+			t.Fatalf("Failed to reuse email: %v", err)
+		}
+
+		if err := db.CreateIndex("users", "users_age_unique", []string{"age"}, true); !errors.As(err, &dupErr) {
+			t.Fatalf("Expected duplicate error building unique index, got %v", err)
+		}
+	})
+
+	// Test: an old snapshot keeps finding rows through the index after they change
+	t.Run("Snapshot", func(t *testing.T) {
+		snap := db.acquireSnapshot()
+		defer db.releaseSnapshot(snap)
+
+		if _, err := db.Update("users", func(row *Row) bool {
+			return row.Values["age"] == int64(10)
+		}, map[string]interface{}{"age": int64(99)}); err != nil {
+			t.Fatalf("Failed to update rows: %v", err)
+		}
+		if _, err := db.Delete("users", func(row *Row) bool {
+			return row.Values["age"] == int64(11)
+		}); err != nil {
+			t.Fatalf("Failed to delete rows: %v", err)
+		}
+
+		table := snap.tables["users"]
+		for _, age := range []int64{10, 11} {
+			condition, _ := whereCondition(table, "age", "=", age)
+			rows, _, err := db.selectWhereIndexed(snap, table, "age", "=", age, condition)
+			if err != nil {
+				t.Fatalf("Failed to select: %v", err)
+			}
+			if len(rows) != rowCount/50 {
+				t.Fatalf("Expected snapshot to see %d rows with age %d, got %d", rowCount/50, age, len(rows))
+			}
+		}
+
+		checkIndexed(t, "age", "=", int64(10))
+		if rows := checkIndexed(t, "age", "=", int64(99)); len(rows) != rowCount/50 {
+			t.Fatalf("Expected %d rows with age 99, got %d", rowCount/50, len(rows))
+		}
+		checkIndexed(t, "age", "=", int64(11))
+	})
+
+	// Test: stale entries are pruned once no snapshot needs them
+	t.Run("Prune", func(t *testing.T) {
+		if err := db.pruneVersions(); err != nil {
+			t.Fatalf("Failed to prune: %v", err)
+		}
+		if len(db.indexGarbage) != 0 {
+			t.Fatalf("Expected index garbage to be reclaimed, %d entries left", len(db.indexGarbage))
+		}
+
+		table, _ := db.GetTableSchema("users")
+		index, _ := table.index("users_age")
+		lo, hi, _ := indexRange(table, index, "=", int64(10))
+		snap := db.acquireSnapshot()
+		defer db.releaseSnapshot(snap)
+
+		entries := 0
+		if err := bpScan(snap, index.RootPageID, lo, hi, func([]byte, uint64) bool {
+			entries++
+			return true
+		}); err != nil {
+			t.Fatalf("Failed to scan index: %v", err)
+		}
+		if entries != 0 {
+			t.Fatalf("Expected stale entries for age 10 to be removed, found %d", entries)
+		}
+	})
+
+	// Test: indexes survive a restart and can be dropped
+	t.Run("Reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+
+		table, _ := db.GetTableSchema("users")
+		if len(table.Indexes) != 3 {
+			t.Fatalf("Expected 3 indexes after reopen, got %d", len(table.Indexes))
+		}
+		checkIndexed(t, "age", "<", int64(5))
+		checkIndexed(t, "email", "=", "user0001@example.com")
+
+		if err := db.DropIndex("users", "users_age"); err != nil {
+			t.Fatalf("Failed to drop index: %v", err)
+		}
+		if err := db.DropIndex("users", "users_age"); err == nil {
+			t.Fatal("Expected error dropping a missing index, got nil")
+		}
+
+		rows, err := db.SelectWhere("users", "age", "=", int64(7))
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		if len(rows) != rowCount/50 {
+			t.Fatalf("Expected %d rows after dropping the index, got %d", rowCount/50, len(rows))
+		}
+	})
+
+	db.Close()
+}
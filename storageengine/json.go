@@ -0,0 +1,509 @@
+package storageengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TJSON columns hold JSON documents in a compact binary form. Every value
+// starts with a tag byte:
+//
+//	null, false, true   the tag alone
+//	integer             zigzag varint, also for whole numbers written as 1.0 or 1e3
+//	float               8-byte IEEE 754
+//	string              [uvarint length][UTF-8 bytes]
+//	array               [uvarint body length][uvarint count][values]
+//	object              [uvarint body length][uvarint count][uvarint key length][key][value]...
+//
+// Object keys are sorted and unique, so equal documents have equal encodings.
+// The body length of arrays and objects lets a path lookup step over the
+// values it does not need without reading them.
+const (
+	jsonNull byte = iota
+	jsonFalse
+	jsonTrue
+	jsonInt
+	jsonFloat
+	jsonString
+	jsonArray
+	jsonObject
+)
+
+// maxJSONDepth bounds the nesting of documents, which are read recursively
+const maxJSONDepth = 512
+
+// JSON is a document of a TJSON column. It marshals back to JSON text with
+// encoding/json.
+type JSON struct {
+	data []byte // binary form
+}
+
+// ParseJSON parses JSON text into a document
+func ParseJSON(text []byte) (JSON, error) {
+	if !json.Valid(text) {
+		return JSON{}, errors.New("invalid JSON")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(text))
+	dec.UseNumber()
+	data, err := appendJSON(nil, dec, 0)
+	if err != nil {
+		return JSON{}, err
+	}
+	return JSON{data: data}, nil
+}
+
+// appendJSON appends the binary form of the next value of dec
+func appendJSON(buf []byte, dec *json.Decoder, depth int) ([]byte, error) {
+	if depth > maxJSONDepth {
+		return nil, fmt.Errorf("JSON is nested deeper than %d levels", maxJSONDepth)
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := tok.(type) {
+	case nil:
+		return append(buf, jsonNull), nil
+	case bool:
+		if v {
+			return append(buf, jsonTrue), nil
+		}
+		return append(buf, jsonFalse), nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return binary.AppendVarint(append(buf, jsonInt), n), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("JSON number %s is out of range", v)
+		}
+		// 1.0 and 1e2 are stored like 1 and 100, so equal documents encode the same
+		if n, ok := floatToInt64(f); ok {
+			return binary.AppendVarint(append(buf, jsonInt), n), nil
+		}
+		return binary.LittleEndian.AppendUint64(append(buf, jsonFloat), math.Float64bits(f)), nil
+	case string:
+		return appendJSONString(append(buf, jsonString), v), nil
+	}
+
+	var body []byte
+	var count int
+	if tok == json.Delim('[') {
+		for ; dec.More(); count++ {
+			if body, err = appendJSON(body, dec, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		buf = append(buf, jsonArray)
+	} else {
+		// Later duplicates of a key win, as when decoding into a map
+		members := make(map[string][]byte)
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			if members[key.(string)], err = appendJSON(nil, dec, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		keys := make([]string, 0, len(members))
+		for key := range members {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			body = appendJSONString(body, key)
+			body = append(body, members[key]...)
+		}
+		count = len(keys)
+		buf = append(buf, jsonObject)
+	}
+	if _, err := dec.Token(); err != nil { // closing delimiter
+		return nil, err
+	}
+
+	counted := binary.AppendUvarint(nil, uint64(count))
+	buf = binary.AppendUvarint(buf, uint64(len(counted)+len(body)))
+	buf = append(buf, counted...)
+	return append(buf, body...), nil
+}
+
+func appendJSONString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// checkJSON checks that data holds exactly one well-formed value, so the
+// other functions can read it without bounds checks
+func checkJSON(data []byte) error {
+	n, err := checkJSONValue(data, 0)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("JSON value has %d bytes left over", len(data)-n)
+	}
+	return nil
+}
+
+// checkJSONValue checks the value at the start of data and returns its length
+func checkJSONValue(data []byte, depth int) (int, error) {
+	truncated := errors.New("JSON value is truncated")
+	if len(data) == 0 {
+		return 0, truncated
+	}
+	if depth > maxJSONDepth {
+		return 0, fmt.Errorf("JSON is nested deeper than %d levels", maxJSONDepth)
+	}
+
+	switch data[0] {
+	case jsonNull, jsonFalse, jsonTrue:
+		return 1, nil
+	case jsonInt:
+		_, n := binary.Varint(data[1:])
+		if n <= 0 {
+			return 0, truncated
+		}
+		return 1 + n, nil
+	case jsonFloat:
+		if len(data) < 9 {
+			return 0, truncated
+		}
+		return 9, nil
+	case jsonString:
+		length, n := binary.Uvarint(data[1:])
+		if n <= 0 || length > uint64(len(data)-1-n) {
+			return 0, truncated
+		}
+		return 1 + n + int(length), nil
+	case jsonArray, jsonObject:
+		length, n := binary.Uvarint(data[1:])
+		if n <= 0 || length > uint64(len(data)-1-n) {
+			return 0, truncated
+		}
+		body := data[1+n : 1+n+int(length)]
+		count, m := binary.Uvarint(body)
+		if m <= 0 {
+			return 0, truncated
+		}
+		offset := m
+		for i := uint64(0); i < count; i++ {
+			if data[0] == jsonObject {
+				keyLen, k := binary.Uvarint(body[offset:])
+				if k <= 0 || keyLen > uint64(len(body)-offset-k) {
+					return 0, truncated
+				}
+				offset += k + int(keyLen)
+			}
+			size, err := checkJSONValue(body[offset:], depth+1)
+			if err != nil {
+				return 0, err
+			}
+			offset += size
+		}
+		if offset != len(body) {
+			return 0, fmt.Errorf("JSON container has %d bytes left over", len(body)-offset)
+		}
+		return 1 + n + int(length), nil
+	}
+	return 0, fmt.Errorf("unknown JSON value tag %d", data[0])
+}
+
+// jsonValueLen returns the length of the well-formed value at the start of data
+func jsonValueLen(data []byte) int {
+	switch data[0] {
+	case jsonInt:
+		_, n := binary.Varint(data[1:])
+		return 1 + n
+	case jsonFloat:
+		return 9
+	case jsonString, jsonArray, jsonObject:
+		length, n := binary.Uvarint(data[1:])
+		return 1 + n + int(length)
+	}
+	return 1
+}
+
+// jsonContainer returns the element count and the elements of an array or object
+func jsonContainer(data []byte) (uint64, []byte) {
+	length, n := binary.Uvarint(data[1:])
+	body := data[1+n : 1+n+int(length)]
+	count, m := binary.Uvarint(body)
+	return count, body[m:]
+}
+
+// jsonKey splits the key off the next member of an object
+func jsonKey(members []byte) (string, []byte) {
+	length, n := binary.Uvarint(members)
+	return string(members[n : n+int(length)]), members[n+int(length):]
+}
+
+// Value returns the document as Go values: map[string]interface{},
+// []interface{}, int64, float64, string, bool and nil
+func (j JSON) Value() interface{} {
+	if len(j.data) == 0 {
+		return nil
+	}
+	return jsonValue(j.data)
+}
+
+func jsonValue(data []byte) interface{} {
+	switch data[0] {
+	case jsonFalse:
+		return false
+	case jsonTrue:
+		return true
+	case jsonInt:
+		n, _ := binary.Varint(data[1:])
+		return n
+	case jsonFloat:
+		return math.Float64frombits(binary.LittleEndian.Uint64(data[1:9]))
+	case jsonString:
+		length, n := binary.Uvarint(data[1:])
+		return string(data[1+n : 1+n+int(length)])
+	case jsonArray:
+		count, elems := jsonContainer(data)
+		values := make([]interface{}, 0, count)
+		for i := uint64(0); i < count; i++ {
+			values = append(values, jsonValue(elems))
+			elems = elems[jsonValueLen(elems):]
+		}
+		return values
+	case jsonObject:
+		count, members := jsonContainer(data)
+		values := make(map[string]interface{}, count)
+		for i := uint64(0); i < count; i++ {
+			var key string
+			key, members = jsonKey(members)
+			values[key] = jsonValue(members)
+			members = members[jsonValueLen(members):]
+		}
+		return values
+	}
+	return nil
+}
+
+// MarshalJSON returns the document as compact JSON text, with object keys in
+// sorted order
+func (j JSON) MarshalJSON() ([]byte, error) {
+	if len(j.data) == 0 {
+		return []byte("null"), nil
+	}
+	return appendJSONText(nil, j.data), nil
+}
+
+// String returns the document as JSON text
+func (j JSON) String() string {
+	text, _ := j.MarshalJSON()
+	return string(text)
+}
+
+func appendJSONText(buf []byte, data []byte) []byte {
+	switch data[0] {
+	case jsonArray:
+		count, elems := jsonContainer(data)
+		buf = append(buf, '[')
+		for i := uint64(0); i < count; i++ {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONText(buf, elems)
+			elems = elems[jsonValueLen(elems):]
+		}
+		return append(buf, ']')
+	case jsonObject:
+		count, members := jsonContainer(data)
+		buf = append(buf, '{')
+		for i := uint64(0); i < count; i++ {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			var key string
+			key, members = jsonKey(members)
+			text, _ := json.Marshal(key)
+			buf = append(append(buf, text...), ':')
+			buf = appendJSONText(buf, members)
+			members = members[jsonValueLen(members):]
+		}
+		return append(buf, '}')
+	}
+	// Scalars are formatted by encoding/json, which cannot fail for them
+	text, _ := json.Marshal(jsonValue(data))
+	return append(buf, text...)
+}
+
+// Path returns the value at a path of object keys and array indexes, such as
+// Path("items", "0", "sku"). Arrays and objects are returned as JSON, other
+// values as by Value. ok is false if the path does not exist.
+func (j JSON) Path(path ...string) (value interface{}, ok bool) {
+	if len(j.data) == 0 {
+		return nil, false
+	}
+	data := j.data
+	for _, segment := range path {
+		if data, ok = jsonChild(data, segment); !ok {
+			return nil, false
+		}
+	}
+
+	if data[0] == jsonArray || data[0] == jsonObject {
+		return JSON{data: data[:jsonValueLen(data)]}, true
+	}
+	return jsonValue(data), true
+}
+
+// jsonChild returns the member of an object or the element of an array
+// that a path segment names
+func jsonChild(data []byte, segment string) ([]byte, bool) {
+	switch data[0] {
+	case jsonArray:
+		index, err := strconv.ParseUint(segment, 10, 64)
+		count, elems := jsonContainer(data)
+		if err != nil || index >= count {
+			return nil, false
+		}
+		for ; index > 0; index-- {
+			elems = elems[jsonValueLen(elems):]
+		}
+		return elems, true
+	case jsonObject:
+		count, members := jsonContainer(data)
+		for i := uint64(0); i < count; i++ {
+			var key string
+			key, members = jsonKey(members)
+			if key == segment {
+				return members, true
+			}
+			if key > segment {
+				break // keys are sorted
+			}
+			members = members[jsonValueLen(members):]
+		}
+	}
+	return nil, false
+}
+
+// toJSON returns the document of a value written to a TJSON column. Strings,
+// byte slices and json.RawMessage are taken as JSON text, other values are
+// marshaled with encoding/json.
+func toJSON(value interface{}) (JSON, error) {
+	switch v := value.(type) {
+	case JSON:
+		return v, nil
+	case string:
+		return ParseJSON([]byte(v))
+	case []byte:
+		return ParseJSON(v)
+	case json.RawMessage:
+		return ParseJSON(v)
+	}
+
+	text, err := json.Marshal(value)
+	if err != nil {
+		return JSON{}, fmt.Errorf("cannot convert %T to JSON: %w", value, err)
+	}
+	return ParseJSON(text)
+}
+
+// readJSON returns the document stored as data, which is copied
+func readJSON(data []byte) (JSON, error) {
+	if err := checkJSON(data); err != nil {
+		return JSON{}, err
+	}
+	return JSON{data: append([]byte{}, data...)}, nil
+}
+
+// columnPath resolves a column name, or a path into a JSON column such as
+// "payload.user.id". A column whose name contains dots takes precedence.
+func (t *Table) columnPath(name string) (col *Column, path []string, ok bool) {
+	if col, ok := t.column(name); ok {
+		return col, nil, true
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] != '.' {
+			continue
+		}
+		if col, ok := t.column(name[:i]); ok && col.Type == TJSON {
+			return col, strings.Split(name[i+1:], "."), true
+		}
+	}
+	return nil, nil, false
+}
+
+// jsonPathValue returns the scalar at a path of a value of a JSON column.
+// Missing paths, JSON null and arrays and objects give nil.
+func jsonPathValue(value interface{}, path []string) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	doc, err := toJSON(value)
+	if err != nil {
+		return nil, err
+	}
+	v, _ := doc.Path(path...)
+	if _, isDoc := v.(JSON); isDoc {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// jsonScalar converts a value compared with a JSON path to the Go type JSON
+// values of its kind are read back as
+func jsonScalar(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string, bool:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	if n, ok := toInt64(value); ok {
+		return n, nil
+	}
+	return nil, fmt.Errorf("expected a string, number or boolean to compare a JSON path with")
+}
+
+// jsonKind groups the scalars that compare with each other
+func jsonKind(value interface{}) byte {
+	switch value.(type) {
+	case bool:
+		return jsonTrue
+	case int64, float64:
+		return jsonFloat
+	case string:
+		return jsonString
+	}
+	return jsonNull
+}
+
+// appendJSONKey appends the index key of a scalar at a JSON path. Booleans
+// sort before numbers and numbers before strings.
+func appendJSONKey(buf []byte, value interface{}) ([]byte, error) {
+	v, err := jsonScalar(value)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return append(buf, 1, 1), nil
+		}
+		return append(buf, 1, 0), nil
+	case int64:
+		return appendFloatKey(append(buf, 2), float64(v)), nil
+	case float64:
+		return appendFloatKey(append(buf, 2), v), nil
+	}
+	return appendKeyBytes(append(buf, 3), v.(string)), nil
+}
@@ -0,0 +1,292 @@
+package storageengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestJSONColumns tests storing JSON documents and querying and indexing paths into them
+func TestJSONColumns(t *testing.T) {
+	dbPath := "json_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "kind", Type: Tstring, NotNull: true},
+		{Name: "payload", Type: TJSON},
+	}
+	if err := db.CreateTable("events", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// Documents come as text, as json.RawMessage or as Go values to marshal
+	for i := 1; i <= 30; i++ {
+		var payload interface{}
+		switch i % 3 {
+		case 0:
+			payload = fmt.Sprintf(`{"user": {"id": %d, "name": "user %d"}, "tags": ["a", "t%d"], "ok": true}`, i, i, i%2)
+		case 1:
+			payload = json.RawMessage(fmt.Sprintf(`{"ok": false, "user": {"name": "user %d", "id": %d.0}, "tags": []}`, i, i))
+		case 2:
+			payload = map[string]interface{}{"user": map[string]interface{}{"id": i, "name": fmt.Sprintf("user %d", i)}}
+		}
+		if i == 30 {
+			payload = fmt.Sprintf(`{"user": {"id": 30}, "blob": %q}`, strings.Repeat("j", 5000)) // stored out of line
+		}
+		values := map[string]interface{}{"id": int64(i), "kind": "click", "payload": payload}
+		if err := db.Insert("events", values); err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+	if err := db.Insert("events", map[string]interface{}{"id": int64(31), "kind": "empty"}); err != nil {
+		t.Fatalf("Failed to insert a row without a document: %v", err)
+	}
+	err = db.Insert("events", map[string]interface{}{"id": int64(32), "kind": "click", "payload": `{"user": `})
+	if err == nil {
+		t.Fatal("Expected invalid JSON to be rejected")
+	}
+
+	checkOK := func(t *testing.T) {
+		t.Helper()
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Failed to check database: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("Expected no problems, got %v", report.Problems)
+		}
+	}
+
+	// ids returns the IDs of the rows where a column or path compares to value with op
+	ids := func(t *testing.T, column, op string, value interface{}) []int64 {
+		t.Helper()
+		rows, err := db.SelectWhere("events", column, op, value)
+		if err != nil {
+			t.Fatalf("Failed to select %s %s %v: %v", column, op, value, err)
+		}
+		var ids []int64
+		for _, row := range rows {
+			ids = append(ids, row.Values["id"].(int64))
+		}
+		return ids
+	}
+
+	// queries is run with and without an index on the path
+	queries := func(t *testing.T, prefix string) {
+		t.Helper()
+		if got := ids(t, prefix+".user.id", "=", 42-20); len(got) != 1 || got[0] != 22 {
+			t.Fatalf("Expected row 22 where the user ID is 22, got %v", got)
+		}
+		if got := ids(t, prefix+".user.id", "=", 7.0); len(got) != 1 || got[0] != 7 {
+			t.Fatalf("Expected integers and floats to compare by value, got %v", got)
+		}
+		if got := ids(t, prefix+".user.id", ">", 25); len(got) != 5 {
+			t.Fatalf("Expected 5 rows with a user ID above 25, got %v", got)
+		}
+		if got := ids(t, prefix+".user.id", "<", "100"); len(got) != 0 {
+			t.Fatalf("Expected numbers never to match a string, got %v", got)
+		}
+		if got := ids(t, prefix+".user.name", "=", "user 3"); len(got) != 1 || got[0] != 3 {
+			t.Fatalf("Expected row 3 by user name, got %v", got)
+		}
+		if got := ids(t, prefix+".ok", "=", true); len(got) != 9 {
+			t.Fatalf("Expected 9 rows with ok set, got %v", got)
+		}
+		if got := ids(t, prefix+".tags.1", "=", "t1"); len(got) != 5 {
+			t.Fatalf("Expected 5 rows with the second tag t1, got %v", got)
+		}
+		if got := ids(t, prefix+".missing", "!=", "x"); len(got) != 0 {
+			t.Fatalf("Expected rows without the path not to match, got %v", got)
+		}
+	}
+
+	// Test: documents read back as JSON and paths compare by their JSON values
+	t.Run("Query", func(t *testing.T) {
+		row, err := db.SelectByPK("events", int64(4))
+		if err != nil {
+			t.Fatalf("Failed to select row: %v", err)
+		}
+		doc, ok := row.Values["payload"].(JSON)
+		if !ok {
+			t.Fatalf("Expected a JSON value, got %T", row.Values["payload"])
+		}
+		if want := `{"ok":false,"tags":[],"user":{"id":4,"name":"user 4"}}`; doc.String() != want {
+			t.Fatalf("Expected compact JSON with sorted keys %s, got %s", want, doc)
+		}
+		if name, ok := doc.Path("user", "name"); !ok || name != "user 4" {
+			t.Fatalf("Expected the user name at its path, got %v, %v", name, ok)
+		}
+
+		row, _ = db.SelectByPK("events", int64(30))
+		if blob, _ := row.Values["payload"].(JSON).Path("blob"); blob != strings.Repeat("j", 5000) {
+			t.Fatal("Expected a document stored out of line to read back whole")
+		}
+
+		queries(t, "payload")
+
+		// Whole documents compare for equality whatever their key order and spacing
+		if got := ids(t, "payload", "=", `{"user":{"name":"user 2","id":2}}`); len(got) != 1 || got[0] != 2 {
+			t.Fatalf("Expected row 2 by its whole document, got %v", got)
+		}
+		// 1.0 is the number 1 whether the whole document or the path is compared
+		if err := db.CreateTable("counts", []Column{{Name: "doc", Type: TJSON}}, ""); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+		for _, text := range []string{`{"n":1}`, `{"n":1.0}`, `{"n":1e0}`} {
+			if err := db.Insert("counts", map[string]interface{}{"doc": text}); err != nil {
+				t.Fatalf("Failed to insert %s: %v", text, err)
+			}
+		}
+		for _, q := range []struct {
+			column string
+			value  interface{}
+		}{{"doc", `{"n":1}`}, {"doc", `{"n":1.0}`}, {"doc.n", 1}, {"doc.n", 1.0}} {
+			if rows, err := db.SelectWhere("counts", q.column, "=", q.value); err != nil || len(rows) != 3 {
+				t.Fatalf("Expected 3 rows where %s = %v, got %d, %v", q.column, q.value, len(rows), err)
+			}
+		}
+		if _, err := db.SelectWhere("events", "payload", ">", `{}`); err == nil {
+			t.Fatal("Expected ordering whole documents to be rejected")
+		}
+		if _, err := db.SelectWhere("events", "payload.user.id", "=", nil); err == nil {
+			t.Fatal("Expected comparing a path with NULL to be rejected")
+		}
+		if _, err := db.SelectWhere("events", "kind.length", "=", 1); err == nil {
+			t.Fatal("Expected a path into a column that is not JSON to be rejected")
+		}
+		checkOK(t)
+	})
+
+	// Test: an index on a path gives the same answers and can be unique
+	t.Run("Index", func(t *testing.T) {
+		for _, path := range []string{"payload.user.id", "payload.user.name", "payload.ok", "payload.tags.1"} {
+			if err := db.CreateIndex("events", "events_"+path, []string{path}, false); err != nil {
+				t.Fatalf("Failed to create index on %s: %v", path, err)
+			}
+		}
+		queries(t, "payload")
+
+		if err := db.CreateIndex("events", "events_user", []string{"payload.user.id"}, true); err != nil {
+			t.Fatalf("Failed to create unique index: %v", err)
+		}
+		err := db.Insert("events", map[string]interface{}{"id": int64(40), "kind": "click", "payload": `{"user": {"id": 5}}`})
+		var dupErr *DuplicateKeyError
+		if !errors.As(err, &dupErr) || dupErr.Value != int64(5) {
+			t.Fatalf("Expected a DuplicateKeyError for user 5, got %v", err)
+		}
+
+		// Updates move rows between index entries
+		if err := db.UpdateByID("events", 1, map[string]interface{}{"payload": `{"user": {"id": 100}}`}); err != nil {
+			t.Fatalf("Failed to update document: %v", err)
+		}
+		if got := ids(t, "payload.user.id", "=", 100); len(got) != 1 || got[0] != 1 {
+			t.Fatalf("Expected the updated row under its new user ID, got %v", got)
+		}
+		if got := ids(t, "payload.user.id", "=", 1); len(got) != 0 {
+			t.Fatalf("Expected the old user ID to be gone, got %v", got)
+		}
+		if err := db.UpdateByID("events", 1, map[string]interface{}{"payload": `{"user": {"id": 1}, "ok": false, "tags": []}`}); err != nil {
+			t.Fatalf("Failed to update document back: %v", err)
+		}
+
+		if err := db.CreateIndex("events", "events_payload", []string{"payload"}, false); err == nil {
+			t.Fatal("Expected indexing a whole JSON column to be rejected")
+		}
+		checkOK(t)
+	})
+
+	// Test: path indexes follow their column when it is renamed and keep it from being dropped
+	t.Run("Rename", func(t *testing.T) {
+		if err := db.RenameColumn("events", "payload", "body"); err != nil {
+			t.Fatalf("Failed to rename column: %v", err)
+		}
+		table, _ := db.GetTableSchema("events")
+		if index, ok := table.index("events_user"); !ok || index.Columns[0] != "body.user.id" {
+			t.Fatalf("Expected the index to follow the renamed column, got %v", index)
+		}
+		queries(t, "body")
+
+		if err := db.DropColumn("events", "body"); err == nil {
+			t.Fatal("Expected dropping a column with an index on a path to fail")
+		}
+		checkOK(t)
+	})
+
+	// Test: documents and path indexes survive reopening
+	t.Run("Reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+		queries(t, "body")
+		checkOK(t)
+	})
+}
+
+// TestJSONEncoding tests the binary form of JSON documents
+func TestJSONEncoding(t *testing.T) {
+	text := `{"b": [1, -2.5, "x\u0000y", null, true, {"nested": []}], "a": 1e3, "c": 9007199254740993, "a": "last"}`
+	doc, err := ParseJSON([]byte(text))
+	if err != nil {
+		t.Fatalf("Failed to parse JSON: %v", err)
+	}
+	if err := checkJSON(doc.data); err != nil {
+		t.Fatalf("Expected the encoding to check out: %v", err)
+	}
+
+	want := `{"a":"last","b":[1,-2.5,"x\u0000y",null,true,{"nested":[]}],"c":9007199254740993}`
+	if got := doc.String(); got != want {
+		t.Fatalf("Expected %s, got %s", want, got)
+	}
+	value := doc.Value().(map[string]interface{})
+	if value["c"] != int64(9007199254740993) {
+		t.Fatalf("Expected large integers to stay exact, got %v", value["c"])
+	}
+	if v, ok := doc.Path("b", "4"); !ok || v != true {
+		t.Fatalf("Expected true at b.4, got %v, %v", v, ok)
+	}
+	if v, ok := doc.Path("b", "5"); !ok || v.(JSON).String() != `{"nested":[]}` {
+		t.Fatalf("Expected an object at b.5, got %v, %v", v, ok)
+	}
+	for _, path := range [][]string{{"b", "6"}, {"b", "x"}, {"a", "0"}, {"d"}} {
+		if v, ok := doc.Path(path...); ok {
+			t.Fatalf("Expected no value at %v, got %v", path, v)
+		}
+	}
+
+	// A damaged encoding is caught rather than read out of bounds
+	for n := range doc.data {
+		if err := checkJSON(doc.data[:n]); err == nil {
+			t.Fatalf("Expected %d of %d bytes to be rejected", n, len(doc.data))
+		}
+	}
+
+	// Whole numbers encode the same however they are written
+	one, _ := ParseJSON([]byte("1"))
+	for _, text := range []string{"1.0", "1e0", "0.1e1"} {
+		if doc, err := ParseJSON([]byte(text)); err != nil || !bytes.Equal(doc.data, one.data) {
+			t.Fatalf("Expected %s to encode like 1, got %v, %v", text, doc.data, err)
+		}
+	}
+
+	for _, invalid := range []string{"", "{", `{"a" 1}`, "[1,]", "1 2", "1e999"} {
+		if _, err := ParseJSON([]byte(invalid)); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+}
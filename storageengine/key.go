@@ -0,0 +1,194 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Index keys are encoded so that comparing the bytes gives the same order as
+// comparing the values. Every value starts with a marker byte so NULL sorts
+// first and keys of several columns can simply be concatenated.
+const (
+	keyNull    byte = 0x00
+	keyNotNull byte = 0x01
+)
+
+// encodeKey encodes a single column value as an index key
+func encodeKey(value interface{}, col Column) ([]byte, error) {
+	return appendKey(nil, value, col)
+}
+
+// appendKey appends the order-preserving encoding of a value of a column to buf
+func appendKey(buf []byte, value interface{}, col Column) ([]byte, error) {
+	if value == nil {
+		return append(buf, keyNull), nil
+	}
+	buf = append(buf, keyNotNull)
+
+	switch col.Type {
+	case TInteger:
+		v, ok := toInt64(value)
+		if !ok {
+			return nil, fmt.Errorf("expected integer value")
+		}
+		// Flipping the sign bit makes negative numbers sort first
+		return binary.BigEndian.AppendUint64(buf, uint64(v)^(1<<63)), nil
+
+	case Tfloat:
+		v, ok := toFloat64(value)
+		if !ok {
+			return nil, fmt.Errorf("expected numeric value")
+		}
+		return appendFloatKey(buf, v), nil
+
+	case Tstring:
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string value")
+		}
+		return appendKeyBytes(buf, str), nil
+
+	case TBytes:
+		b, ok := value.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("expected []byte value")
+		}
+		return appendKeyBytes(buf, b), nil
+
+	case Tbool:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected boolean value")
+		}
+		if b {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+
+	case TTimestamp:
+		nanos, err := toTimestamp(value)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(buf, uint64(nanos)^(1<<63)), nil
+
+	case TDate:
+		days, err := toDate(value)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint32(buf, uint32(days)^(1<<31)), nil
+
+	case TDecimal:
+		// All values of a column have its scale, so the coefficients sort like integers
+		coef, err := toDecimal(value, col.Scale)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(buf, uint64(coef)^(1<<63)), nil
+
+	case TUUID:
+		u, err := toUUID(value)
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, u[:]...), nil
+
+	case TJSON:
+		// Only paths into JSON columns are indexed, value is the scalar at the path
+		return appendJSONKey(buf, value)
+
+	case TArray:
+		return nil, fmt.Errorf("array columns cannot be indexed")
+
+	case TVector:
+		return nil, fmt.Errorf("vector columns cannot be indexed, use CreateVectorIndex")
+	}
+
+	return nil, fmt.Errorf("unknown column type")
+}
+
+// appendFloatKey appends a float so that negative numbers sort first
+func appendFloatKey(buf []byte, v float64) []byte {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return binary.BigEndian.AppendUint64(buf, bits)
+}
+
+// appendKeyBytes appends a string or byte slice. Zero bytes are escaped and
+// the value is terminated, so a prefix sorts before longer values.
+func appendKeyBytes[T string | []byte](buf []byte, data T) []byte {
+	for i := 0; i < len(data); i++ {
+		if data[i] == 0x00 {
+			buf = append(buf, 0x00, 0xFF)
+		} else {
+			buf = append(buf, data[i])
+		}
+	}
+	return append(buf, 0x00, 0x01)
+}
+
+// toInt64 converts any Go integer, or a float holding a whole number, to
+// int64. Fractions and values out of int64's range are rejected rather than
+// truncated or wrapped.
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), uint64(v) <= math.MaxInt64
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), v <= math.MaxInt64
+	case float32:
+		return floatToInt64(float64(v))
+	case float64:
+		return floatToInt64(v)
+	}
+	return 0, false
+}
+
+// floatToInt64 converts a float holding a whole number in int64's range
+func floatToInt64(f float64) (int64, bool) {
+	// -2^63 is exact as a float, 2^63 is the first whole float out of range
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= -math.MinInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// toFloat64 converts any Go number to float64
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case uint:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	if v, ok := toInt64(value); ok {
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,124 @@
+package storageengine
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SelectWhere matches strings against patterns with three operators:
+//
+//	LIKE    SQL pattern, where % matches any run of characters, _ matches
+//	        exactly one and the escape character makes the next one literal
+//	ILIKE   LIKE ignoring case
+//	REGEXP  regular expression in Go's syntax, matching anywhere in the
+//	        string unless anchored with ^ and $
+//
+// Patterns apply to string columns and to paths into JSON columns, where rows
+// holding anything but a string at the path never match. A pattern is
+// compiled once per query, into a regular expression for all three operators.
+
+// LikePattern is a LIKE or ILIKE pattern with an escape character of its
+// own. A plain string pattern escapes with a backslash.
+type LikePattern struct {
+	Pattern string
+	Escape  rune // makes the next character literal, a backslash if zero
+}
+
+// isPatternOp reports whether op matches strings against a pattern
+func isPatternOp(op string) bool {
+	return op == "LIKE" || op == "ILIKE" || op == "REGEXP"
+}
+
+// patternCondition builds the row predicate of a pattern operator on a
+// string column, or on a path into a JSON column if path is set
+func patternCondition(col *Column, path []string, op string, value interface{}) (func(row *Row) bool, error) {
+	if path == nil && col.Type != Tstring {
+		return nil, fmt.Errorf("%s operator requires a string column or a path into a JSON column", op)
+	}
+	re, err := compilePattern(op, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(row *Row) bool {
+		rowVal := row.Values[col.Name]
+		if path != nil {
+			doc, ok := rowVal.(JSON)
+			if !ok {
+				return false
+			}
+			rowVal, _ = doc.Path(path...)
+		}
+		str, ok := rowVal.(string)
+		return ok && re.MatchString(str)
+	}, nil
+}
+
+// compilePattern compiles the pattern of a pattern operator
+func compilePattern(op string, value interface{}) (*regexp.Regexp, error) {
+	if op == "REGEXP" {
+		expr, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("REGEXP operator requires a string value")
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression: %w", err)
+		}
+		return re, nil
+	}
+
+	var pattern LikePattern
+	switch v := value.(type) {
+	case string:
+		pattern.Pattern = v
+	case LikePattern:
+		pattern = v
+	default:
+		return nil, fmt.Errorf("%s operator requires a string or LikePattern value", op)
+	}
+	expr, err := likeExpr(pattern, op == "ILIKE")
+	if err != nil {
+		return nil, err
+	}
+	return regexp.MustCompile(expr), nil
+}
+
+// likeExpr translates a LIKE pattern into an anchored regular expression
+func likeExpr(pattern LikePattern, ignoreCase bool) (string, error) {
+	escape := pattern.Escape
+	if escape == 0 {
+		escape = '\\'
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^(?s")
+	if ignoreCase {
+		expr.WriteString("i")
+	}
+	expr.WriteString(")")
+
+	escaped := false
+	for _, r := range pattern.Pattern {
+		switch {
+		case escaped:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == escape:
+			escaped = true
+		case r == '%':
+			expr.WriteString(".*")
+		case r == '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if escaped {
+		return "", fmt.Errorf("LIKE pattern %q ends with its escape character", pattern.Pattern)
+	}
+
+	expr.WriteString("$")
+	return expr.String(), nil
+}
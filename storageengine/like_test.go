@@ -0,0 +1,144 @@
+package storageengine
+
+import (
+	"os"
+	"testing"
+)
+
+// TestLikePatterns tests matching strings against LIKE, ILIKE and REGEXP patterns
+func TestLikePatterns(t *testing.T) {
+	for _, tc := range []struct {
+		op    string
+		value interface{}
+		str   string
+		want  bool
+	}{
+		{"LIKE", "abc", "abc", true},
+		{"LIKE", "abc", "abcd", false},
+		{"LIKE", "a%", "a", true},
+		{"LIKE", "%c", "abc", true},
+		{"LIKE", "a%b%c", "a--b--c", true},
+		{"LIKE", "a%b%c", "a--c--b", false},
+		{"LIKE", "%%", "", true},
+		{"LIKE", "%b%", "abc", true},
+		{"LIKE", "%%b", "bb", true},
+		{"LIKE", "a_c", "abc", true},
+		{"LIKE", "a_c", "ac", false},
+		{"LIKE", "a_c", "aéc", true},
+		{"LIKE", "___", "ab\nc", false},
+		{"LIKE", "a%", "a\nb", true},
+		{"LIKE", `50\%`, "50%", true},
+		{"LIKE", `50\%`, "500", false},
+		{"LIKE", `a\_c`, "abc", false},
+		{"LIKE", `a\\b`, `a\b`, true},
+		{"LIKE", LikePattern{Pattern: "50!%%", Escape: '!'}, "50% off", true},
+		{"LIKE", LikePattern{Pattern: `a\%`, Escape: '!'}, `a\bc`, true},
+		{"LIKE", "a.*", "abc", false},
+		{"LIKE", "ABC", "abc", false},
+		{"ILIKE", "ABC", "abc", true},
+		{"ILIKE", "straße%", "STRASSE", false},
+		{"ILIKE", "ÉCOLE_", "écoles", true},
+		{"REGEXP", "^a.c$", "abc", true},
+		{"REGEXP", "b+", "abbbc", true},
+		{"REGEXP", "^b", "abc", false},
+	} {
+		re, err := compilePattern(tc.op, tc.value)
+		if err != nil {
+			t.Fatalf("Failed to compile %s %v: %v", tc.op, tc.value, err)
+		}
+		if got := re.MatchString(tc.str); got != tc.want {
+			t.Fatalf("Expected %q %s %v to be %v", tc.str, tc.op, tc.value, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		op    string
+		value interface{}
+	}{
+		{"LIKE", `abc\`},
+		{"LIKE", LikePattern{Pattern: "a!", Escape: '!'}},
+		{"LIKE", 5},
+		{"REGEXP", "a("},
+		{"REGEXP", LikePattern{Pattern: "a"}},
+	} {
+		if _, err := compilePattern(tc.op, tc.value); err == nil {
+			t.Fatalf("Expected %s %v to be rejected", tc.op, tc.value)
+		}
+	}
+}
+
+// TestPatternQueries tests the pattern operators in SelectWhere
+func TestPatternQueries(t *testing.T) {
+	dbPath := "like_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring},
+		{Name: "meta", Type: TJSON},
+	}
+	if err := db.CreateTable("products", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for i, name := range []string{"Apple Pie", "apple juice", "Banana Split", "100% Juice", "Cherry"} {
+		values := map[string]interface{}{
+			"id":   int64(i + 1),
+			"name": name,
+			"meta": map[string]interface{}{"sku": name[:3], "rank": i},
+		}
+		if err := db.Insert("products", values); err != nil {
+			t.Fatalf("Failed to insert row: %v", err)
+		}
+	}
+	if err := db.Insert("products", map[string]interface{}{"id": int64(6)}); err != nil {
+		t.Fatalf("Failed to insert row without a name: %v", err)
+	}
+	// An index on the column does not change the answers
+	if err := db.CreateIndex("products", "products_name", []string{"name"}, false); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+
+	for _, q := range []struct {
+		column, op string
+		value      interface{}
+		want       int
+	}{
+		{"name", "LIKE", "%e%i%", 2},
+		{"name", "LIKE", "apple%", 1},
+		{"name", "ILIKE", "apple%", 2},
+		{"name", "LIKE", "_pple%", 2},
+		{"name", "LIKE", `100\% %`, 1},
+		{"name", "LIKE", "%", 5},
+		{"name", "ILIKE", "%JUICE", 2},
+		{"name", "REGEXP", "^[A-Z][a-z]+$", 1},
+		{"name", "REGEXP", "(?i)split|pie", 2},
+		{"meta.sku", "LIKE", "App", 1},
+		{"meta.sku", "ILIKE", "app", 2},
+		{"meta.rank", "LIKE", "%", 0},
+	} {
+		rows, err := db.SelectWhere("products", q.column, q.op, q.value)
+		if err != nil {
+			t.Fatalf("Failed to select %s %s %v: %v", q.column, q.op, q.value, err)
+		}
+		if len(rows) != q.want {
+			t.Fatalf("Expected %d rows where %s %s %v, got %d", q.want, q.column, q.op, q.value, len(rows))
+		}
+	}
+
+	if _, err := db.SelectWhere("products", "id", "LIKE", "1%"); err == nil {
+		t.Fatal("Expected LIKE on an integer column to be rejected")
+	}
+	if _, err := db.SelectWhere("products", "meta", "REGEXP", "a"); err == nil {
+		t.Fatal("Expected REGEXP on a whole JSON column to be rejected")
+	}
+	if _, err := db.SelectWhere("products", "name", "REGEXP", "[a-"); err == nil {
+		t.Fatal("Expected an invalid regular expression to be rejected")
+	}
+}
@@ -0,0 +1,163 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The meta page is always page 0. It is the superblock of the file and holds
+// what opening the database needs to find everything else, so the rest of the
+// file is never scanned:
+//
+//	[21:29] magic number identifying a gdb file
+//	[29:31] format version
+//	[31:35] page size
+//	[35:43] first table page of the catalog
+//	[43:51] first page of the free list
+//	[51:59] last page of the free list
+//	[59:67] next transaction ID
+//	[67:75] next page ID
+//	[75:79] next table ID
+//
+// Table pages are chained through the next page ID in their header, see
+// catalog.go for what they hold.
+const (
+	metaPageID = 0
+	metaSize   = 79
+)
+
+// metaMagic starts the meta page of every database file
+const metaMagic = "gdb\x00data"
+
+// formatVersion is the file format written by this version of the engine
+const formatVersion = 9
+
+// Page offsets are 16 bits wide, which bounds the page size
+const (
+	minPageSize = 512
+	maxPageSize = 32768
+)
+
+// ErrNotDatabase is returned when opening a file that is not a database
+var ErrNotDatabase = errors.New("file is not a gdb database")
+
+// dbMeta is the decoded meta page
+type dbMeta struct {
+	pageSize    int
+	catalogHead uint64
+	freeHead    uint64
+	freeTail    uint64
+	nextTxID    uint64
+	nextPageID  uint64
+	nextTableID uint32
+}
+
+// decodeMeta reads the meta page. Only the first metaSize bytes are needed.
+func decodeMeta(page *Page) (dbMeta, error) {
+	if len(page.Data) < metaSize || PageType(page.Data[0]) != PTMeta || string(page.Data[21:29]) != metaMagic {
+		return dbMeta{}, ErrNotDatabase
+	}
+	if version := binary.LittleEndian.Uint16(page.Data[29:31]); version != formatVersion {
+		return dbMeta{}, fmt.Errorf("unsupported file format version %d, expected %d", version, formatVersion)
+	}
+
+	meta := dbMeta{
+		pageSize:    int(binary.LittleEndian.Uint32(page.Data[31:35])),
+		catalogHead: binary.LittleEndian.Uint64(page.Data[35:43]),
+		freeHead:    binary.LittleEndian.Uint64(page.Data[43:51]),
+		freeTail:    binary.LittleEndian.Uint64(page.Data[51:59]),
+		nextTxID:    binary.LittleEndian.Uint64(page.Data[59:67]),
+		nextPageID:  binary.LittleEndian.Uint64(page.Data[67:75]),
+		nextTableID: binary.LittleEndian.Uint32(page.Data[75:79]),
+	}
+	if err := validatePageSize(meta.pageSize); err != nil {
+		return dbMeta{}, fmt.Errorf("invalid meta page: %w", err)
+	}
+	return meta, nil
+}
+
+// encode writes the meta fields into page
+func (m dbMeta) encode(page *Page) {
+	page.Data[0] = byte(PTMeta)
+	copy(page.Data[21:29], metaMagic)
+	binary.LittleEndian.PutUint16(page.Data[29:31], formatVersion)
+	binary.LittleEndian.PutUint32(page.Data[31:35], uint32(m.pageSize))
+	binary.LittleEndian.PutUint64(page.Data[35:43], m.catalogHead)
+	binary.LittleEndian.PutUint64(page.Data[43:51], m.freeHead)
+	binary.LittleEndian.PutUint64(page.Data[51:59], m.freeTail)
+	binary.LittleEndian.PutUint64(page.Data[59:67], m.nextTxID)
+	binary.LittleEndian.PutUint64(page.Data[67:75], m.nextPageID)
+	binary.LittleEndian.PutUint32(page.Data[75:79], m.nextTableID)
+	binary.LittleEndian.PutUint16(page.Data[15:17], metaSize)
+}
+
+// validatePageSize checks that pages of the given size can be addressed
+func validatePageSize(pageSize int) error {
+	if pageSize < minPageSize || pageSize > maxPageSize || pageSize&(pageSize-1) != 0 {
+		return fmt.Errorf("page size %d must be a power of two between %d and %d", pageSize, minPageSize, maxPageSize)
+	}
+	return nil
+}
+
+// readFilePageSize returns the page size recorded in the meta page of a database file
+func readFilePageSize(file *os.File) (int, error) {
+	data := make([]byte, metaSize)
+	if _, err := file.ReadAt(data, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, ErrNotDatabase
+		}
+		return 0, fmt.Errorf("failed to read meta page: %w", err)
+	}
+
+	meta, err := decodeMeta(&Page{ID: metaPageID, Data: data})
+	if err != nil {
+		return 0, err
+	}
+	return meta.pageSize, nil
+}
+
+// initialize writes the meta page of a new, empty database file
+func (db *Database) initialize() error {
+	page := &Page{
+		ID:   metaPageID,
+		Data: make([]byte, db.pageSize),
+	}
+	dbMeta{
+		pageSize:    db.pageSize,
+		nextTxID:    db.nextTxID,
+		nextPageID:  metaPageID + 1,
+		nextTableID: db.nextTableID,
+	}.encode(page)
+	setPageChecksum(page)
+
+	if err := db.writePage(page); err != nil {
+		return fmt.Errorf("failed to write meta page: %w", err)
+	}
+	if err := db.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync database file: %w", err)
+	}
+
+	db.nextPageID = metaPageID + 1
+	return nil
+}
+
+// updateMeta changes the meta page as part of the transaction
+func (tx *Tx) updateMeta(fn func(meta *dbMeta)) error {
+	page, err := tx.modifyPage(metaPageID)
+	if err != nil {
+		return fmt.Errorf("failed to read meta page: %w", err)
+	}
+
+	meta, err := decodeMeta(page)
+	if err != nil {
+		return err
+	}
+
+	fn(&meta)
+	meta.encode(page)
+
+	return tx.writePage(page)
+}
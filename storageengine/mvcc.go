@@ -0,0 +1,284 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// pruneInterval is how often the background pruner looks for dead row versions
+const pruneInterval = time.Second
+
+// acquireSnapshot takes a read view of everything committed so far.
+// The snapshot must be released once the reader is done with it.
+func (db *Database) acquireSnapshot() *snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	snap := &snapshot{
+		db:     db,
+		id:     db.lastCommitted,
+		tables: db.tables,
+	}
+	db.snapshots[snap] = struct{}{}
+
+	return snap
+}
+
+// releaseSnapshot lets the pruner reclaim versions the snapshot could still see
+func (db *Database) releaseSnapshot(snap *snapshot) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.snapshots, snap)
+}
+
+// readPage reads a committed page through the buffer pool. Committing never
+// changes a cached page in place, so the page stays intact while it is pinned.
+func (s *snapshot) readPage(pageID uint64) (*Page, error) {
+	return s.db.readPage(pageID)
+}
+
+// unpinPage releases a page returned by readPage
+func (s *snapshot) unpinPage(page *Page) {
+	s.db.unpinPage(page)
+}
+
+// table returns a table as of the snapshot
+func (s *snapshot) table(name string) (*Table, bool) {
+	table, exists := s.tables[name]
+	return table, exists
+}
+
+// visible reports whether a row version is part of the snapshot
+func (s *snapshot) visible(xmin, xmax uint64) bool {
+	created := xmin != 0 && xmin <= s.id
+	deleted := xmax != 0 && xmax <= s.id
+	return created && !deleted
+}
+
+// visible reports whether a row version is seen by the transaction,
+// which includes its own uncommitted changes
+func (tx *Tx) visible(xmin, xmax uint64) bool {
+	created := xmin != 0 && (xmin == tx.id || xmin <= tx.snapshotID)
+	deleted := xmax != 0 && (xmax == tx.id || xmax <= tx.snapshotID)
+	return created && !deleted
+}
+
+// horizon returns the newest transaction whose deletions no reader can see past.
+// Versions deleted at or before the horizon are invisible to every snapshot.
+// The caller must hold db.mu.
+func (db *Database) horizon() uint64 {
+	horizon := db.lastCommitted
+	for snap := range db.snapshots {
+		if snap.id < horizon {
+			horizon = snap.id
+		}
+	}
+	return horizon
+}
+
+// addGarbage remembers that a page holds a version deleted by xmax.
+// The caller must hold db.mu or have exclusive access to the database.
+func (db *Database) addGarbage(pageID uint64, xmax uint64) {
+	if xmax > db.garbage[pageID] {
+		db.garbage[pageID] = xmax
+	}
+}
+
+// pruneLoop runs the pruner in the background until the database is closed
+func (db *Database) pruneLoop() {
+	defer db.prunerDone.Done()
+
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.stopPruner:
+			return
+		case <-ticker.C:
+			// A failed pass leaves its pages in the garbage map for the next one
+			db.pruneVersions()
+		}
+	}
+}
+
+// pruneVersions reclaims the space of row versions no snapshot can see anymore,
+// together with the index entries that pointed at them.
+//
+// Dead records are removed and the remaining ones packed together, which
+// leaves their slots, and so every row pointer, in place. A page whose
+// records are all dead is freed entirely.
+func (db *Database) pruneVersions() error {
+	db.mu.RLock()
+	horizon := db.horizon()
+	var pageIDs []uint64
+	for pageID, xmax := range db.garbage {
+		if xmax <= horizon {
+			pageIDs = append(pageIDs, pageID)
+		}
+	}
+
+	// A key that turns stale again later may still be seen by a snapshot,
+	// leave it to the newer entry
+	pending := make(map[string]bool)
+	for _, entry := range db.indexGarbage {
+		if entry.xmax > horizon {
+			pending[entry.id()] = true
+		}
+	}
+	var entries []indexGarbage
+	for _, entry := range db.indexGarbage {
+		if entry.xmax <= horizon && !pending[entry.id()] {
+			entries = append(entries, entry)
+		}
+	}
+	db.mu.RUnlock()
+
+	if len(pageIDs) == 0 && len(entries) == 0 {
+		return nil
+	}
+
+	// New snapshots only ever see more than the old ones, so the horizon stays valid
+	tx := db.Begin()
+
+	// Pages freed while waiting for the transaction have nothing left to prune
+	db.mu.RLock()
+	current := pageIDs[:0]
+	for _, pageID := range pageIDs {
+		if _, ok := db.garbage[pageID]; ok {
+			current = append(current, pageID)
+		}
+	}
+	pageIDs = current
+	db.mu.RUnlock()
+
+	var emptied []uint64
+	for _, pageID := range pageIDs {
+		empty, err := tx.prunePage(pageID, horizon)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to prune page %d: %w", pageID, err)
+		}
+		if empty {
+			emptied = append(emptied, pageID)
+		}
+	}
+	if err := tx.releaseDataPages(emptied); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to free empty pages: %w", err)
+	}
+	for _, entry := range entries {
+		if err := tx.pruneIndexEntry(entry); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to prune index %s: %w", entry.index, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, pageID := range pageIDs {
+		if db.garbage[pageID] <= horizon {
+			delete(db.garbage, pageID)
+		}
+	}
+
+	remaining := db.indexGarbage[:0]
+	for _, entry := range db.indexGarbage {
+		if entry.xmax > horizon {
+			remaining = append(remaining, entry)
+		}
+	}
+	db.indexGarbage = remaining
+
+	return nil
+}
+
+// id identifies the index entry across transactions
+func (g indexGarbage) id() string {
+	return fmt.Sprintf("%d\x00%s\x00%s", g.tableID, g.index, g.key)
+}
+
+// prunePage removes the dead records of a data page and packs the rest
+// together. A deleted row whose last version goes is removed from the row
+// index as well. emptied reports whether the page is left without records and
+// can be freed, which is never the case for the page new rows are added to.
+//
+// Newer versions may still link to a removed record, and its slot may be
+// reused, but nobody follows those links anymore: every snapshot sees the
+// newer version.
+func (tx *Tx) prunePage(pageID uint64, horizon uint64) (emptied bool, err error) {
+	page, err := tx.modifyPage(pageID)
+	if err != nil {
+		return false, err
+	}
+
+	if PageType(page.Data[0]) != PTData {
+		return false, nil
+	}
+
+	table, exists := tx.tableByID(binary.LittleEndian.Uint32(page.Data[1:5]))
+	if !exists {
+		return false, fmt.Errorf("data page %d references unknown table", pageID)
+	}
+
+	removed, live := 0, 0
+	for slot := uint16(0); slot < slotCount(page); slot++ {
+		offset := slotOffset(page, slot)
+		if offset == 0 {
+			continue
+		}
+		record, err := readRowRecord(page, offset)
+		if err != nil {
+			return false, err
+		}
+		if record.xmax == 0 || record.xmax > horizon {
+			// Still visible to somebody
+			live++
+			continue
+		}
+
+		version := RowIndex{RowID: record.rowID, Ptr: RowPtr{PageID: pageID, Slot: slot}}
+		if err := tx.unlinkRowVersion(table, version); err != nil {
+			return false, err
+		}
+		// Values stored out of line go with the version
+		if err := tx.freeOverflow(table, record.payload); err != nil {
+			return false, fmt.Errorf("failed to free overflow pages of row %d: %w", record.rowID, err)
+		}
+		setSlotOffset(page, slot, 0)
+		removed++
+	}
+
+	if removed == 0 {
+		return false, nil
+	}
+	if err := compactDataPage(page); err != nil {
+		return false, err
+	}
+
+	return live == 0 && pageID != table.LastPageID, tx.writePage(page)
+}
+
+// unlinkRowVersion removes a row from the row index if the index still points
+// at the given version, which means the row was deleted
+func (tx *Tx) unlinkRowVersion(table *Table, version RowIndex) error {
+	key := rowKey(version.RowID)
+
+	var current uint64
+	var found bool
+	err := bpScan(tx, table.RowIndexRoot, key, prefixEnd(key), func(_ []byte, value uint64) bool {
+		current, found = value, true
+		return false
+	})
+	if err != nil || !found || unpackRowPtr(current) != version.Ptr {
+		return err
+	}
+
+	return tx.bpDelete(table.RowIndexRoot, key)
+}
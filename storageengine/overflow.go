@@ -0,0 +1,289 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Values too large to stay in their row are stored out of line on a chain of
+// PTOverflow pages, and the row keeps a pointer to the chain in their place.
+// Each overflow page holds the next part of the value between its header and
+// its free offset and links to the following page through the next page ID in
+// its header.
+//
+// A chain belongs to a single row version. It is written together with the
+// version and freed when the pruner removes the version.
+
+// overflowPointer takes the place of a value stored out of line. It only
+// appears in rows between serialization and reading the value back.
+type overflowPointer struct {
+	length uint32
+	pageID uint64
+}
+
+// Variable length values are stored as a 4-byte length followed by the data.
+// The top bit of the length marks a value stored out of line, followed by the
+// first page of its chain instead of the data.
+const (
+	overflowFlag     = 1 << 31
+	maxValueLength   = overflowFlag - 1
+	inlineHeaderSize = 4
+	overflowPtrSize  = 4 + 8
+)
+
+// maxRowSize returns the largest row payload that fits on a data page
+func (db *Database) maxRowSize() int {
+	return db.pageSize - pageHeaderSize - rowHeaderSize - slotSize
+}
+
+// overflowThreshold returns the size above which a value is always stored out
+// of line, so that several rows still share a page
+func (db *Database) overflowThreshold() int {
+	return db.maxRowSize() / 4
+}
+
+// storeOverflow moves the values of a row that are too large onto overflow
+// pages and returns the values to serialize. Values above the threshold always
+// move, then the largest remaining ones until the row fits on a page. The
+// caller's values are left alone.
+func (tx *Tx) storeOverflow(table *Table, values map[string]interface{}) (map[string]interface{}, error) {
+	type candidate struct {
+		name string
+		data []byte
+	}
+	var candidates []candidate
+	for _, col := range table.Columns {
+		if !isVarlen(col.Type) || values[col.Name] == nil {
+			continue
+		}
+		data, err := varlenData(col, values[col.Name])
+		if err != nil {
+			return nil, err
+		}
+		// Only values larger than a pointer are worth moving
+		if inlineHeaderSize+len(data) > overflowPtrSize {
+			candidates = append(candidates, candidate{name: col.Name, data: data})
+		}
+	}
+	if len(candidates) == 0 {
+		return values, nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(candidates[i].data) > len(candidates[j].data)
+	})
+
+	data, err := tx.db.serializeRow(&Row{Values: values}, table)
+	if err != nil {
+		return nil, err
+	}
+	size := len(data)
+
+	var stored map[string]interface{}
+	for _, c := range candidates {
+		if len(c.data) <= tx.db.overflowThreshold() && size <= tx.db.maxRowSize() {
+			break
+		}
+		ptr, err := tx.writeOverflow(table.ID, c.data)
+		if err != nil {
+			return nil, err
+		}
+
+		if stored == nil {
+			stored = make(map[string]interface{}, len(values))
+			for name, val := range values {
+				stored[name] = val
+			}
+		}
+		stored[c.name] = ptr
+		size -= inlineHeaderSize + len(c.data) - overflowPtrSize
+	}
+
+	if stored == nil {
+		return values, nil
+	}
+	return stored, nil
+}
+
+// isVarlen reports whether a column type's values are stored as a length and
+// their data, which may go out of line
+func isVarlen(t ColumnType) bool {
+	return t == Tstring || t == TBytes || t == TJSON || t == TArray || t == TVector
+}
+
+// varlenData returns the bytes a value of a string, bytes, JSON, array or
+// vector column is stored as
+func varlenData(col Column, val interface{}) ([]byte, error) {
+	switch v := val.(type) {
+	case string:
+		if col.Type == Tstring {
+			return []byte(v), nil
+		}
+	case []byte:
+		if col.Type == TBytes {
+			return v, nil
+		}
+	}
+	if col.Type == TArray {
+		return encodeArray(col, val)
+	}
+	if col.Type == TVector {
+		return encodeVector(col, val)
+	}
+	if col.Type == TJSON {
+		doc, err := toJSON(val)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col.Name, err)
+		}
+		return doc.data, nil
+	}
+	return nil, fmt.Errorf("invalid type for column %s", col.Name)
+}
+
+// varlenValue returns the value of a string, bytes, JSON, array or vector
+// column stored as data. data may be part of a page and is not kept.
+func varlenValue(col Column, data []byte) (interface{}, error) {
+	switch col.Type {
+	case TBytes:
+		return append([]byte{}, data...), nil
+	case TJSON:
+		return readJSON(data)
+	case TArray:
+		return decodeArray(col, data)
+	case TVector:
+		return decodeVector(col, data)
+	}
+	return string(data), nil
+}
+
+// writeOverflow stores a value on a new chain of overflow pages
+func (tx *Tx) writeOverflow(tableID uint32, data []byte) (overflowPointer, error) {
+	return tx.writeChain(PTOverflow, tableID, data)
+}
+
+// writeChain stores data on a new chain of pages of a type. Vector indexes
+// keep their centroids on such a chain of index pages.
+func (tx *Tx) writeChain(pageType PageType, tableID uint32, data []byte) (overflowPointer, error) {
+	if len(data) > maxValueLength {
+		return overflowPointer{}, fmt.Errorf("value of %d bytes exceeds the maximum of %d", len(data), maxValueLength)
+	}
+
+	capacity := tx.db.pageSize - pageHeaderSize
+	pages := make([]*Page, (len(data)+capacity-1)/capacity)
+	for i := range pages {
+		page, err := tx.newPage()
+		if err != nil {
+			return overflowPointer{}, fmt.Errorf("failed to allocate overflow page: %w", err)
+		}
+		pages[i] = page
+	}
+
+	for i, page := range pages {
+		part := data[i*capacity : min((i+1)*capacity, len(data))]
+		page.Data[0] = byte(pageType)
+		binary.LittleEndian.PutUint32(page.Data[1:5], tableID)
+		if i+1 < len(pages) {
+			binary.LittleEndian.PutUint64(page.Data[7:15], pages[i+1].ID)
+		}
+		binary.LittleEndian.PutUint16(page.Data[15:17], uint16(pageHeaderSize+len(part)))
+		copy(page.Data[pageHeaderSize:], part)
+
+		if err := tx.writePage(page); err != nil {
+			return overflowPointer{}, err
+		}
+	}
+
+	return overflowPointer{length: uint32(len(data)), pageID: pages[0].ID}, nil
+}
+
+// walkOverflow calls fn with every page of an overflow chain and the part of
+// the value it holds. The chain must hold exactly the length of the value.
+func walkOverflow(src pageReader, ptr overflowPointer, fn func(pageID uint64, part []byte)) error {
+	return walkChain(src, PTOverflow, ptr, fn)
+}
+
+// walkChain walks a chain of pages of a type written by writeChain
+func walkChain(src pageReader, pageType PageType, ptr overflowPointer, fn func(pageID uint64, part []byte)) error {
+	remaining := int(ptr.length)
+	pageID := ptr.pageID
+	for remaining > 0 {
+		if pageID == 0 {
+			return fmt.Errorf("chain ends %d bytes short of its value", remaining)
+		}
+		page, err := src.readPage(pageID)
+		if err != nil {
+			return fmt.Errorf("failed to read overflow page %d: %w", pageID, err)
+		}
+
+		// Every page holds part of the value, which bounds the chain
+		freeOffset := int(binary.LittleEndian.Uint16(page.Data[15:17]))
+		valid := PageType(page.Data[0]) == pageType && freeOffset > pageHeaderSize &&
+			freeOffset <= len(page.Data) && freeOffset-pageHeaderSize <= remaining
+		if valid {
+			fn(pageID, page.Data[pageHeaderSize:freeOffset])
+			remaining -= freeOffset - pageHeaderSize
+		}
+		next := binary.LittleEndian.Uint64(page.Data[7:15])
+		src.unpinPage(page)
+		if !valid {
+			return fmt.Errorf("page %d does not continue an overflow chain", pageID)
+		}
+		pageID = next
+	}
+	if pageID != 0 {
+		return fmt.Errorf("overflow chain continues past its value on page %d", pageID)
+	}
+	return nil
+}
+
+// loadOverflow reads the values of a row that are stored out of line
+func (db *Database) loadOverflow(src pageReader, table *Table, row *Row) error {
+	for _, col := range table.Columns {
+		ptr, ok := row.Values[col.Name].(overflowPointer)
+		if !ok {
+			continue
+		}
+
+		data := make([]byte, 0, ptr.length)
+		err := walkOverflow(src, ptr, func(_ uint64, part []byte) {
+			data = append(data, part...)
+		})
+		if err != nil {
+			return fmt.Errorf("column %s: %w", col.Name, err)
+		}
+		if row.Values[col.Name], err = varlenValue(col, data); err != nil {
+			return fmt.Errorf("column %s: %w", col.Name, err)
+		}
+	}
+	return nil
+}
+
+// freeOverflow frees the overflow chains a row version points at, including
+// those of columns dropped since it was written
+func (tx *Tx) freeOverflow(table *Table, payload []byte) error {
+	_, layout, values, err := decodeRow(payload, table)
+	if err != nil {
+		return err
+	}
+
+	for i, col := range layout {
+		ptr, ok := values[i].(overflowPointer)
+		if !ok {
+			continue
+		}
+
+		var pageIDs []uint64
+		err := walkOverflow(tx, ptr, func(pageID uint64, _ []byte) {
+			pageIDs = append(pageIDs, pageID)
+		})
+		if err != nil {
+			return fmt.Errorf("column %s: %w", col.Name, err)
+		}
+		for _, pageID := range pageIDs {
+			if err := tx.freePage(pageID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package storageengine
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestOverflow tests values that are too large to be stored in their row
+func TestOverflow(t *testing.T) {
+	dbPath := "overflow_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "title", Type: Tstring, NotNull: true},
+		{Name: "body", Type: Tstring, NotNull: false},
+	}
+	if err := db.CreateTable("docs", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// text returns a string of n bytes that differs along its length
+	text := func(n int, seed int) string {
+		var b strings.Builder
+		for i := 0; b.Len() < n; i++ {
+			fmt.Fprintf(&b, "%d:%d ", seed, i)
+		}
+		return b.String()[:n]
+	}
+
+	bodies := map[int64]string{
+		1: "short",
+		2: text(2000, 2),    // above the threshold, out of line on one page
+		3: text(100_000, 3), // a chain of many pages
+		4: text(70_000, 4),  // longer than a 16-bit length
+	}
+	for id := int64(1); id <= 4; id++ {
+		err := db.Insert("docs", map[string]interface{}{
+			"id":    id,
+			"title": fmt.Sprintf("doc %d", id),
+			"body":  bodies[id],
+		})
+		if err != nil {
+			t.Fatalf("Failed to insert doc %d: %v", id, err)
+		}
+	}
+
+	checkBodies := func(t *testing.T) {
+		t.Helper()
+		for id, body := range bodies {
+			row, err := db.SelectByPK("docs", id)
+			if err != nil {
+				t.Fatalf("Failed to select doc %d: %v", id, err)
+			}
+			if got := row.Values["body"].(string); got != body {
+				t.Fatalf("Expected doc %d to have a body of %d bytes, got %d bytes", id, len(body), len(got))
+			}
+		}
+	}
+
+	checkOK := func(t *testing.T) {
+		t.Helper()
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Failed to check database: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("Expected no problems, got %v", report.Problems)
+		}
+	}
+
+	// Test: large values are read back whole
+	t.Run("Read", func(t *testing.T) {
+		checkBodies(t)
+
+		rows, err := db.SelectWhere("docs", "body", "=", bodies[3])
+		if err != nil {
+			t.Fatalf("Failed to select by body: %v", err)
+		}
+		if len(rows) != 1 || rows[0].Values["id"] != int64(3) {
+			t.Fatalf("Expected doc 3, got %v", rows)
+		}
+		checkOK(t)
+	})
+
+	// Test: several medium values that only fit together once some move out of line
+	t.Run("Wide", func(t *testing.T) {
+		var wide []Column
+		values := make(map[string]interface{})
+		for i := 0; i < 6; i++ {
+			name := fmt.Sprintf("part%d", i)
+			wide = append(wide, Column{Name: name, Type: Tstring})
+			values[name] = text(900, i)
+		}
+		if err := db.CreateTable("wide", wide, ""); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+		if err := db.Insert("wide", values); err != nil {
+			t.Fatalf("Failed to insert wide row: %v", err)
+		}
+		rows, err := db.SelectAll("wide")
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		for name, val := range values {
+			if rows[0].Values[name] != val {
+				t.Fatalf("Expected column %s to be read back unchanged", name)
+			}
+		}
+		checkOK(t)
+	})
+
+	// Test: a row of fixed size values that cannot fit is refused
+	t.Run("TooLarge", func(t *testing.T) {
+		var many []Column
+		values := make(map[string]interface{})
+		for i := 0; i < 600; i++ {
+			name := fmt.Sprintf("n%d", i)
+			many = append(many, Column{Name: name, Type: TInteger})
+			values[name] = int64(i)
+		}
+		if err := db.CreateTable("many", many, ""); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+		if err := db.Insert("many", values); err == nil {
+			t.Fatal("Expected an error for a row larger than a page")
+		}
+	})
+
+	// Test: the pruner frees the chains of removed versions for reuse, and
+	// updates write new ones
+	t.Run("Prune", func(t *testing.T) {
+		// Docs 3 and 4 are the last records on their page, so the pruner removes them
+		if _, err := db.Delete("docs", func(row *Row) bool {
+			return row.Values["id"].(int64) >= 3
+		}); err != nil {
+			t.Fatalf("Failed to delete docs: %v", err)
+		}
+		delete(bodies, 3)
+		delete(bodies, 4)
+		if err := db.pruneVersions(); err != nil {
+			t.Fatalf("Failed to prune: %v", err)
+		}
+		// An overflow page the pruner forgot would show up as unused
+		checkOK(t)
+
+		nextPageID := func() uint64 {
+			db.mu.RLock()
+			defer db.mu.RUnlock()
+			return db.nextPageID
+		}
+		before := nextPageID()
+		bodies[5] = text(100_000, 5)
+		if err := db.Insert("docs", map[string]interface{}{"id": int64(5), "title": "doc 5", "body": bodies[5]}); err != nil {
+			t.Fatalf("Failed to insert doc 5: %v", err)
+		}
+		if nextPageID() != before {
+			t.Fatalf("Expected the freed overflow pages to be reused, file grew by %d pages", nextPageID()-before)
+		}
+
+		bodies[2] = text(3000, 20)
+		if _, err := db.Update("docs", func(row *Row) bool {
+			return row.Values["id"] == int64(2)
+		}, map[string]interface{}{"body": bodies[2]}); err != nil {
+			t.Fatalf("Failed to update doc 2: %v", err)
+		}
+		checkBodies(t)
+		checkOK(t)
+	})
+
+	// Test: large values survive a restart
+	t.Run("Reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+		checkBodies(t)
+		checkOK(t)
+	})
+
+	db.Close()
+}
@@ -1,55 +1,126 @@
 package storageengine
 
 import (
-	"encoding/binary"
+	"bytes"
+	"cmp"
 	"fmt"
-
-	"github.com/google/btree"
+	"math"
+	"time"
 )
 
 func (db *Database) Select(tableName string, condition func(row *Row) bool) ([]*Row, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+	// Read from a snapshot so writers can keep committing during the scan
+	snap := db.acquireSnapshot()
+	defer db.releaseSnapshot(snap)
+
+	return db.selectRows(snap, tableName, condition)
+}
+
+// Select returns the rows matching condition, including the transaction's own changes
+func (tx *Tx) Select(tableName string, condition func(row *Row) bool) ([]*Row, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.db.selectRows(tx, tableName, condition)
+}
 
-	table, exists := db.tables[tableName]
+// selectRows returns the rows of a table visible to src that match condition
+func (db *Database) selectRows(src rowSource, tableName string, condition func(row *Row) bool) ([]*Row, error) {
+	table, exists := src.table(tableName)
 	if !exists {
 		return nil, fmt.Errorf("table not found: %s", tableName)
 	}
 
+	return db.scanRows(src, table, condition)
+}
+
+// scanRows reads every row of a table visible to src and keeps the ones matching condition
+func (db *Database) scanRows(src rowSource, table *Table, condition func(row *Row) bool) ([]*Row, error) {
 	var result []*Row
 
-	index := db.rowIndices[tableName]
-	if index == nil {
-		return nil, fmt.Errorf("index not found for table: %s", tableName)
+	err := db.scanRowIndex(src, table, 0, math.MaxUint64, func(rowIndex *RowIndex, row *Row) bool {
+		if condition == nil || condition(row) {
+			result = append(result, row)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	index.Ascend(func(item btree.Item) bool {
-		rowIndex := item.(*RowIndex)
+	return result, nil
+}
 
-		page, err := db.readPage(rowIndex.Ptr.PageID)
+// scanRowIndex calls fn for every row with an ID from fromID to toID, both
+// inclusive, with the version of the row visible to src. Returning false from
+// fn stops the scan.
+func (db *Database) scanRowIndex(src rowSource, table *Table, fromID, toID uint64, fn func(rowIndex *RowIndex, row *Row) bool) error {
+	var scanErr error
+
+	err := bpScan(src, table.RowIndexRoot, rowKey(fromID), prefixEnd(rowKey(toID)), func(key []byte, value uint64) bool {
+		rowIndex, row, err := db.readRow(src, table, rowKeyID(key), unpackRowPtr(value))
 		if err != nil {
+			scanErr = err
+			return false
+		}
+		if row == nil {
 			return true
 		}
+		return fn(rowIndex, row)
+	})
+	if err != nil {
+		return err
+	}
 
-		rowSize := binary.LittleEndian.Uint16(page.Data[rowIndex.Ptr.Offset : rowIndex.Ptr.Offset+2])
-
-		rowData := page.Data[rowIndex.Ptr.Offset+2 : rowIndex.Ptr.Offset+2+rowSize]
+	return scanErr
+}
 
-		row, err := db.deserializeRow(rowData, table)
+// readRow follows the version chain of a row from its newest version to the
+// one visible to src. It returns nil if src sees no version of the row.
+func (db *Database) readRow(src rowSource, table *Table, rowID uint64, ptr RowPtr) (*RowIndex, *Row, error) {
+	for {
+		page, err := src.readPage(ptr.PageID)
 		if err != nil {
-			return true
+			return nil, nil, err
 		}
 
-		row.RowID = rowIndex.RowID
+		record, err := readSlot(page, ptr.Slot)
+		if err != nil {
+			src.unpinPage(page)
+			return nil, nil, err
+		}
+		if record.rowID != rowID {
+			// A pruned version's slot was reused, nobody can see this row anymore
+			src.unpinPage(page)
+			return nil, nil, nil
+		}
 
-		if condition == nil || condition(row) {
-			result = append(result, row)
+		if !src.visible(record.xmin, 0) {
+			src.unpinPage(page)
+			// Written after src was taken, an older version may still be visible
+			if record.prev == 0 {
+				return nil, nil, nil
+			}
+			ptr = unpackRowPtr(record.prev)
+			continue
+		}
+		if !src.visible(record.xmin, record.xmax) {
+			src.unpinPage(page)
+			return nil, nil, nil // Deleted
 		}
 
-		return true
-	})
+		row, err := db.deserializeRow(record.payload, table)
+		src.unpinPage(page)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := db.loadOverflow(src, table, row); err != nil {
+			return nil, nil, err
+		}
 
-	return result, nil
+		row.RowID = rowID
+		return &RowIndex{TableID: table.ID, RowID: rowID, Ptr: ptr}, row, nil
+	}
 }
 
 func (db *Database) SelectAll(tableName string) ([]*Row, error) {
@@ -57,47 +128,238 @@ func (db *Database) SelectAll(tableName string) ([]*Row, error) {
 }
 
 func (db *Database) SelectByID(tableName string, id uint64) (*Row, error) {
-	rows, err := db.Select(tableName, func(row *Row) bool {
-		return row.RowID == id
-	})
+	snap := db.acquireSnapshot()
+	defer db.releaseSnapshot(snap)
+
+	return db.selectByID(snap, tableName, id)
+}
+
+// SelectByID looks up a row by ID, including the transaction's own changes
+func (tx *Tx) SelectByID(tableName string, id uint64) (*Row, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.db.selectByID(tx, tableName, id)
+}
+
+// selectByID reads a single row through the row index
+func (db *Database) selectByID(src rowSource, tableName string, id uint64) (*Row, error) {
+	table, exists := src.table(tableName)
+	if !exists {
+		return nil, fmt.Errorf("table not found: %s", tableName)
+	}
+
+	_, row, err := db.lookupRow(src, table, id)
 	if err != nil {
 		return nil, err
 	}
-	if len(rows) == 0 {
+	if row == nil {
 		return nil, fmt.Errorf("row not found with ID: %d", id)
 	}
-	return rows[0], nil
+	return row, nil
+}
+
+// lookupRow reads a row through the row index. It returns nil if src sees no such row.
+func (db *Database) lookupRow(src rowSource, table *Table, id uint64) (*RowIndex, *Row, error) {
+	var rowIndex *RowIndex
+	var row *Row
+
+	err := db.scanRowIndex(src, table, id, id, func(ri *RowIndex, r *Row) bool {
+		rowIndex, row = ri, r
+		return false
+	})
+	return rowIndex, row, err
+}
+
+// SelectRange returns the rows with IDs from fromID to toID, both inclusive
+func (db *Database) SelectRange(tableName string, fromID, toID uint64) ([]*Row, error) {
+	snap := db.acquireSnapshot()
+	defer db.releaseSnapshot(snap)
+
+	return db.selectRange(snap, tableName, fromID, toID)
+}
+
+// SelectRange returns the rows with IDs from fromID to toID, both inclusive,
+// including the transaction's own changes
+func (tx *Tx) SelectRange(tableName string, fromID, toID uint64) ([]*Row, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.db.selectRange(tx, tableName, fromID, toID)
+}
+
+// selectRange reads only the part of the row index between two IDs
+func (db *Database) selectRange(src rowSource, tableName string, fromID, toID uint64) ([]*Row, error) {
+	table, exists := src.table(tableName)
+	if !exists {
+		return nil, fmt.Errorf("table not found: %s", tableName)
+	}
+
+	var result []*Row
+	err := db.scanRowIndex(src, table, fromID, toID, func(rowIndex *RowIndex, row *Row) bool {
+		result = append(result, row)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
 
 func (db *Database) SelectWhere(tableName string, columnName string, op string, value interface{}) ([]*Row, error) {
+	snap := db.acquireSnapshot()
+	defer db.releaseSnapshot(snap)
+
+	return db.selectWhere(snap, tableName, columnName, op, value)
+}
+
+// SelectWhere returns the rows where a column compares to value with op,
+// including the transaction's own changes
+func (tx *Tx) SelectWhere(tableName string, columnName string, op string, value interface{}) ([]*Row, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.db.selectWhere(tx, tableName, columnName, op, value)
+}
+
+// selectWhere returns the rows visible to src where a column compares to value with op
+func (db *Database) selectWhere(src rowSource, tableName string, columnName string, op string, value interface{}) ([]*Row, error) {
 	// Get table schema to validate column
-	table, err := db.GetTableSchema(tableName)
+	table, exists := src.table(tableName)
+	if !exists {
+		return nil, fmt.Errorf("table not found: %s", tableName)
+	}
+
+	condition, err := whereCondition(table, columnName, op, value)
 	if err != nil {
 		return nil, err
 	}
 
-	var targetCol *Column
-	for _, col := range table.Columns {
-		if col.Name == columnName {
-			targetCol = &col
-			break
-		}
+	if rows, ok, err := db.selectWhereIndexed(src, table, columnName, op, value, condition); ok {
+		return rows, err
+	}
+
+	return db.scanRows(src, table, condition)
+}
+
+// SelectByPK looks up a row by its primary key value
+func (db *Database) SelectByPK(tableName string, value interface{}) (*Row, error) {
+	snap := db.acquireSnapshot()
+	defer db.releaseSnapshot(snap)
+
+	return db.selectByPK(snap, tableName, value)
+}
+
+// SelectByPK looks up a row by its primary key value, including the transaction's own changes
+func (tx *Tx) SelectByPK(tableName string, value interface{}) (*Row, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.db.selectByPK(tx, tableName, value)
+}
+
+// selectByPK finds a row through the primary key index instead of scanning the table
+func (db *Database) selectByPK(src rowSource, tableName string, value interface{}) (*Row, error) {
+	table, exists := src.table(tableName)
+	if !exists {
+		return nil, fmt.Errorf("table not found: %s", tableName)
+	}
+
+	index, exists := table.primaryIndex()
+	if !exists {
+		return nil, fmt.Errorf("table has no primary key: %s", tableName)
+	}
+	if value == nil {
+		return nil, fmt.Errorf("primary key column %s cannot be NULL", table.PK)
 	}
 
-	if targetCol == nil {
+	key, _, err := indexPrefix(table, index, map[string]interface{}{table.PK: value})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.indexScan(src, table, index, key, prefixEnd(key), func(row *Row) bool {
+		current, _, err := indexPrefix(table, index, row.Values)
+		return err == nil && bytes.Equal(current, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("row not found with primary key: %v", value)
+	}
+	return rows[0], nil
+}
+
+// whereCondition builds the row predicate for a column, operator and value
+func whereCondition(table *Table, columnName string, op string, value interface{}) (func(row *Row) bool, error) {
+	targetCol, path, exists := table.columnPath(columnName)
+	if !exists {
 		return nil, fmt.Errorf("column not found: %s", columnName)
 	}
+	if isPatternOp(op) {
+		return patternCondition(targetCol, path, op, value)
+	}
+	if path != nil {
+		return jsonPathCondition(targetCol, path, op, value)
+	}
+	if targetCol.Type == TJSON && op != "=" && op != "==" && op != "!=" && op != "<>" {
+		return nil, fmt.Errorf("JSON column %s can only be compared for equality, compare a path into it instead", columnName)
+	}
+	if op == "CONTAINS" || op == "ANY" {
+		if targetCol.Type != TArray {
+			return nil, fmt.Errorf("%s operator requires an array column", op)
+		}
+		return arrayCondition(targetCol, op, value)
+	}
+	if targetCol.Type == TArray && op != "=" && op != "==" && op != "!=" && op != "<>" {
+		return nil, fmt.Errorf("array column %s can only be compared for equality or with CONTAINS and ANY", columnName)
+	}
+	if targetCol.Type == TVector {
+		return nil, fmt.Errorf("vector column %s cannot be compared, search it with NearestNeighbors", columnName)
+	}
 
-	if err := validateValueType(value, targetCol.Type); err != nil {
+	// Compare against the value as the column's values are read back
+	value, err := normalizeValue(*targetCol, value)
+	if err != nil {
 		return nil, fmt.Errorf("invalid value for column %s: %w", columnName, err)
 	}
 
+	return compareCondition(op, value, func(row *Row) (interface{}, bool) {
+		rowVal, exists := row.Values[columnName]
+		return rowVal, exists
+	})
+}
+
+// jsonPathCondition builds the row predicate for a path into a JSON column.
+// Rows where the path is missing, null or holds a value of another kind than
+// value never match.
+func jsonPathCondition(col *Column, path []string, op string, value interface{}) (func(row *Row) bool, error) {
+	value, err := jsonScalar(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for column %s: %w", col.Name, err)
+	}
+
+	return compareCondition(op, value, func(row *Row) (interface{}, bool) {
+		doc, ok := row.Values[col.Name].(JSON)
+		if !ok {
+			return nil, false
+		}
+		rowVal, ok := doc.Path(path...)
+		return rowVal, ok && jsonKind(rowVal) != jsonNull && jsonKind(rowVal) == jsonKind(value)
+	})
+}
+
+// compareCondition builds the row predicate comparing the value get returns
+// for a row to value with op. Rows get has no value for never match.
+func compareCondition(op string, value interface{}, get func(row *Row) (interface{}, bool)) (func(row *Row) bool, error) {
 	var condition func(row *Row) bool
 
 	switch op {
 	case "=", "==":
 		condition = func(row *Row) bool {
-			rowVal, exists := row.Values[columnName]
+			rowVal, exists := get(row)
 			if !exists {
 				return false
 			}
@@ -105,7 +367,7 @@ func (db *Database) SelectWhere(tableName string, columnName string, op string,
 		}
 	case ">":
 		condition = func(row *Row) bool {
-			rowVal, exists := row.Values[columnName]
+			rowVal, exists := get(row)
 			if !exists {
 				return false
 			}
@@ -113,7 +375,7 @@ func (db *Database) SelectWhere(tableName string, columnName string, op string,
 		}
 	case ">=":
 		condition = func(row *Row) bool {
-			rowVal, exists := row.Values[columnName]
+			rowVal, exists := get(row)
 			if !exists {
 				return false
 			}
@@ -121,7 +383,7 @@ func (db *Database) SelectWhere(tableName string, columnName string, op string,
 		}
 	case "<":
 		condition = func(row *Row) bool {
-			rowVal, exists := row.Values[columnName]
+			rowVal, exists := get(row)
 			if !exists {
 				return false
 			}
@@ -129,7 +391,7 @@ func (db *Database) SelectWhere(tableName string, columnName string, op string,
 		}
 	case "<=":
 		condition = func(row *Row) bool {
-			rowVal, exists := row.Values[columnName]
+			rowVal, exists := get(row)
 			if !exists {
 				return false
 			}
@@ -137,36 +399,17 @@ func (db *Database) SelectWhere(tableName string, columnName string, op string,
 		}
 	case "!=", "<>":
 		condition = func(row *Row) bool {
-			rowVal, exists := row.Values[columnName]
+			rowVal, exists := get(row)
 			if !exists {
 				return false
 			}
 			return compareValues(rowVal, value) != 0
 		}
-	case "LIKE":
-		strValue, ok := value.(string)
-		if !ok {
-			return nil, fmt.Errorf("LIKE operator requires string value")
-		}
-
-		condition = func(row *Row) bool {
-			rowVal, exists := row.Values[columnName]
-			if !exists {
-				return false
-			}
-
-			rowStr, ok := rowVal.(string)
-			if !ok {
-				return false
-			}
-
-			return matchLike(rowStr, strValue)
-		}
 	default:
 		return nil, fmt.Errorf("unsupported operator: %s", op)
 	}
 
-	return db.Select(tableName, condition)
+	return condition, nil
 }
 
 // compareValues compares two values of potentially different types
@@ -238,49 +481,39 @@ func compareValues(a, b interface{}) int {
 		}
 	}
 
-	return 0
-}
-
-// matchLike performs a simple LIKE comparison with % wildcards
-func matchLike(str, pattern string) bool {
-	// TODO: Implement a more robust LIKE matching
-
-	// Case: pattern is just %
-	if pattern == "%" {
-		return true
-	}
-
-	// Case: pattern starts with %
-	if len(pattern) > 0 && pattern[0] == '%' {
-		if len(pattern) == 1 {
-			return true
+	switch a := a.(type) {
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return a.Compare(b)
 		}
-
-		suffix := pattern[1:]
-		// Check if string ends with suffix
-		if len(suffix) > 0 && suffix[len(suffix)-1] == '%' {
-			// Pattern is %...%
-			middle := suffix[:len(suffix)-1]
-			return len(middle) > 0 && contains(str, middle)
+	case []byte:
+		if b, ok := b.([]byte); ok {
+			return bytes.Compare(a, b)
 		}
-
-		return len(str) >= len(suffix) && str[len(str)-len(suffix):] == suffix
-	}
-
-	// Case: pattern ends with %
-	if len(pattern) > 0 && pattern[len(pattern)-1] == '%' {
-		prefix := pattern[:len(pattern)-1]
-		return len(str) >= len(prefix) && str[:len(prefix)] == prefix
-	}
-
-	return str == pattern
-}
-
-func contains(str, substr string) bool {
-	for i := 0; i <= len(str)-len(substr); i++ {
-		if str[i:i+len(substr)] == substr {
-			return true
+	case Decimal:
+		if b, ok := b.(Decimal); ok {
+			return a.Cmp(b)
+		}
+	case UUID:
+		if b, ok := b.(UUID); ok {
+			return bytes.Compare(a[:], b[:])
+		}
+	case JSON:
+		// Equal documents have equal encodings, the order means nothing
+		if b, ok := b.(JSON); ok {
+			return bytes.Compare(a.data, b.data)
+		}
+	case []interface{}:
+		// Arrays compare element by element, then by length
+		if b, ok := b.([]interface{}); ok {
+			for i := 0; i < len(a) && i < len(b); i++ {
+				if c := compareValues(a[i], b[i]); c != 0 {
+					return c
+				}
+			}
+			return cmp.Compare(len(a), len(b))
 		}
 	}
-	return false
+
+	return 0
 }
@@ -254,3 +254,76 @@ func TestQueryPerformance(t *testing.T) {
 		}
 	})
 }
+
+// TestSelectByIDAndRange tests point and range lookups through the row index
+func TestSelectByIDAndRange(t *testing.T) {
+	dbPath := "range_test.db"
+	defer os.Remove(dbPath)
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	columns := []Column{
+		{Name: "value", Type: TInteger, NotNull: true},
+	}
+	if err := db.CreateTable("numbers", columns, ""); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	tx := db.Begin()
+	for i := 1; i <= 1000; i++ {
+		if err := tx.Insert("numbers", map[string]interface{}{"value": int64(i * 10)}); err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	if err := db.DeleteByID("numbers", 15); err != nil {
+		t.Fatalf("Failed to delete row: %v", err)
+	}
+
+	// Test: point lookup
+	t.Run("SelectByID", func(t *testing.T) {
+		row, err := db.SelectByID("numbers", 777)
+		if err != nil {
+			t.Fatalf("Failed to select by ID: %v", err)
+		}
+		if row.RowID != 777 || row.Values["value"] != int64(7770) {
+			t.Fatalf("Unexpected row %d: %v", row.RowID, row.Values)
+		}
+
+		if _, err := db.SelectByID("numbers", 15); err == nil {
+			t.Fatal("Expected deleted row to be missing")
+		}
+		if _, err := db.SelectByID("numbers", 1001); err == nil {
+			t.Fatal("Expected row past the last ID to be missing")
+		}
+	})
+
+	// Test: inclusive range lookup skipping deleted rows
+	t.Run("SelectRange", func(t *testing.T) {
+		rows, err := db.SelectRange("numbers", 10, 20)
+		if err != nil {
+			t.Fatalf("Failed to select range: %v", err)
+		}
+		if len(rows) != 10 {
+			t.Fatalf("Expected 10 rows, got %d", len(rows))
+		}
+		if rows[0].RowID != 10 || rows[len(rows)-1].RowID != 20 {
+			t.Fatalf("Expected rows 10 to 20, got %d to %d", rows[0].RowID, rows[len(rows)-1].RowID)
+		}
+
+		rows, err = db.SelectRange("numbers", 995, ^uint64(0))
+		if err != nil {
+			t.Fatalf("Failed to select range: %v", err)
+		}
+		if len(rows) != 6 {
+			t.Fatalf("Expected 6 rows, got %d", len(rows))
+		}
+	})
+}
@@ -4,60 +4,302 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"time"
 )
 
+// Insert inserts a row into a table in a transaction of its own
 func (db *Database) Insert(tableName string, values map[string]interface{}) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	return db.autocommit(func(tx *Tx) error {
+		return tx.Insert(tableName, values)
+	})
+}
+
+// Insert inserts a row into a table as part of the transaction
+func (tx *Tx) Insert(tableName string, values map[string]interface{}) error {
+	if tx.done {
+		return ErrTxDone
+	}
 
 	// Find table
-	table, exists := db.tables[tableName]
+	table, exists := tx.tables[tableName]
 	if !exists {
 		return fmt.Errorf("table not found: %s", tableName)
 	}
 
 	// Validate values against schema
-	if err := db.validateRowData(table, values); err != nil {
+	values = withDefaults(table, values)
+	if err := tx.db.validateRowData(table, values); err != nil {
+		return err
+	}
+
+	if err := tx.checkUnique(table, values, 0); err != nil {
 		return err
 	}
 
-	rowID := uint64(db.rowIndices[tableName].Len() + 1)
+	// Row IDs are never reused, the high-water mark is kept in the table page
+	rowID := table.NextRowID
+	table.NextRowID++
 
-	row := &Row{
+	if err := tx.writeRowVersion(table, &Row{
 		Values: values,
 		RowID:  rowID,
+	}, RowPtr{}); err != nil {
+		return err
+	}
+
+	return tx.indexRow(table, nil, values, rowID)
+}
+
+// Update sets columns on every row matching condition in a transaction of its own.
+// It returns the number of rows updated.
+func (db *Database) Update(tableName string, condition func(row *Row) bool, set map[string]interface{}) (int, error) {
+	var updated int
+	err := db.autocommit(func(tx *Tx) error {
+		var err error
+		updated, err = tx.Update(tableName, condition, set)
+		return err
+	})
+	return updated, err
+}
+
+// UpdateByID sets columns on a single row in a transaction of its own
+func (db *Database) UpdateByID(tableName string, id uint64, set map[string]interface{}) error {
+	return db.autocommit(func(tx *Tx) error {
+		return tx.UpdateByID(tableName, id, set)
+	})
+}
+
+// Delete removes every row matching condition in a transaction of its own.
+// It returns the number of rows deleted.
+func (db *Database) Delete(tableName string, condition func(row *Row) bool) (int, error) {
+	var deleted int
+	err := db.autocommit(func(tx *Tx) error {
+		var err error
+		deleted, err = tx.Delete(tableName, condition)
+		return err
+	})
+	return deleted, err
+}
+
+// DeleteByID removes a single row in a transaction of its own
+func (db *Database) DeleteByID(tableName string, id uint64) error {
+	return db.autocommit(func(tx *Tx) error {
+		return tx.DeleteByID(tableName, id)
+	})
+}
+
+// Update sets columns on every row matching condition as part of the transaction.
+//
+// Rows are never rewritten in place: the current version is marked deleted and
+// the updated row is written as a new version, so a row may grow past the space
+// it had and readers with older snapshots keep seeing the old values.
+func (tx *Tx) Update(tableName string, condition func(row *Row) bool, set map[string]interface{}) (int, error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+
+	table, exists := tx.tables[tableName]
+	if !exists {
+		return 0, fmt.Errorf("table not found: %s", tableName)
+	}
+
+	matches, err := tx.matchRows(table, condition)
+	if err != nil {
+		return 0, err
 	}
 
+	for _, match := range matches {
+		if err := tx.updateRow(table, match, set); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(matches), nil
+}
+
+// UpdateByID sets columns on a single row as part of the transaction
+func (tx *Tx) UpdateByID(tableName string, id uint64, set map[string]interface{}) error {
+	table, match, err := tx.matchRowByID(tableName, id)
+	if err != nil {
+		return err
+	}
+	return tx.updateRow(table, match, set)
+}
+
+// Delete removes every row matching condition as part of the transaction
+func (tx *Tx) Delete(tableName string, condition func(row *Row) bool) (int, error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+
+	table, exists := tx.tables[tableName]
+	if !exists {
+		return 0, fmt.Errorf("table not found: %s", tableName)
+	}
+
+	matches, err := tx.matchRows(table, condition)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, match := range matches {
+		if err := tx.deleteRow(table, match); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(matches), nil
+}
+
+// DeleteByID removes a single row as part of the transaction
+func (tx *Tx) DeleteByID(tableName string, id uint64) error {
+	table, match, err := tx.matchRowByID(tableName, id)
+	if err != nil {
+		return err
+	}
+	return tx.deleteRow(table, match)
+}
+
+// rowMatch is a row found by a scan together with its index entry
+type rowMatch struct {
+	row   *Row
+	index *RowIndex
+}
+
+// matchRows collects the visible rows matching condition before any of them is changed
+func (tx *Tx) matchRows(table *Table, condition func(row *Row) bool) ([]rowMatch, error) {
+	var matches []rowMatch
+
+	err := tx.db.scanRowIndex(tx, table, 0, math.MaxUint64, func(rowIndex *RowIndex, row *Row) bool {
+		if condition == nil || condition(row) {
+			matches = append(matches, rowMatch{row: row, index: rowIndex})
+		}
+		return true
+	})
+
+	return matches, err
+}
+
+// matchRowByID finds a single visible row through the row index
+func (tx *Tx) matchRowByID(tableName string, id uint64) (*Table, rowMatch, error) {
+	if tx.done {
+		return nil, rowMatch{}, ErrTxDone
+	}
+
+	table, exists := tx.tables[tableName]
+	if !exists {
+		return nil, rowMatch{}, fmt.Errorf("table not found: %s", tableName)
+	}
+
+	rowIndex, row, err := tx.db.lookupRow(tx, table, id)
+	if err != nil {
+		return nil, rowMatch{}, err
+	}
+	if row == nil {
+		return nil, rowMatch{}, fmt.Errorf("row not found with ID: %d", id)
+	}
+
+	return table, rowMatch{row: row, index: rowIndex}, nil
+}
+
+// updateRow replaces a row with a new version carrying the updated values
+func (tx *Tx) updateRow(table *Table, match rowMatch, set map[string]interface{}) error {
+	values := make(map[string]interface{}, len(match.row.Values)+len(set))
+	for name, val := range match.row.Values {
+		values[name] = val
+	}
+	for name, val := range set {
+		values[name] = val
+	}
+
+	if err := tx.db.validateRowData(table, values); err != nil {
+		return err
+	}
+
+	rowID := match.index.RowID
+	if err := tx.checkUnique(table, values, rowID); err != nil {
+		return err
+	}
+
+	if err := tx.deleteRowVersion(match.index.Ptr); err != nil {
+		return err
+	}
+
+	// Link the new version to the old one for readers that cannot see it yet
+	if err := tx.writeRowVersion(table, &Row{
+		Values: values,
+		RowID:  rowID,
+	}, match.index.Ptr); err != nil {
+		return err
+	}
+
+	return tx.indexRow(table, match.row.Values, values, rowID)
+}
+
+// deleteRow marks the current version of a row deleted. The row index keeps
+// pointing at it until the pruner removes the row for good.
+func (tx *Tx) deleteRow(table *Table, match rowMatch) error {
+	if err := tx.deleteRowVersion(match.index.Ptr); err != nil {
+		return err
+	}
+	return tx.indexRow(table, match.row.Values, nil, match.index.RowID)
+}
+
+// writeRowVersion stores a new version of a row, linked to the previous one at prev,
+// and points the row index at it
+func (tx *Tx) writeRowVersion(table *Table, row *Row, prev RowPtr) error {
 	// Find or create a page for this row
-	pageID, rowOffset, err := db.findPageForRow(table, row)
+	pageID, slot, err := tx.findPageForRow(table, row, prev)
 	if err != nil {
 		return err
 	}
 
 	rowPtr := RowPtr{
 		PageID: pageID,
-		Offset: rowOffset,
+		Slot:   slot,
 	}
 
-	rowIndex := &RowIndex{
-		TableID: table.ID,
-		RowID:   rowID,
-		Ptr:     rowPtr,
+	root, err := tx.bpInsert(table.RowIndexRoot, rowKey(row.RowID), rowPtr.pack())
+	if err != nil {
+		return fmt.Errorf("failed to update row index: %w", err)
 	}
-	db.rowIndices[tableName].ReplaceOrInsert(rowIndex)
+	table.RowIndexRoot = root
 
-	return nil
+	// The row ID high-water mark, last page or index root may have moved
+	return tx.writeTablePage(table)
+}
+
+// deleteRowVersion stamps the transaction as the deleter of a row version.
+// The record stays on its page for older snapshots until the pruner reclaims it.
+func (tx *Tx) deleteRowVersion(ptr RowPtr) error {
+	page, err := tx.modifyPage(ptr.PageID)
+	if err != nil {
+		return fmt.Errorf("failed to read row page: %w", err)
+	}
+
+	if _, err := readSlot(page, ptr.Slot); err != nil {
+		return err
+	}
+	offset := slotOffset(page, ptr.Slot)
+	binary.LittleEndian.PutUint64(page.Data[offset+10:offset+18], tx.id)
+
+	tx.garbage[page.ID] = tx.id
+	return tx.writePage(page)
 }
+
 func (db *Database) validateRowData(table *Table, values map[string]interface{}) error {
 	// Check for required columns
 	for _, col := range table.Columns {
 		val, exists := values[col.Name]
-		if !exists && col.NotNull {
+		if (!exists || val == nil) && col.NotNull {
 			return fmt.Errorf("missing value for NOT NULL column: %s", col.Name)
 		}
+		if (!exists || val == nil) && col.Name == table.PK {
+			return fmt.Errorf("missing value for primary key column: %s", col.Name)
+		}
 
 		if exists {
-			if err := validateValueType(val, col.Type); err != nil {
+			if err := validateValueType(val, col); err != nil {
 				return fmt.Errorf("invalid value for column %s: %w", col.Name, err)
 			}
 		}
@@ -79,22 +321,16 @@ func (db *Database) validateRowData(table *Table, values map[string]interface{})
 	return nil
 }
 
-func validateValueType(value interface{}, colType ColumnType) error {
+func validateValueType(value interface{}, col Column) error {
 	if value == nil {
 		return nil // NULL value is valid for any column type (unless NOT NULL)
 	}
 
-	switch colType {
+	switch col.Type {
 	case TInteger:
-		switch v := value.(type) {
-		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		// Floats must hold a whole number, and nothing may overflow int64
+		if _, ok := toInt64(value); ok {
 			return nil
-		case float32, float64:
-			// Check if float is actually an integer
-			f := v.(float64)
-			if f == math.Trunc(f) {
-				return nil
-			}
 		}
 		return fmt.Errorf("expected integer value")
 
@@ -118,44 +354,94 @@ func validateValueType(value interface{}, colType ColumnType) error {
 			return nil
 		}
 		return fmt.Errorf("expected boolean value")
+
+	case TTimestamp, TDate:
+		switch value.(type) {
+		case time.Time:
+			return nil
+		}
+		return fmt.Errorf("expected time.Time value")
+
+	case TBytes:
+		switch value.(type) {
+		case []byte:
+			return nil
+		}
+		return fmt.Errorf("expected []byte value")
+
+	case TDecimal:
+		switch v := value.(type) {
+		case Decimal, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			return nil
+		case string:
+			_, err := ParseDecimal(v)
+			return err
+		}
+		return fmt.Errorf("expected decimal value")
+
+	case TUUID:
+		_, err := toUUID(value)
+		return err
+
+	case TJSON:
+		_, err := toJSON(value)
+		return err
+
+	case TArray:
+		elems, err := toArray(value)
+		if err != nil {
+			return err
+		}
+		for i, elem := range elems {
+			if elem == nil {
+				return fmt.Errorf("array element %d is NULL", i)
+			}
+			if err := validateValueType(elem, elemColumn(col)); err != nil {
+				return fmt.Errorf("array element %d: %w", i, err)
+			}
+		}
+		return nil
+
+	case TVector:
+		_, err := toVector(col, value)
+		return err
 	}
 
 	return fmt.Errorf("unknown column type")
 }
 
-func (db *Database) findPageForRow(table *Table, row *Row) (uint64, uint16, error) {
-	rowData, err := db.serializeRow(row, table)
+func (tx *Tx) findPageForRow(table *Table, row *Row, prev RowPtr) (uint64, uint16, error) {
+	values, err := tx.storeOverflow(table, row.Values)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to store large values: %w", err)
+	}
+	rowData, err := tx.db.serializeRow(&Row{Values: values}, table)
 	if err != nil {
 		return 0, 0, fmt.Errorf("failed to serialize row: %w", err)
 	}
 
 	rowSize := len(rowData)
-	neededSpace := rowSize + 2
+	if rowSize > tx.db.maxRowSize() {
+		return 0, 0, fmt.Errorf("row of %d bytes does not fit in a page of %d bytes", rowSize, tx.db.pageSize)
+	}
 
 	var lastPage *Page
 	if table.LastPageID != 0 {
-		lastPage, err = db.readPage(table.LastPageID)
+		lastPage, err = tx.modifyPage(table.LastPageID)
 		if err != nil {
 			return 0, 0, fmt.Errorf("failed to read last data page: %w", err)
 		}
 	}
 
-	if lastPage == nil || !db.hasEnoughSpace(lastPage, neededSpace) {
-		newPage := &Page{
-			ID:   db.nextPageID,
-			Data: make([]byte, db.pageSize),
+	if lastPage == nil || !canHold(lastPage, rowHeaderSize+rowSize) {
+		newPage, err := tx.newDataPage(table.ID)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to allocate data page: %w", err)
 		}
-		db.nextPageID++
-
-		newPage.Data[0] = byte(PTData)
-		binary.LittleEndian.PutUint32(newPage.Data[1:5], table.ID)
-		binary.LittleEndian.PutUint16(newPage.Data[5:7], 0)    // No rows yet
-		binary.LittleEndian.PutUint64(newPage.Data[7:15], 0)   // No next page yet
-		binary.LittleEndian.PutUint16(newPage.Data[15:17], 17) // Free offset starts after header
 
 		if lastPage != nil {
 			binary.LittleEndian.PutUint64(lastPage.Data[7:15], newPage.ID)
-			if err := db.writePage(lastPage); err != nil {
+			if err := tx.writePage(lastPage); err != nil {
 				return 0, 0, fmt.Errorf("failed to update last page: %w", err)
 			}
 		} else {
@@ -166,178 +452,176 @@ func (db *Database) findPageForRow(table *Table, row *Row) (uint64, uint16, erro
 		lastPage = newPage
 	}
 
-	return db.addRowToPage(lastPage, rowData, table)
+	return tx.addRowToPage(lastPage, row.RowID, prev, rowData)
 }
 
-func (db *Database) addRowToPage(page *Page, rowData []byte, table *Table) (uint64, uint16, error) {
-	rowCount := binary.LittleEndian.Uint16(page.Data[5:7])
-	freeOffset := binary.LittleEndian.Uint16(page.Data[15:17])
+// addRowToPage adds a new row version to a data page and returns its slot
+func (tx *Tx) addRowToPage(page *Page, rowID uint64, prev RowPtr, rowData []byte) (uint64, uint16, error) {
+	// The new version is created by this transaction and not deleted yet
+	record := make([]byte, rowHeaderSize+len(rowData))
+	binary.LittleEndian.PutUint16(record[0:2], uint16(len(rowData)))
+	binary.LittleEndian.PutUint64(record[2:10], tx.id)
+	binary.LittleEndian.PutUint64(record[10:18], 0)
+	binary.LittleEndian.PutUint64(record[18:26], rowID)
+	binary.LittleEndian.PutUint64(record[26:34], prev.pack())
+	copy(record[rowHeaderSize:], rowData)
+
+	slot := insertRecord(page, record)
+
+	// Stage page until commit
+	if err := tx.writePage(page); err != nil {
+		return 0, 0, fmt.Errorf("failed to write page: %w", err)
+	}
+
+	return page.ID, slot, nil
+}
 
-	binary.LittleEndian.PutUint16(page.Data[freeOffset:freeOffset+2], uint16(len(rowData)))
+// Row records are stored as [payload length][xmin][xmax][rowID][prev][payload]. xmin
+// is the transaction that created the row version and xmax the one that deleted it,
+// or 0 while the version is live. The row ID is stored with every version so it
+// never depends on where the record sits in the file. prev points at the version
+// this one replaced, or is 0 for the first version of a row.
+const rowHeaderSize = 34
+
+// rowRecord is a row version as stored on a data page
+type rowRecord struct {
+	xmin    uint64
+	xmax    uint64
+	rowID   uint64
+	prev    uint64 // packed RowPtr of the previous version
+	payload []byte
+}
 
-	copy(page.Data[freeOffset+2:freeOffset+2+uint16(len(rowData))], rowData)
+// size returns the number of page bytes the record takes up
+func (r rowRecord) size() uint16 {
+	return rowHeaderSize + uint16(len(r.payload))
+}
 
-	rowCount++
-	binary.LittleEndian.PutUint16(page.Data[5:7], rowCount)
+// readRowRecord returns the record at offset
+func readRowRecord(page *Page, offset uint16) (rowRecord, error) {
+	if int(offset)+rowHeaderSize > len(page.Data) {
+		return rowRecord{}, fmt.Errorf("row record at offset %d exceeds page %d", offset, page.ID)
+	}
 
-	newFreeOffset := freeOffset + 2 + uint16(len(rowData))
-	binary.LittleEndian.PutUint16(page.Data[15:17], newFreeOffset)
+	rowSize := binary.LittleEndian.Uint16(page.Data[offset : offset+2])
 
-	// Write page to disk
-	if err := db.writePage(page); err != nil {
-		return 0, 0, fmt.Errorf("failed to write page: %w", err)
+	start := int(offset) + rowHeaderSize
+	if start+int(rowSize) > len(page.Data) {
+		return rowRecord{}, fmt.Errorf("row record at offset %d exceeds page %d", offset, page.ID)
 	}
 
-	return page.ID, freeOffset, nil
+	return rowRecord{
+		xmin:    binary.LittleEndian.Uint64(page.Data[offset+2 : offset+10]),
+		xmax:    binary.LittleEndian.Uint64(page.Data[offset+10 : offset+18]),
+		rowID:   binary.LittleEndian.Uint64(page.Data[offset+18 : offset+26]),
+		prev:    binary.LittleEndian.Uint64(page.Data[offset+26 : offset+34]),
+		payload: page.Data[start : start+int(rowSize)],
+	}, nil
 }
 
+// A row payload starts with the schema version of the table it was written
+// with, followed by a null bitmap and the values of the columns that version
+// had, in column order:
+//
+//	[0:4] schema version
+//	[4:]  null bitmap, one bit per column, then the non-NULL values
+//
+// Rows are not rewritten when columns are added or dropped, see alter.go.
+const rowVersionSize = 4
+
+// serializeRow encodes a row with the table's current columns
 func (db *Database) serializeRow(row *Row, table *Table) ([]byte, error) {
-	nullBitmapSize := (len(table.Columns) + 7) / 8
+	values := make([]interface{}, len(table.Columns))
+	for i, col := range table.Columns {
+		values[i] = row.Values[col.Name]
+	}
+	return encodeRow(table.SchemaVersion, table.Columns, values)
+}
 
-	dataSize := 0
-	for _, col := range table.Columns {
-		val, exists := row.Values[col.Name]
-		if !exists || val == nil {
-			continue // NULL value, needs no space except in bitmap
-		}
-
-		switch col.Type {
-		case TInteger:
-			dataSize += 8 // int64
-		case Tfloat:
-			dataSize += 8 // float64
-		case Tstring:
-			str, ok := val.(string)
-			if !ok {
-				return nil, fmt.Errorf("invalid type for string column %s", col.Name)
+// deserializeRow decodes a row payload into the table's current columns. A row
+// written with an older schema leaves out the columns dropped since and gets
+// the default value of the columns added since.
+func (db *Database) deserializeRow(data []byte, table *Table) (*Row, error) {
+	version, layout, values, err := decodeRow(data, table)
+	if err != nil {
+		return nil, err
+	}
+
+	row := &Row{
+		Values: make(map[string]interface{}),
+	}
+
+	if version == table.SchemaVersion {
+		for i, col := range layout {
+			if values[i] != nil {
+				row.Values[col.Name] = values[i]
 			}
-			dataSize += 2 + len(str) // 2 bytes for length + string data
-		case Tbool:
-			dataSize += 1 // 1 byte
+		}
+		return row, nil
+	}
+
+	stored := make(map[uint32]interface{}, len(layout))
+	for i, col := range layout {
+		stored[col.id] = values[i]
+	}
+	for _, col := range table.Columns {
+		val, ok := stored[col.id]
+		if !ok {
+			val = col.Default
+		}
+		if val != nil {
+			row.Values[col.Name] = val
 		}
 	}
+	return row, nil
+}
 
-	buffer := make([]byte, nullBitmapSize+dataSize)
+// encodeRow encodes the values of a row written with a schema version, one
+// per column of its layout, nil for NULL
+func encodeRow(version uint32, layout []Column, values []interface{}) ([]byte, error) {
+	nullBitmapSize := (len(layout) + 7) / 8
 
-	for i, col := range table.Columns {
-		val, exists := row.Values[col.Name]
-		if !exists || val == nil {
+	buffer := make([]byte, rowVersionSize+nullBitmapSize, rowVersionSize+nullBitmapSize+8*len(layout))
+	binary.LittleEndian.PutUint32(buffer[0:rowVersionSize], version)
+
+	for i, col := range layout {
+		if values[i] == nil {
 			// Set bit in null bitmap (value is NULL)
 			byteIndex := i / 8
 			bitIndex := i % 8
-			buffer[byteIndex] |= (1 << bitIndex)
+			buffer[rowVersionSize+byteIndex] |= (1 << bitIndex)
+			continue
 		}
-	}
 
-	offset := nullBitmapSize
-	for _, col := range table.Columns {
-		val, exists := row.Values[col.Name]
-		if !exists || val == nil {
-			continue // Skip NULL values
-		}
-
-		switch col.Type {
-		case TInteger:
-			var v int64
-			switch val := val.(type) {
-			case int:
-				v = int64(val)
-			case int8:
-				v = int64(val)
-			case int16:
-				v = int64(val)
-			case int32:
-				v = int64(val)
-			case int64:
-				v = val
-			case uint:
-				v = int64(val)
-			case uint8:
-				v = int64(val)
-			case uint16:
-				v = int64(val)
-			case uint32:
-				v = int64(val)
-			case uint64:
-				v = int64(val)
-			case float64:
-				v = int64(val)
-			default:
-				return nil, fmt.Errorf("invalid type for integer column %s", col.Name)
-			}
-			binary.LittleEndian.PutUint64(buffer[offset:offset+8], uint64(v))
-			offset += 8
-
-		case Tfloat:
-			var v float64
-			switch val := val.(type) {
-			case float32:
-				v = float64(val)
-			case float64:
-				v = val
-			case int:
-				v = float64(val)
-			case int8:
-				v = float64(val)
-			case int16:
-				v = float64(val)
-			case int32:
-				v = float64(val)
-			case int64:
-				v = float64(val)
-			case uint:
-				v = float64(val)
-			case uint8:
-				v = float64(val)
-			case uint16:
-				v = float64(val)
-			case uint32:
-				v = float64(val)
-			case uint64:
-				v = float64(val)
-			default:
-				return nil, fmt.Errorf("invalid type for float column %s", col.Name)
-			}
-			bits := math.Float64bits(v)
-			binary.LittleEndian.PutUint64(buffer[offset:offset+8], bits)
-			offset += 8
-
-		case Tstring:
-			str, ok := val.(string)
-			if !ok {
-				return nil, fmt.Errorf("invalid type for string column %s", col.Name)
-			}
-			binary.LittleEndian.PutUint16(buffer[offset:offset+2], uint16(len(str)))
-			offset += 2
-			copy(buffer[offset:offset+len(str)], str)
-			offset += len(str)
-
-		case Tbool:
-			b, ok := val.(bool)
-			if !ok {
-				return nil, fmt.Errorf("invalid type for boolean column %s", col.Name)
-			}
-			if b {
-				buffer[offset] = 1
-			} else {
-				buffer[offset] = 0
-			}
-			offset++
+		var err error
+		if buffer, err = appendValue(buffer, col, values[i]); err != nil {
+			return nil, err
 		}
 	}
 
 	return buffer, nil
 }
 
-func (db *Database) deserializeRow(data []byte, table *Table) (*Row, error) {
-	nullBitmapSize := (len(table.Columns) + 7) / 8
+// decodeRow decodes a row payload with the layout of the schema version it
+// was written with. NULL values are nil.
+func decodeRow(data []byte, table *Table) (version uint32, layout []Column, values []interface{}, err error) {
+	if len(data) < rowVersionSize {
+		return 0, nil, nil, fmt.Errorf("row data of %d bytes is too short for its schema version", len(data))
+	}
+	version = binary.LittleEndian.Uint32(data[0:rowVersionSize])
+	if layout, err = table.layout(version); err != nil {
+		return 0, nil, nil, err
+	}
+	data = data[rowVersionSize:]
 
-	row := &Row{
-		Values: make(map[string]interface{}),
+	nullBitmapSize := (len(layout) + 7) / 8
+	if len(data) < nullBitmapSize {
+		return 0, nil, nil, fmt.Errorf("row data of %d bytes is too short for its null bitmap", len(data))
 	}
 
+	values = make([]interface{}, len(layout))
 	offset := nullBitmapSize
-	for i, col := range table.Columns {
+	for i, col := range layout {
 		byteIndex := i / 8
 		bitIndex := i % 8
 		isNull := (data[byteIndex] & (1 << bitIndex)) != 0
@@ -346,70 +630,196 @@ func (db *Database) deserializeRow(data []byte, table *Table) (*Row, error) {
 			continue // Skip NULL values
 		}
 
-		switch col.Type {
-		case TInteger:
-			val := int64(binary.LittleEndian.Uint64(data[offset : offset+8]))
-			row.Values[col.Name] = val
-			offset += 8
-		case Tfloat:
-			bits := binary.LittleEndian.Uint64(data[offset : offset+8])
-			val := math.Float64frombits(bits)
-			row.Values[col.Name] = val
-			offset += 8
-		case Tstring:
-			strLen := binary.LittleEndian.Uint16(data[offset : offset+2])
-			offset += 2
-			str := string(data[offset : offset+int(strLen)])
-			row.Values[col.Name] = str
-			offset += int(strLen)
-		case Tbool:
-			val := data[offset] != 0
-			row.Values[col.Name] = val
-			offset++
+		val, n, err := readValue(data[offset:], col)
+		if err != nil {
+			return 0, nil, nil, err
 		}
+		values[i] = val
+		offset += n
 	}
 
-	return row, nil
+	if offset != len(data) {
+		return 0, nil, nil, fmt.Errorf("row data has %d bytes left over after its values", len(data)-offset)
+	}
+	return version, layout, values, nil
 }
 
-func (db *Database) indexRowsInPage(page *Page, table *Table) error {
-	// Get header information
-	rowCount := binary.LittleEndian.Uint16(page.Data[5:7])
+// appendValue appends the encoding of a non-NULL value of a column
+func appendValue(buffer []byte, col Column, val interface{}) ([]byte, error) {
+	switch col.Type {
+	case TInteger:
+		v, ok := toInt64(val)
+		if !ok {
+			return nil, fmt.Errorf("invalid type for integer column %s", col.Name)
+		}
+		return binary.LittleEndian.AppendUint64(buffer, uint64(v)), nil
 
-	offset := uint16(17)
+	case Tfloat:
+		v, ok := toFloat64(val)
+		if !ok {
+			return nil, fmt.Errorf("invalid type for float column %s", col.Name)
+		}
+		return binary.LittleEndian.AppendUint64(buffer, math.Float64bits(v)), nil
 
-	for i := uint16(0); i < rowCount; i++ {
-		// Check if we've reached the end of data
-		if offset >= uint16(len(page.Data)) {
-			return fmt.Errorf("reached end of page data while reading row %d", i)
+	case Tstring, TBytes, TJSON, TArray, TVector:
+		if ptr, ok := val.(overflowPointer); ok {
+			buffer = binary.LittleEndian.AppendUint32(buffer, ptr.length|overflowFlag)
+			return binary.LittleEndian.AppendUint64(buffer, ptr.pageID), nil
+		}
+		data, err := varlenData(col, val)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxValueLength {
+			return nil, fmt.Errorf("value of %d bytes for column %s exceeds the maximum of %d", len(data), col.Name, maxValueLength)
 		}
+		buffer = binary.LittleEndian.AppendUint32(buffer, uint32(len(data)))
+		return append(buffer, data...), nil
 
-		// Read row size
-		if offset+2 > uint16(len(page.Data)) {
-			return fmt.Errorf("not enough data to read row size")
+	case Tbool:
+		b, ok := val.(bool)
+		if !ok {
+			return nil, fmt.Errorf("invalid type for boolean column %s", col.Name)
+		}
+		if b {
+			return append(buffer, 1), nil
 		}
-		rowSize := binary.LittleEndian.Uint16(page.Data[offset : offset+2])
+		return append(buffer, 0), nil
 
-		// Create row index
-		rowID := uint64(db.rowIndices[table.Name].Len() + 1)
+	case TTimestamp:
+		nanos, err := toTimestamp(val)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col.Name, err)
+		}
+		return binary.LittleEndian.AppendUint64(buffer, uint64(nanos)), nil
 
-		rowPtr := RowPtr{
-			PageID: page.ID,
-			Offset: offset,
+	case TDate:
+		days, err := toDate(val)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col.Name, err)
 		}
+		return binary.LittleEndian.AppendUint32(buffer, uint32(days)), nil
 
-		rowIndex := &RowIndex{
-			TableID: table.ID,
-			RowID:   rowID,
-			Ptr:     rowPtr,
+	case TDecimal:
+		coef, err := toDecimal(val, col.Scale)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col.Name, err)
 		}
+		return binary.LittleEndian.AppendUint64(buffer, uint64(coef)), nil
 
-		// Add to index
-		db.rowIndices[table.Name].ReplaceOrInsert(rowIndex)
+	case TUUID:
+		u, err := toUUID(val)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col.Name, err)
+		}
+		return append(buffer, u[:]...), nil
+	}
 
-		// Move to next row
-		offset += 2 + rowSize
+	return nil, fmt.Errorf("column %s has unknown type %d", col.Name, col.Type)
+}
+
+// readValue decodes the value of a column at the start of data and returns
+// the number of bytes it takes up
+func readValue(data []byte, col Column) (interface{}, int, error) {
+	// need fails if the next n bytes are missing, as in a damaged record
+	need := func(n int) error {
+		if n > len(data) {
+			return fmt.Errorf("row data is truncated in column %s", col.Name)
+		}
+		return nil
 	}
 
-	return nil
+	switch col.Type {
+	case TInteger:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return int64(binary.LittleEndian.Uint64(data[0:8])), 8, nil
+
+	case Tfloat:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(data[0:8])), 8, nil
+
+	case Tstring, TBytes, TJSON, TArray, TVector:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		strLen := binary.LittleEndian.Uint32(data[0:4])
+		if strLen&overflowFlag != 0 {
+			// Stored out of line, the caller loads it
+			if err := need(overflowPtrSize); err != nil {
+				return nil, 0, err
+			}
+			ptr := overflowPointer{
+				length: strLen &^ overflowFlag,
+				pageID: binary.LittleEndian.Uint64(data[4:12]),
+			}
+			return ptr, overflowPtrSize, nil
+		}
+		if err := need(4 + int(strLen)); err != nil {
+			return nil, 0, err
+		}
+		val, err := varlenValue(col, data[4:4+int(strLen)])
+		if err != nil {
+			return nil, 0, err
+		}
+		return val, 4 + int(strLen), nil
+
+	case Tbool:
+		if err := need(1); err != nil {
+			return nil, 0, err
+		}
+		return data[0] != 0, 1, nil
+
+	case TTimestamp:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return fromTimestamp(int64(binary.LittleEndian.Uint64(data[0:8]))), 8, nil
+
+	case TDate:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		return fromDate(int32(binary.LittleEndian.Uint32(data[0:4]))), 4, nil
+
+	case TDecimal:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return Decimal{Coef: int64(binary.LittleEndian.Uint64(data[0:8])), Scale: col.Scale}, 8, nil
+
+	case TUUID:
+		if err := need(16); err != nil {
+			return nil, 0, err
+		}
+		return UUID(data[0:16]), 16, nil
+	}
+
+	return nil, 0, fmt.Errorf("column %s has unknown type %d", col.Name, col.Type)
+}
+
+// rowKey encodes a row ID as a row index key
+func rowKey(rowID uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, rowID)
+}
+
+// rowKeyID decodes a row index key
+func rowKeyID(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key)
+}
+
+// pack stores a row pointer in a single row index value
+func (p RowPtr) pack() uint64 {
+	return p.PageID<<16 | uint64(p.Slot)
+}
+
+// unpackRowPtr decodes a row index value
+func unpackRowPtr(v uint64) RowPtr {
+	return RowPtr{
+		PageID: v >> 16,
+		Slot:   uint16(v),
+	}
 }
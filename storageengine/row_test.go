@@ -0,0 +1,299 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestUpdateAndDelete tests changing and removing rows, before and after reopening
+func TestUpdateAndDelete(t *testing.T) {
+	dbPath := "update_test.db"
+	defer os.Remove(dbPath)
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+		{Name: "age", Type: TInteger, NotNull: false},
+	}
+	if err := db.CreateTable("users", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		err := db.Insert("users", map[string]interface{}{
+			"id":   int64(i),
+			"name": "user",
+			"age":  int64(20 + i),
+		})
+		if err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+
+	// Test: update a set of rows, growing one past its original size
+	t.Run("Update", func(t *testing.T) {
+		updated, err := db.Update("users", func(row *Row) bool {
+			age, ok := row.Values["age"].(int64)
+			return ok && age >= 24
+		}, map[string]interface{}{"age": nil})
+		if err != nil {
+			t.Fatalf("Failed to update rows: %v", err)
+		}
+		if updated != 2 {
+			t.Fatalf("Expected 2 updated rows, got %d", updated)
+		}
+
+		long := strings.Repeat("x", 500)
+		if err := db.UpdateByID("users", 1, map[string]interface{}{"name": long}); err != nil {
+			t.Fatalf("Failed to update row by ID: %v", err)
+		}
+
+		user, err := db.SelectByID("users", 1)
+		if err != nil {
+			t.Fatalf("Failed to select row: %v", err)
+		}
+		if user.Values["name"] != long || user.Values["age"] != int64(21) {
+			t.Fatalf("Unexpected values after update: %v", user.Values)
+		}
+
+		rows, err := db.SelectWhere("users", "age", ">=", int64(24))
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		if len(rows) != 0 {
+			t.Fatalf("Expected no rows with age >= 24, got %d", len(rows))
+		}
+
+		err = db.UpdateByID("users", 2, map[string]interface{}{"name": nil})
+		if err == nil {
+			t.Fatal("Expected error when setting NOT NULL column to NULL, got nil")
+		}
+	})
+
+	// Test: delete by condition and by ID
+	t.Run("Delete", func(t *testing.T) {
+		deleted, err := db.Delete("users", func(row *Row) bool {
+			return row.Values["age"] == nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to delete rows: %v", err)
+		}
+		if deleted != 2 {
+			t.Fatalf("Expected 2 deleted rows, got %d", deleted)
+		}
+
+		if err := db.DeleteByID("users", 2); err != nil {
+			t.Fatalf("Failed to delete row by ID: %v", err)
+		}
+		if err := db.DeleteByID("users", 2); err == nil {
+			t.Fatal("Expected error when deleting a missing row, got nil")
+		}
+
+		if err := db.Insert("users", map[string]interface{}{"id": int64(6), "name": "new"}); err != nil {
+			t.Fatalf("Failed to insert after delete: %v", err)
+		}
+
+		count, err := db.GetRowCount("users")
+		if err != nil {
+			t.Fatalf("Failed to get row count: %v", err)
+		}
+		if count != 3 {
+			t.Fatalf("Expected 3 rows, got %d", count)
+		}
+	})
+
+	// Test: a rolled back delete leaves the row in place
+	t.Run("RollbackDelete", func(t *testing.T) {
+		tx := db.Begin()
+		if _, err := tx.Delete("users", nil); err != nil {
+			t.Fatalf("Failed to delete rows: %v", err)
+		}
+		rows, err := tx.Select("users", nil)
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		if len(rows) != 0 {
+			t.Fatalf("Expected transaction to see no rows, got %d", len(rows))
+		}
+		tx.Rollback()
+
+		rows, err = db.SelectAll("users")
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		if len(rows) != 3 {
+			t.Fatalf("Expected 3 rows after rollback, got %d", len(rows))
+		}
+	})
+
+	// Test: deleted rows stay deleted and updated values stay updated after reopening
+	t.Run("Reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+
+		rows, err := db.SelectAll("users")
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		if len(rows) != 3 {
+			t.Fatalf("Expected 3 rows after reopen, got %d", len(rows))
+		}
+
+		names := map[int64]interface{}{}
+		for _, row := range rows {
+			names[row.Values["id"].(int64)] = row.Values["name"]
+		}
+		if len(names[1].(string)) != 500 || names[3] != "user" || names[6] != "new" {
+			t.Fatalf("Unexpected rows after reopen: %v", names)
+		}
+	})
+
+	db.Close()
+}
+
+// TestPruneVersions tests that dead versions are reclaimed once no snapshot can see them
+func TestPruneVersions(t *testing.T) {
+	dbPath := "prune_test.db"
+	defer os.Remove(dbPath)
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+	}
+	if err := db.CreateTable("items", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for i := 1; i <= 10; i++ {
+		if err := db.Insert("items", map[string]interface{}{"id": int64(i)}); err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+
+	freeOffset := func() uint16 {
+		table, _ := db.GetTableSchema("items")
+		page, err := db.readPage(table.LastPageID)
+		if err != nil {
+			t.Fatalf("Failed to read page: %v", err)
+		}
+		defer db.unpinPage(page)
+		return binary.LittleEndian.Uint16(page.Data[15:17])
+	}
+	before := freeOffset()
+
+	// An old snapshot still sees the rows about to be deleted
+	snap := db.acquireSnapshot()
+
+	deleted, err := db.Delete("items", func(row *Row) bool {
+		return row.Values["id"].(int64) > 5
+	})
+	if err != nil || deleted != 5 {
+		t.Fatalf("Failed to delete rows: %d, %v", deleted, err)
+	}
+
+	if err := db.pruneVersions(); err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	if freeOffset() != before {
+		t.Fatal("Expected versions visible to a snapshot to be kept")
+	}
+
+	rows, err := db.scanRows(snap, snap.tables["items"], nil)
+	if err != nil {
+		t.Fatalf("Failed to scan snapshot: %v", err)
+	}
+	if len(rows) != 10 {
+		t.Fatalf("Expected old snapshot to see 10 rows, got %d", len(rows))
+	}
+	db.releaseSnapshot(snap)
+
+	if err := db.pruneVersions(); err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	if freeOffset() != before-5*(rowHeaderSize+rowVersionSize+9) {
+		t.Fatalf("Expected 5 dead records to be reclaimed, free offset went from %d to %d", before, freeOffset())
+	}
+
+	rows, err = db.SelectAll("items")
+	if err != nil {
+		t.Fatalf("Failed to select: %v", err)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("Expected 5 rows after pruning, got %d", len(rows))
+	}
+}
+
+// TestStableRowIDs tests that row IDs never shift or get reused, even across restarts
+func TestStableRowIDs(t *testing.T) {
+	dbPath := "rowid_test.db"
+	defer os.Remove(dbPath)
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	columns := []Column{
+		{Name: "code", Type: Tstring, NotNull: true},
+	}
+	if err := db.CreateTable("items", columns, ""); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for _, code := range []string{"a", "b", "c", "d"} {
+		if err := db.Insert("items", map[string]interface{}{"code": code}); err != nil {
+			t.Fatalf("Failed to insert %s: %v", code, err)
+		}
+	}
+
+	// Moving row 1 to the end of the table must not change its ID
+	if err := db.UpdateByID("items", 1, map[string]interface{}{"code": "a2"}); err != nil {
+		t.Fatalf("Failed to update row: %v", err)
+	}
+	// Deleting the newest row must not free its ID
+	if err := db.DeleteByID("items", 4); err != nil {
+		t.Fatalf("Failed to delete row: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	db, err = NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Insert("items", map[string]interface{}{"code": "e"}); err != nil {
+		t.Fatalf("Failed to insert after reopen: %v", err)
+	}
+
+	expected := map[uint64]string{1: "a2", 2: "b", 3: "c", 5: "e"}
+	rows, err := db.SelectAll("items")
+	if err != nil {
+		t.Fatalf("Failed to select: %v", err)
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("Expected %d rows, got %d", len(expected), len(rows))
+	}
+	for _, row := range rows {
+		if expected[row.RowID] != row.Values["code"] {
+			t.Fatalf("Row %d has code %v, expected %s", row.RowID, row.Values["code"], expected[row.RowID])
+		}
+	}
+}
@@ -2,38 +2,203 @@ package storageengine
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"os"
+)
+
+// DefaultPageSize is the page size of new databases when none is configured
+const DefaultPageSize = 4096
 
-	"github.com/google/btree"
+// CorruptPagePolicy decides what opening a database does when it finds a corrupt page
+type CorruptPagePolicy int
+
+const (
+	// FailOnCorruptPage makes NewDatabase return the CorruptPageError
+	FailOnCorruptPage CorruptPagePolicy = iota
+	// QuarantineCorruptPages skips corrupt pages and lists them in QuarantinedPages.
+	// A corrupt table page hides its table and the tables after it in the catalog.
+	// Pages missing from a file that was cut short count as corrupt. The meta
+	// page is always required.
+	QuarantineCorruptPages
 )
 
-// NewDatabase creates a new clustered database
+// Options configures how a database is opened
+type Options struct {
+	PageSize     int               // bytes per page of a new file, DefaultPageSize if zero; existing files keep theirs
+	CacheSize    int               // buffer pool budget in bytes, DefaultCacheSize if zero
+	CorruptPages CorruptPagePolicy // what to do about corrupt pages found while opening
+
+	// ReadOnly opens an existing file without ever writing to it, as needed to
+	// check a backup. The WAL is neither replayed nor created, so changes still
+	// in the log of a database that was not closed cleanly are not seen, and
+	// no pruner runs. Commits, vacuums and checkpoints fail with ErrReadOnly.
+	ReadOnly bool
+}
+
+// NewDatabase creates a new clustered database or opens an existing one.
+// pageSize only applies to a new file, an existing file keeps the page size
+// recorded in its meta page.
 func NewDatabase(path string, pageSize int) (*Database, error) {
+	return NewDatabaseWithOptions(path, Options{PageSize: pageSize})
+}
+
+// NewDatabaseWithOptions creates a new clustered database or opens an existing one with the given options
+func NewDatabaseWithOptions(path string, opts Options) (*Database, error) {
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = DefaultPageSize
+	}
+	cacheSize := opts.CacheSize
+	if cacheSize == 0 {
+		cacheSize = DefaultCacheSize
+	}
+
+	if opts.ReadOnly {
+		return openReadOnly(path, opts)
+	}
+
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database file: %w", err)
 	}
-	db := &Database{
-		file:        file,
-		pageSize:    pageSize,
-		nextPageID:  0,
-		tables:      make(map[string]*Table),
-		tableIDMap:  make(map[string]*Table),
-		rowIndices:  make(map[string]*btree.BTree),
-		nextTableID: 1,
-	}
+
+	// An existing file decides the page size
 	if info, err := file.Stat(); err != nil {
+		file.Close()
 		return nil, err
 	} else if info.Size() > 0 {
-		if err := db.loadExistingData(); err != nil {
+		pageSize, err = readFilePageSize(file)
+		if err != nil {
+			file.Close()
 			return nil, err
 		}
+	} else if err := validatePageSize(pageSize); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	wal, err := openWAL(path + "-wal")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	db := newDatabase(file, wal, pageSize, cacheSize, opts)
+
+	// Bring the data file up to date before reading anything from it
+	if err := db.recover(); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err == nil && info.Size() > 0 {
+		err = db.loadExistingData()
+	} else if err == nil {
+		err = db.initialize()
+	}
+	if err != nil {
+		db.closeFiles()
+		return nil, err
 	}
 
+	// Everything found on disk was committed
+	db.lastCommitted = db.nextTxID - 1
+
+	db.prunerDone.Add(1)
+	go db.pruneLoop()
+
 	return db, nil
 }
 
+// openReadOnly opens an existing database file for reading only
+func openReadOnly(path string, opts Options) (*Database, error) {
+	cacheSize := opts.CacheSize
+	if cacheSize == 0 {
+		cacheSize = DefaultCacheSize
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database file: %w", err)
+	}
+	if info, err := file.Stat(); err != nil {
+		file.Close()
+		return nil, err
+	} else if info.Size() == 0 {
+		file.Close()
+		return nil, fmt.Errorf("database file %s is empty", path)
+	}
+	pageSize, err := readFilePageSize(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	db := newDatabase(file, nil, pageSize, cacheSize, opts)
+	if err := db.loadExistingData(); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
+	db.lastCommitted = db.nextTxID - 1
+	return db, nil
+}
+
+// newDatabase returns a database over open files, with nothing loaded yet
+func newDatabase(file *os.File, wal *writeAheadLog, pageSize int, cacheSize int, opts Options) *Database {
+	db := &Database{
+		file:         file,
+		wal:          wal,
+		pageSize:     pageSize,
+		corruptPages: opts.CorruptPages,
+		readOnly:     opts.ReadOnly,
+		nextPageID:   0,
+		tables:       make(map[string]*Table),
+		tableIDMap:   make(map[string]*Table),
+		nextTableID:  1,
+		nextTxID:     1,
+		snapshots:    make(map[*snapshot]struct{}),
+		garbage:      make(map[uint64]uint64),
+		stopPruner:   make(chan struct{}),
+	}
+	db.pool = newBufferPool(db, cacheSize)
+	return db
+}
+
+// recover replays committed WAL batches into the data file and resets the log
+func (db *Database) recover() error {
+	_, err := db.wal.replay(func(page *Page) error {
+		if len(page.Data) != db.pageSize {
+			return fmt.Errorf("wal page size %d does not match database page size %d", len(page.Data), db.pageSize)
+		}
+		return db.writePage(page)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to recover from wal: %w", err)
+	}
+
+	return db.checkpoint()
+}
+
+// checkpoint writes back the buffer pool and makes the data file durable so
+// the log can be discarded
+func (db *Database) checkpoint() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.pool.flush(); err != nil {
+		return err
+	}
+	if err := db.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync database file: %w", err)
+	}
+	return db.wal.reset()
+}
+
 // writePage writes a page to disk
 func (db *Database) writePage(page *Page) error {
 	offset := int64(page.ID) * int64(db.pageSize)
@@ -41,118 +206,158 @@ func (db *Database) writePage(page *Page) error {
 	return err
 }
 
-// readPage reads a page from disk
-func (db *Database) readPage(pageID uint64) (*Page, error) {
-	page := &Page{
-		ID:   pageID,
-		Data: make([]byte, db.pageSize),
+// readPageFromFile reads a page from disk into data and verifies its checksum
+func (db *Database) readPageFromFile(pageID uint64, data []byte) error {
+	offset := int64(pageID) * int64(db.pageSize)
+	if _, err := db.file.ReadAt(data, offset); err != nil {
+		return err
 	}
 
-	offset := int64(pageID) * int64(db.pageSize)
-	_, err := db.file.ReadAt(page.Data, offset)
-	if err != nil {
-		return nil, err
+	if binary.LittleEndian.Uint32(data[17:pageHeaderSize]) != pageChecksum(data) {
+		return &CorruptPageError{PageID: pageID}
 	}
+	return nil
+}
+
+// castagnoli is the CRC32C table used for page checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
 
-	return page, nil
+// pageChecksum computes the checksum of a page image, leaving out the checksum itself
+func pageChecksum(data []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, data[:17])
+	return crc32.Update(crc, castagnoli, data[pageHeaderSize:])
 }
 
-// loadExistingData loads existing database content into memory
+// setPageChecksum stores the checksum of a page image in its header
+func setPageChecksum(page *Page) {
+	binary.LittleEndian.PutUint32(page.Data[17:pageHeaderSize], pageChecksum(page.Data))
+}
+
+// readPage returns the latest committed image of a page through the buffer pool.
+// The page is pinned, it must not be modified and must be unpinned after use.
+func (db *Database) readPage(pageID uint64) (*Page, error) {
+	return db.pool.fetch(pageID)
+}
+
+// unpinPage releases a page returned by readPage
+func (db *Database) unpinPage(page *Page) {
+	db.pool.unpin(page.ID)
+}
+
+// loadExistingData reads the catalog of an existing database file.
+// Rows and indexes stay on disk, only the table definitions are loaded.
 func (db *Database) loadExistingData() error {
-	fileInfo, err := db.file.Stat()
+	metaPage, err := db.readPage(metaPageID)
+	if err != nil {
+		return fmt.Errorf("failed to read meta page: %w", err)
+	}
+	meta, err := decodeMeta(metaPage)
+	db.unpinPage(metaPage)
 	if err != nil {
 		return err
 	}
+	db.nextTxID = meta.nextTxID
+	db.nextPageID = meta.nextPageID
+	db.nextTableID = meta.nextTableID
 
-	numPages := fileInfo.Size() / int64(db.pageSize)
-
-	// First pass: Load table definitions
-	for pageID := uint64(0); pageID < uint64(numPages); pageID++ {
+	// Follow the chain of table pages
+	for pageID := meta.catalogHead; pageID != 0; {
 		page, err := db.readPage(pageID)
+		lost := errors.Is(err, ErrCorruptPage) || errors.Is(err, io.EOF)
+		if lost && db.corruptPages == QuarantineCorruptPages {
+			// The link to the next table page is lost with this one
+			db.quarantined = append(db.quarantined, pageID)
+			break
+		}
 		if err != nil {
 			return fmt.Errorf("failed to read page %d: %w", pageID, err)
 		}
 
-		if pageID >= db.nextPageID {
-			db.nextPageID = pageID + 1
+		if PageType(page.Data[0]) != PTTable {
+			db.unpinPage(page)
+			return fmt.Errorf("catalog page %d is not a table page", pageID)
 		}
 
-		if len(page.Data) == 0 {
-			continue // Skip empty pages
+		table, err := readTableDef(db, page)
+		next := binary.LittleEndian.Uint64(page.Data[7:15])
+		db.unpinPage(page)
+		var corrupt *CorruptPageError
+		if errors.As(err, &corrupt) && db.corruptPages == QuarantineCorruptPages {
+			// Only this table is lost, the catalog goes on
+			db.quarantined = append(db.quarantined, corrupt.PageID)
+			pageID = next
+			continue
+		}
+		if errors.Is(err, io.EOF) && db.corruptPages == QuarantineCorruptPages {
+			// The definition continues past the end of the file
+			db.quarantined = append(db.quarantined, pageID)
+			pageID = next
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to deserialize table on page %d: %w", pageID, err)
 		}
 
-		pageType := PageType(page.Data[0])
-
-		if pageType == PTTable {
-			table, err := deserializeTable(page)
-			if err != nil {
-				return fmt.Errorf("failed to deserialize table on page %d: %w", pageID, err)
-			}
+		// Add table to maps
+		db.tables[table.Name] = table
+		db.tableIDMap[table.Name] = table
 
-			db.rowIndices[table.Name] = btree.New(32)
+		pageID = next
+	}
 
-			// Add table to maps
-			db.tables[table.Name] = table
-			db.tableIDMap[table.Name] = table
+	return nil
+}
 
-			if table.ID >= db.nextTableID {
-				db.nextTableID = table.ID + 1
-			}
-		}
+// Close waits for an active transaction, checkpoints the WAL and closes the
+// database. A read-only database is simply closed. Closing a database again
+// returns ErrClosed.
+func (db *Database) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
 	}
+	db.closed = true
+	if db.readOnly {
+		defer db.mu.Unlock()
+		return db.closeFiles()
+	}
+	db.mu.Unlock()
 
-	// Second pass: Process data pages and build indices
-	for pageID := uint64(0); pageID < uint64(numPages); pageID++ {
-		page, err := db.readPage(pageID)
-		if err != nil {
-			return fmt.Errorf("failed to read page %d: %w", pageID, err)
-		}
+	close(db.stopPruner)
+	db.prunerDone.Wait()
 
-		if len(page.Data) == 0 {
-			continue
-		}
+	// Stale index entries are only tracked in memory, clean them up while we can
+	db.pruneVersions()
 
-		pageType := PageType(page.Data[0])
-
-		if pageType == PTData {
-			// Extract table ID from page header
-			tableID := binary.LittleEndian.Uint32(page.Data[1:5])
-			nextPageID := binary.LittleEndian.Uint64(page.Data[7:15])
-
-			// Find corresponding table by ID
-			var targetTable *Table
-			for _, table := range db.tables {
-				if table.ID == tableID {
-					targetTable = table
-					break
-				}
-			}
-
-			if targetTable == nil {
-				return fmt.Errorf("data page %d references unknown table ID %d", pageID, tableID)
-			}
-
-			if targetTable.FirstPageID == 0 {
-				targetTable.FirstPageID = pageID
-			}
-
-			if nextPageID == 0 {
-				targetTable.LastPageID = pageID
-			}
-
-			err = db.indexRowsInPage(page, targetTable)
-			if err != nil {
-				return fmt.Errorf("failed to index rows in page %d: %w", pageID, err)
-			}
-		}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.checkpoint(); err != nil {
+		db.closeFiles()
+		return err
 	}
 
-	return nil
+	if err := db.closeFiles(); err != nil {
+		return err
+	}
+
+	// A clean shutdown leaves nothing to replay
+	return os.Remove(db.wal.path)
 }
 
-// Close closes the database
-func (db *Database) Close() error {
-	return db.file.Close()
+// closeFiles closes the data and log files
+func (db *Database) closeFiles() error {
+	var walErr error
+	if db.wal != nil {
+		walErr = db.wal.close()
+	}
+	if err := db.file.Close(); err != nil {
+		return err
+	}
+	return walErr
 }
 
 // ListTables returns names of all tables in the database
@@ -169,22 +374,28 @@ func (db *Database) ListTables() []string {
 
 // GetRowCount returns the number of rows in a table
 func (db *Database) GetRowCount(tableName string) (int, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+	snap := db.acquireSnapshot()
+	defer db.releaseSnapshot(snap)
 
-	index, exists := db.rowIndices[tableName]
+	table, exists := snap.table(tableName)
 	if !exists {
 		return 0, fmt.Errorf("table not found: %s", tableName)
 	}
 
-	return index.Len(), nil
+	count := 0
+	err := db.scanRowIndex(snap, table, 0, math.MaxUint64, func(rowIndex *RowIndex, row *Row) bool {
+		count++
+		return true
+	})
+	return count, err
 }
 
-// hasEnoughSpace checks if a page has enough space for a value of given size
-func (db *Database) hasEnoughSpace(page *Page, neededSpace int) bool {
-	// Read free offset
-	freeOffset := binary.LittleEndian.Uint16(page.Data[15:17])
+// QuarantinedPages returns the corrupt pages skipped while opening the database
+func (db *Database) QuarantinedPages() []uint64 {
+	return append([]uint64(nil), db.quarantined...)
+}
 
-	// Check if there's enough space (leave some margin for safety)
-	return int(freeOffset)+neededSpace+4 <= db.pageSize
+// PageSize returns the size of the database's pages in bytes
+func (db *Database) PageSize() int {
+	return db.pageSize
 }
@@ -3,18 +3,44 @@ package storageengine
 import (
 	"encoding/binary"
 	"fmt"
-
-	"github.com/google/btree"
 )
 
-// CreateTable creates a new table in the database
+// CreateTable creates a new table in a transaction of its own
 func (db *Database) CreateTable(tableName string, columns []Column, primaryKey string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	return db.autocommit(func(tx *Tx) error {
+		return tx.CreateTable(tableName, columns, primaryKey)
+	})
+}
+
+// CreateTable creates a new table as part of the transaction
+func (tx *Tx) CreateTable(tableName string, columns []Column, primaryKey string) error {
+	if tx.done {
+		return ErrTxDone
+	}
 
-	if _, exists := db.tables[tableName]; exists {
+	if err := checkName("table", tableName); err != nil {
+		return err
+	}
+	if _, exists := tx.tables[tableName]; exists {
 		return fmt.Errorf("table already exists: %s", tableName)
 	}
+	// Columns are numbered in order, the caller's slice is left alone
+	columns = append([]Column(nil), columns...)
+	for i := range columns {
+		col := &columns[i]
+		if err := checkName("column", col.Name); err != nil {
+			return err
+		}
+		if err := checkColumnType(*col); err != nil {
+			return err
+		}
+		var err error
+		if col.Default, err = normalizeDefault(*col); err != nil {
+			return err
+		}
+		col.id = uint32(i + 1)
+		col.added, col.dropped = 0, 0
+	}
 
 	if primaryKey != "" {
 		hasPK := false
@@ -31,61 +57,77 @@ func (db *Database) CreateTable(tableName string, columns []Column, primaryKey s
 
 	// Create table object
 	table := &Table{
-		ID:      db.nextTableID,
-		Name:    tableName,
-		Columns: columns,
-		PK:      primaryKey,
+		ID:        tx.nextTableID,
+		Name:      tableName,
+		Columns:   columns,
+		PK:        primaryKey,
+		NextRowID: 1,
 	}
-	db.nextTableID++
-
-	db.rowIndices[table.Name] = btree.New(32)
+	tx.nextTableID++
 
 	// Create and initialize table metadata page
-	tablePage := &Page{
-		ID:   db.nextPageID,
-		Data: make([]byte, db.pageSize),
+	tablePage, err := tx.newPage()
+	if err != nil {
+		return err
 	}
-	db.nextPageID++
+	table.pageID = tablePage.ID
 
 	tablePage.Data[0] = byte(PTTable)
 	binary.LittleEndian.PutUint32(tablePage.Data[1:5], table.ID)
-	binary.LittleEndian.PutUint16(tablePage.Data[5:7], 0)    // RowCount is always 0 for table pages
-	binary.LittleEndian.PutUint64(tablePage.Data[7:15], 0)   // No next page initially
-	binary.LittleEndian.PutUint16(tablePage.Data[15:17], 17) // Free offset starts after header
+	binary.LittleEndian.PutUint16(tablePage.Data[5:7], 0)                // RowCount is always 0 for table pages
+	binary.LittleEndian.PutUint16(tablePage.Data[15:17], pageHeaderSize) // Free offset starts after header
+
+	// Put the table at the head of the catalog
+	err = tx.updateMeta(func(meta *dbMeta) {
+		binary.LittleEndian.PutUint64(tablePage.Data[7:15], meta.catalogHead)
+		meta.catalogHead = tablePage.ID
+	})
+	if err != nil {
+		return err
+	}
 
-	if err := serializeTable(table, tablePage); err != nil {
-		return fmt.Errorf("failed to serialize table: %w", err)
+	rowIndexRoot, err := tx.createBPTree(table.ID)
+	if err != nil {
+		return err
 	}
+	table.RowIndexRoot = rowIndexRoot
 
-	// Create and initialize first data page for this table
-	dataPage := &Page{
-		ID:   db.nextPageID,
-		Data: make([]byte, db.pageSize),
+	if primaryKey != "" {
+		pkRoot, err := tx.createBPTree(table.ID)
+		if err != nil {
+			return err
+		}
+		table.Indexes = append(table.Indexes, Index{
+			Name:       tableName + "_pkey",
+			Columns:    []string{primaryKey},
+			Unique:     true,
+			Primary:    true,
+			RootPageID: pkRoot,
+		})
 	}
-	db.nextPageID++
 
-	dataPage.Data[0] = byte(PTData)
-	binary.LittleEndian.PutUint32(dataPage.Data[1:5], table.ID)
-	binary.LittleEndian.PutUint16(dataPage.Data[5:7], 0)
-	binary.LittleEndian.PutUint64(dataPage.Data[7:15], 0)
-	binary.LittleEndian.PutUint16(dataPage.Data[15:17], 17)
+	// Create and initialize first data page for this table
+	dataPage, err := tx.newDataPage(table.ID)
+	if err != nil {
+		return err
+	}
 
 	// Update table with page IDs
 	table.FirstPageID = dataPage.ID
 	table.LastPageID = dataPage.ID
 
-	// Write pages to disk
-	if err := db.writePage(tablePage); err != nil {
+	// Stage pages until commit
+	if err := tx.writeTableDef(table, tablePage); err != nil {
 		return fmt.Errorf("failed to write table page: %w", err)
 	}
 
-	if err := db.writePage(dataPage); err != nil {
+	if err := tx.writePage(dataPage); err != nil {
 		return fmt.Errorf("failed to write data page: %w", err)
 	}
 
-	// Add table to in-memory maps
-	db.tables[table.Name] = table
-	db.tableIDMap[table.Name] = table
+	// Add table to the transaction's maps
+	tx.tables[table.Name] = table
+	tx.tableIDMap[table.Name] = table
 
 	return nil
 }
@@ -103,123 +145,252 @@ func (db *Database) GetTableSchema(tableName string) (*Table, error) {
 	return table, nil
 }
 
-// serializeTable serializes a table schema into a page
-func serializeTable(table *Table, page *Page) error {
-	offset := uint16(17)
-	nameLen := uint16(len(table.Name))
-
-	// Write table name length
-	binary.LittleEndian.PutUint16(page.Data[offset:offset+2], nameLen)
-	offset += 2
-
-	// Write table name
-	copy(page.Data[offset:offset+nameLen], []byte(table.Name))
-	offset += nameLen
-
-	// Write number of columns
-	colCount := uint16(len(table.Columns))
-	binary.LittleEndian.PutUint16(page.Data[offset:offset+2], colCount)
-	offset += 2
+// column returns the definition of a column by name
+func (t *Table) column(name string) (*Column, bool) {
+	for i := range t.Columns {
+		if t.Columns[i].Name == name {
+			return &t.Columns[i], true
+		}
+	}
+	return nil, false
+}
 
-	// Write primary key length
-	pkLen := uint16(len(table.PK))
-	binary.LittleEndian.PutUint16(page.Data[offset:offset+2], pkLen)
-	offset += 2
+// newDataPage allocates an empty data page for a table, unstaged and not linked to its chain yet
+func (tx *Tx) newDataPage(tableID uint32) (*Page, error) {
+	page, err := tx.newPage()
+	if err != nil {
+		return nil, err
+	}
 
-	// Write primary key name
-	copy(page.Data[offset:offset+pkLen], table.PK)
-	offset += pkLen
+	page.Data[0] = byte(PTData)
+	binary.LittleEndian.PutUint32(page.Data[1:5], tableID)
+	binary.LittleEndian.PutUint16(page.Data[5:7], 0)                // No rows yet
+	binary.LittleEndian.PutUint64(page.Data[7:15], 0)               // No next page yet
+	binary.LittleEndian.PutUint16(page.Data[15:17], pageHeaderSize) // Free offset starts after header
+	return page, nil
+}
 
-	// Write column definitions
-	for _, col := range table.Columns {
-		// Write column name length
-		colNameLen := uint16(len(col.Name))
-		binary.LittleEndian.PutUint16(page.Data[offset:offset+2], colNameLen)
-		offset += 2
+// DropTable removes a table in a transaction of its own
+func (db *Database) DropTable(tableName string) error {
+	return db.autocommit(func(tx *Tx) error {
+		return tx.DropTable(tableName)
+	})
+}
 
-		// Write column name
-		copy(page.Data[offset:offset+colNameLen], col.Name)
-		offset += colNameLen
+// DropTable removes a table and its indexes as part of the transaction.
+// Every page of the table goes to the free list, older snapshots keep
+// reading the table until they are released.
+func (tx *Tx) DropTable(tableName string) error {
+	if tx.done {
+		return ErrTxDone
+	}
 
-		// Write column type
-		page.Data[offset] = byte(col.Type)
-		offset++
+	table, exists := tx.tables[tableName]
+	if !exists {
+		return fmt.Errorf("table not found: %s", tableName)
+	}
 
-		// Write column flags (NotNull for now)
-		if col.NotNull {
-			page.Data[offset] = 1
-		} else {
-			page.Data[offset] = 0
+	if err := tx.freeTableStorage(table); err != nil {
+		return err
+	}
+	for i := range table.Indexes {
+		if err := tx.freeCentroids(&table.Indexes[i]); err != nil {
+			return err
 		}
-		offset++
+	}
+	if err := tx.unlinkTablePage(table); err != nil {
+		return err
 	}
 
-	// Update free offset in page header
-	binary.LittleEndian.PutUint16(page.Data[15:17], offset)
+	// The definition goes with its pages
+	page, err := tx.readPage(table.pageID)
+	if err != nil {
+		return fmt.Errorf("failed to read table page: %w", err)
+	}
+	pageIDs, err := catalogPages(tx, page)
+	tx.unpinPage(page)
+	if err != nil {
+		return err
+	}
+	for _, pageID := range append(pageIDs, table.pageID) {
+		if err := tx.freePage(pageID); err != nil {
+			return err
+		}
+	}
 
+	delete(tx.tables, tableName)
+	delete(tx.tableIDMap, tableName)
 	return nil
 }
 
-// deserializeTable deserializes a table schema from a page
-func deserializeTable(page *Page) (*Table, error) {
-	offset := uint16(17)
+// TruncateTable removes every row of a table in a transaction of its own
+func (db *Database) TruncateTable(tableName string) error {
+	return db.autocommit(func(tx *Tx) error {
+		return tx.TruncateTable(tableName)
+	})
+}
+
+// TruncateTable removes every row of a table as part of the transaction. The
+// table keeps its definition and indexes, which start over empty; row IDs are
+// never handed out again. Vector indexes keep their lists' centroids. Older
+// snapshots keep seeing the old rows.
+func (tx *Tx) TruncateTable(tableName string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	table, exists := tx.tables[tableName]
+	if !exists {
+		return fmt.Errorf("table not found: %s", tableName)
+	}
+
+	if err := tx.freeTableStorage(table); err != nil {
+		return err
+	}
 
-	// Read table ID from page header
-	tableID := binary.LittleEndian.Uint32(page.Data[1:5])
+	rowIndexRoot, err := tx.createBPTree(table.ID)
+	if err != nil {
+		return err
+	}
+	table.RowIndexRoot = rowIndexRoot
+	for i := range table.Indexes {
+		root, err := tx.createBPTree(table.ID)
+		if err != nil {
+			return err
+		}
+		table.Indexes[i].RootPageID = root
+	}
 
-	// Read table name length
-	nameLen := binary.LittleEndian.Uint16(page.Data[offset : offset+2])
-	offset += 2
+	dataPage, err := tx.newDataPage(table.ID)
+	if err != nil {
+		return err
+	}
+	if err := tx.writePage(dataPage); err != nil {
+		return fmt.Errorf("failed to write data page: %w", err)
+	}
+	table.FirstPageID = dataPage.ID
+	table.LastPageID = dataPage.ID
 
-	// Read table name
-	tableName := string(page.Data[offset : offset+nameLen])
-	offset += nameLen
+	return tx.writeTablePage(table)
+}
 
-	// Read number of columns
-	colCount := binary.LittleEndian.Uint16(page.Data[offset : offset+2])
-	offset += 2
+// RenameTable renames a table in a transaction of its own
+func (db *Database) RenameTable(oldName string, newName string) error {
+	return db.autocommit(func(tx *Tx) error {
+		return tx.RenameTable(oldName, newName)
+	})
+}
 
-	// Read primary key name length
-	pkLen := binary.LittleEndian.Uint16(page.Data[offset : offset+2])
-	offset += 2
+// RenameTable renames a table as part of the transaction. Its indexes keep
+// their names.
+func (tx *Tx) RenameTable(oldName string, newName string) error {
+	if tx.done {
+		return ErrTxDone
+	}
 
-	// Read primary key name
-	primaryKey := string(page.Data[offset : offset+pkLen])
-	offset += pkLen
+	table, exists := tx.tables[oldName]
+	if !exists {
+		return fmt.Errorf("table not found: %s", oldName)
+	}
+	if err := checkName("table", newName); err != nil {
+		return err
+	}
+	if _, exists := tx.tables[newName]; exists {
+		return fmt.Errorf("table already exists: %s", newName)
+	}
 
-	// Read columns
-	columns := make([]Column, colCount)
-	for i := range columns {
-		// Read column name length
-		colNameLen := binary.LittleEndian.Uint16(page.Data[offset : offset+2])
-		offset += 2
+	table.Name = newName
+	if err := tx.writeTablePage(table); err != nil {
+		return err
+	}
 
-		// Read column name
-		colName := string(page.Data[offset : offset+colNameLen])
-		offset += colNameLen
+	delete(tx.tables, oldName)
+	delete(tx.tableIDMap, oldName)
+	tx.tables[newName] = table
+	tx.tableIDMap[newName] = table
+	return nil
+}
 
-		// Read column type
-		colType := ColumnType(page.Data[offset])
-		offset++
+// freeTableStorage frees the data pages of a table, the values its row
+// versions store out of line and its index trees
+func (tx *Tx) freeTableStorage(table *Table) error {
+	for pageID := table.FirstPageID; pageID != 0; {
+		page, err := tx.readPage(pageID)
+		if err != nil {
+			return fmt.Errorf("failed to read data page %d: %w", pageID, err)
+		}
+		for slot := uint16(0); slot < slotCount(page) && err == nil; slot++ {
+			if offset := slotOffset(page, slot); offset != 0 {
+				var record rowRecord
+				if record, err = readRowRecord(page, offset); err == nil {
+					err = tx.freeOverflow(table, record.payload)
+				}
+			}
+		}
+		next := binary.LittleEndian.Uint64(page.Data[7:15])
+		tx.unpinPage(page)
+		if err != nil {
+			return fmt.Errorf("failed to free overflow pages on data page %d: %w", pageID, err)
+		}
 
-		// Read column flags
-		notNull := page.Data[offset] != 0
-		offset++
+		if err := tx.freePage(pageID); err != nil {
+			return err
+		}
+		pageID = next
+	}
 
-		columns[i] = Column{
-			Name:    colName,
-			Type:    colType,
-			NotNull: notNull,
+	if err := tx.freeBPTree(table.RowIndexRoot); err != nil {
+		return err
+	}
+	for _, index := range table.Indexes {
+		if err := tx.freeBPTree(index.RootPageID); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// Create and return table
-	table := &Table{
-		ID:      tableID,
-		Name:    tableName,
-		Columns: columns,
-		PK:      primaryKey,
+// unlinkTablePage removes a table page from the catalog chain
+func (tx *Tx) unlinkTablePage(table *Table) error {
+	page, err := tx.readPage(table.pageID)
+	if err != nil {
+		return fmt.Errorf("failed to read table page: %w", err)
 	}
+	next := binary.LittleEndian.Uint64(page.Data[7:15])
+	tx.unpinPage(page)
 
-	return table, nil
+	metaPage, err := tx.readPage(metaPageID)
+	if err != nil {
+		return fmt.Errorf("failed to read meta page: %w", err)
+	}
+	meta, err := decodeMeta(metaPage)
+	tx.unpinPage(metaPage)
+	if err != nil {
+		return err
+	}
+	if meta.catalogHead == table.pageID {
+		return tx.updateMeta(func(meta *dbMeta) {
+			meta.catalogHead = next
+		})
+	}
+
+	for pageID := meta.catalogHead; pageID != 0; {
+		prev, err := tx.readPage(pageID)
+		if err != nil {
+			return fmt.Errorf("failed to read table page %d: %w", pageID, err)
+		}
+		prevNext := binary.LittleEndian.Uint64(prev.Data[7:15])
+		tx.unpinPage(prev)
+
+		if prevNext == table.pageID {
+			prev, err := tx.modifyPage(pageID)
+			if err != nil {
+				return fmt.Errorf("failed to read table page %d: %w", pageID, err)
+			}
+			binary.LittleEndian.PutUint64(prev.Data[7:15], next)
+			return tx.writePage(prev)
+		}
+		pageID = prevNext
+	}
+	return fmt.Errorf("table page %d is not in the catalog", table.pageID)
 }
@@ -0,0 +1,208 @@
+package storageengine
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestTableOperations tests dropping, truncating and renaming tables
+func TestTableOperations(t *testing.T) {
+	dbPath := "table_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+		{Name: "body", Type: Tstring, NotNull: false},
+	}
+
+	// create makes a table with an index and rows, some with values stored out of line
+	create := func(t *testing.T, table string, rows int) {
+		t.Helper()
+		if err := db.CreateTable(table, columns, "id"); err != nil {
+			t.Fatalf("Failed to create table %s: %v", table, err)
+		}
+		if err := db.CreateIndex(table, table+"_name", []string{"name"}, false); err != nil {
+			t.Fatalf("Failed to create index on %s: %v", table, err)
+		}
+		for i := 1; i <= rows; i++ {
+			values := map[string]interface{}{
+				"id":   int64(i),
+				"name": fmt.Sprintf("%s %d", table, i),
+			}
+			if i%10 == 0 {
+				values["body"] = strings.Repeat("b", 3000)
+			}
+			if err := db.Insert(table, values); err != nil {
+				t.Fatalf("Failed to insert row %d into %s: %v", i, table, err)
+			}
+		}
+	}
+
+	checkOK := func(t *testing.T) {
+		t.Helper()
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Failed to check database: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("Expected no problems, got %v", report.Problems)
+		}
+	}
+
+	// nextPageID returns the end of the file as seen by the next transaction
+	nextPageID := func() uint64 {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return db.nextPageID
+	}
+
+	create(t, "first", 50)
+	create(t, "middle", 200)
+	create(t, "last", 50)
+
+	// Test: a dropped table is gone and its pages are reused
+	t.Run("Drop", func(t *testing.T) {
+		if err := db.DropTable("middle"); err != nil {
+			t.Fatalf("Failed to drop table: %v", err)
+		}
+		if _, err := db.SelectAll("middle"); err == nil {
+			t.Fatal("Expected selecting from a dropped table to fail")
+		}
+		if err := db.DropTable("middle"); err == nil {
+			t.Fatal("Expected dropping a missing table to fail")
+		}
+		for _, table := range []string{"first", "last"} {
+			if count, err := db.GetRowCount(table); err != nil || count != 50 {
+				t.Fatalf("Expected %s to keep its 50 rows, got %d, %v", table, count, err)
+			}
+		}
+		checkOK(t)
+
+		// The pruner has no garbage left on the dropped pages
+		if err := db.pruneVersions(); err != nil {
+			t.Fatalf("Failed to prune: %v", err)
+		}
+
+		end := nextPageID()
+		create(t, "middle", 100)
+		if got := nextPageID(); got != end {
+			t.Fatalf("Expected the new table to reuse the dropped pages, the file grew from %d to %d pages", end, got)
+		}
+		checkOK(t)
+	})
+
+	// Test: a snapshot taken before the drop still reads the table
+	t.Run("Snapshot", func(t *testing.T) {
+		snap := db.acquireSnapshot()
+		if err := db.DropTable("first"); err != nil {
+			db.releaseSnapshot(snap)
+			t.Fatalf("Failed to drop table: %v", err)
+		}
+		create(t, "other", 100)
+
+		rows, err := db.scanRows(snap, snap.tables["first"], nil)
+		db.releaseSnapshot(snap)
+		if err != nil {
+			t.Fatalf("Failed to scan snapshot: %v", err)
+		}
+		if len(rows) != 50 {
+			t.Fatalf("Expected the snapshot to see 50 rows, got %d", len(rows))
+		}
+		checkOK(t)
+	})
+
+	// Test: a truncated table is empty but keeps its indexes and row IDs
+	t.Run("Truncate", func(t *testing.T) {
+		if err := db.TruncateTable("middle"); err != nil {
+			t.Fatalf("Failed to truncate table: %v", err)
+		}
+		if count, err := db.GetRowCount("middle"); err != nil || count != 0 {
+			t.Fatalf("Expected no rows after truncating, got %d, %v", count, err)
+		}
+		if rows, err := db.SelectWhere("middle", "name", "=", "middle 5"); err != nil || len(rows) != 0 {
+			t.Fatalf("Expected the index to be empty, got %d rows, %v", len(rows), err)
+		}
+
+		// The primary key starts over, row IDs do not
+		err := db.Insert("middle", map[string]interface{}{"id": int64(5), "name": "middle 5"})
+		if err != nil {
+			t.Fatalf("Failed to insert after truncating: %v", err)
+		}
+		rows, err := db.SelectWhere("middle", "name", "=", "middle 5")
+		if err != nil || len(rows) != 1 {
+			t.Fatalf("Expected to find the new row through the index, got %d rows, %v", len(rows), err)
+		}
+		if rows[0].RowID <= 100 {
+			t.Fatalf("Expected a new row ID, got %d", rows[0].RowID)
+		}
+		checkOK(t)
+	})
+
+	// Test: a renamed table keeps its rows under the new name only
+	t.Run("Rename", func(t *testing.T) {
+		if err := db.RenameTable("last", "renamed"); err != nil {
+			t.Fatalf("Failed to rename table: %v", err)
+		}
+		if _, err := db.SelectAll("last"); err == nil {
+			t.Fatal("Expected the old name to be gone")
+		}
+		rows, err := db.SelectWhere("renamed", "name", "=", "last 7")
+		if err != nil || len(rows) != 1 {
+			t.Fatalf("Expected to find a row of the renamed table through its index, got %d rows, %v", len(rows), err)
+		}
+
+		if err := db.RenameTable("renamed", "middle"); err == nil {
+			t.Fatal("Expected renaming onto an existing table to fail")
+		}
+		if err := db.RenameTable("missing", "other name"); err == nil {
+			t.Fatal("Expected renaming a missing table to fail")
+		}
+		if err := db.RenameTable("renamed", ""); err == nil {
+			t.Fatal("Expected an empty name to be rejected")
+		}
+
+		// Index entries left behind by updates are still reclaimed
+		if _, err := db.Update("renamed", func(row *Row) bool { return true }, map[string]interface{}{"name": "updated"}); err != nil {
+			t.Fatalf("Failed to update renamed table: %v", err)
+		}
+		if err := db.pruneVersions(); err != nil {
+			t.Fatalf("Failed to prune: %v", err)
+		}
+		if len(db.indexGarbage) != 0 {
+			t.Fatalf("Expected index garbage to be reclaimed, %d entries left", len(db.indexGarbage))
+		}
+		checkOK(t)
+	})
+
+	// Test: the changes to the catalog survive reopening
+	t.Run("Reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+
+		tables := db.ListTables()
+		if len(tables) != 3 {
+			t.Fatalf("Expected 3 tables, got %v", tables)
+		}
+		for table, want := range map[string]int{"middle": 1, "other": 100, "renamed": 50} {
+			if count, err := db.GetRowCount(table); err != nil || count != want {
+				t.Fatalf("Expected %d rows in %s, got %d, %v", want, table, count, err)
+			}
+		}
+		checkOK(t)
+	})
+}
@@ -0,0 +1,226 @@
+package storageengine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTxDone is returned when a committed or rolled back transaction is used
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Begin starts a write transaction. Only one transaction is active at a time;
+// Begin blocks until the previous one commits or rolls back.
+func (db *Database) Begin() *Tx {
+	db.writer.Lock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx := &Tx{
+		db:          db,
+		id:          db.nextTxID,
+		snapshotID:  db.lastCommitted,
+		pages:       make(map[uint64]*Page),
+		tables:      make(map[string]*Table, len(db.tables)),
+		tableIDMap:  make(map[string]*Table, len(db.tableIDMap)),
+		horizon:     db.horizon(),
+		nextPageID:  db.nextPageID,
+		nextTableID: db.nextTableID,
+		garbage:     make(map[uint64]uint64),
+		freed:       make(map[uint64]bool),
+	}
+	db.nextTxID++
+
+	for name, table := range db.tables {
+		copied := *table
+		// Index roots move when the tree splits, keep those changes private
+		copied.Indexes = append([]Index(nil), table.Indexes...)
+		tx.tables[name] = &copied
+		tx.tableIDMap[name] = &copied
+	}
+	return tx
+}
+
+// Commit logs the transaction's pages to the WAL, applies them and
+// publishes its tables to other readers
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	defer tx.db.writer.Unlock()
+
+	if tx.db.readOnly {
+		// Nothing to apply for a transaction that only read
+		if len(tx.pageOrder) > 0 {
+			return ErrReadOnly
+		}
+		return nil
+	}
+	if len(tx.pageOrder) > 0 {
+		// Rows carry the transaction ID, it must never be handed out again after a restart
+		err := tx.updateMeta(func(meta *dbMeta) {
+			meta.nextTxID = tx.id + 1
+			meta.nextPageID = tx.nextPageID
+			meta.nextTableID = tx.nextTableID
+		})
+		if err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+	}
+
+	pages := make([]*Page, 0, len(tx.pageOrder))
+	for _, pageID := range tx.pageOrder {
+		page := tx.pages[pageID]
+		setPageChecksum(page)
+		pages = append(pages, page)
+	}
+
+	db := tx.db
+
+	// The log is synced before taking the lock so readers never wait on it
+	if len(pages) > 0 {
+		if err := db.wal.appendBatch(pages); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+	}
+
+	if err := tx.publish(pages); err != nil {
+		return fmt.Errorf("failed to apply committed transaction: %w", err)
+	}
+
+	if db.wal.size >= walCheckpointSize {
+		return db.checkpoint()
+	}
+
+	return nil
+}
+
+// publish installs logged pages in the buffer pool and makes the transaction's
+// tables the ones new snapshots see. The pages reach the data file when they
+// are evicted or at the next checkpoint.
+func (tx *Tx) publish(pages []*Page) error {
+	db := tx.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.pool.install(pages); err != nil {
+		// The batch is in the log, replay finishes it on the next open
+		return err
+	}
+
+	db.tables = tx.tables
+	db.tableIDMap = tx.tableIDMap
+	db.nextPageID = tx.nextPageID
+	db.nextTableID = tx.nextTableID
+	db.lastCommitted = tx.id
+
+	// A freed page has nothing left to prune
+	for pageID := range tx.freed {
+		delete(db.garbage, pageID)
+	}
+	for pageID, xmax := range tx.garbage {
+		if !tx.freed[pageID] {
+			db.addGarbage(pageID, xmax)
+		}
+	}
+	db.indexGarbage = append(db.indexGarbage, tx.indexGarbage...)
+
+	return nil
+}
+
+// Rollback discards every change made by the transaction
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.db.writer.Unlock()
+
+	return nil
+}
+
+// autocommit runs fn in a transaction of its own
+func (db *Database) autocommit(fn func(tx *Tx) error) error {
+	tx := db.Begin()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// readPage reads a page as seen by the transaction. A committed page is pinned
+// and must not be modified, use modifyPage to change it.
+func (tx *Tx) readPage(pageID uint64) (*Page, error) {
+	if page, ok := tx.pages[pageID]; ok {
+		return page, nil
+	}
+	return tx.db.readPage(pageID)
+}
+
+// unpinPage releases a page returned by readPage
+func (tx *Tx) unpinPage(page *Page) {
+	if tx.pages[page.ID] == page {
+		return // Staged pages are not pinned
+	}
+	tx.db.unpinPage(page)
+}
+
+// modifyPage returns a page the transaction may change and stage with writePage.
+// Committed pages are copied, readers may still be using the cached image.
+func (tx *Tx) modifyPage(pageID uint64) (*Page, error) {
+	if page, ok := tx.pages[pageID]; ok {
+		return page, nil
+	}
+
+	cached, err := tx.db.readPage(pageID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.db.unpinPage(cached)
+
+	return &Page{ID: pageID, Data: append([]byte(nil), cached.Data...)}, nil
+}
+
+// table returns a table as seen by the transaction
+func (tx *Tx) table(name string) (*Table, bool) {
+	table, exists := tx.tables[name]
+	return table, exists
+}
+
+// tableByID returns a table as seen by the transaction by its ID
+func (tx *Tx) tableByID(id uint32) (*Table, bool) {
+	for _, table := range tx.tables {
+		if table.ID == id {
+			return table, true
+		}
+	}
+	return nil, false
+}
+
+// writePage stages a page until the transaction commits
+func (tx *Tx) writePage(page *Page) error {
+	if _, ok := tx.pages[page.ID]; !ok {
+		tx.pageOrder = append(tx.pageOrder, page.ID)
+	}
+	tx.pages[page.ID] = page
+	return nil
+}
+
+// newPage allocates a zeroed page, reusing a free page before extending the file
+func (tx *Tx) newPage() (*Page, error) {
+	pageID, reused, err := tx.popFreePage()
+	if err != nil {
+		return nil, err
+	}
+	if !reused {
+		pageID = tx.nextPageID
+		tx.nextPageID++
+	}
+
+	return &Page{
+		ID:   pageID,
+		Data: make([]byte, tx.db.pageSize),
+	}, nil
+}
@@ -0,0 +1,134 @@
+package storageengine
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// TestTransactions tests commit, rollback and isolation of explicit transactions
+func TestTransactions(t *testing.T) {
+	dbPath := "tx_test.db"
+	defer os.Remove(dbPath)
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+	}
+
+	// Test: a table and its rows are invisible until commit
+	t.Run("Commit", func(t *testing.T) {
+		tx := db.Begin()
+		if err := tx.CreateTable("accounts", columns, "id"); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+		for i := 1; i <= 3; i++ {
+			err := tx.Insert("accounts", map[string]interface{}{
+				"id":   int64(i),
+				"name": "account",
+			})
+			if err != nil {
+				t.Fatalf("Failed to insert row %d: %v", i, err)
+			}
+		}
+
+		rows, err := tx.SelectWhere("accounts", "id", ">=", int64(2))
+		if err != nil {
+			t.Fatalf("Failed to select inside transaction: %v", err)
+		}
+		if len(rows) != 2 {
+			t.Fatalf("Expected 2 rows inside transaction, got %d", len(rows))
+		}
+
+		if _, err := db.SelectAll("accounts"); err == nil {
+			t.Fatal("Expected uncommitted table to be invisible to other readers")
+		}
+
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+
+		count, err := db.GetRowCount("accounts")
+		if err != nil {
+			t.Fatalf("Failed to get row count: %v", err)
+		}
+		if count != 3 {
+			t.Fatalf("Expected 3 rows after commit, got %d", count)
+		}
+	})
+
+	// Test: rollback undoes every insert of the batch
+	t.Run("Rollback", func(t *testing.T) {
+		tx := db.Begin()
+		for i := 4; i <= 400; i++ {
+			err := tx.Insert("accounts", map[string]interface{}{
+				"id":   int64(i),
+				"name": "rolled back",
+			})
+			if err != nil {
+				t.Fatalf("Failed to insert row %d: %v", i, err)
+			}
+		}
+
+		rows, err := db.SelectAll("accounts")
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		if len(rows) != 3 {
+			t.Fatalf("Expected uncommitted rows to be invisible, got %d rows", len(rows))
+		}
+
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("Failed to roll back: %v", err)
+		}
+
+		if err := tx.Insert("accounts", map[string]interface{}{"id": int64(5), "name": "late"}); !errors.Is(err, ErrTxDone) {
+			t.Fatalf("Expected ErrTxDone after rollback, got %v", err)
+		}
+
+		// The next insert reuses the space the rolled back batch never wrote
+		if err := db.Insert("accounts", map[string]interface{}{"id": int64(4), "name": "kept"}); err != nil {
+			t.Fatalf("Failed to insert after rollback: %v", err)
+		}
+
+		rows, err = db.SelectAll("accounts")
+		if err != nil {
+			t.Fatalf("Failed to select: %v", err)
+		}
+		if len(rows) != 4 {
+			t.Fatalf("Expected 4 rows after rollback and insert, got %d", len(rows))
+		}
+		for _, row := range rows {
+			if row.Values["name"] == "rolled back" {
+				t.Fatalf("Found rolled back row %v", row.Values)
+			}
+		}
+	})
+
+	// Test: only committed data is on disk after reopening
+	t.Run("Reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+
+		count, err := db.GetRowCount("accounts")
+		if err != nil {
+			t.Fatalf("Failed to get row count: %v", err)
+		}
+		if count != 4 {
+			t.Fatalf("Expected 4 rows after reopen, got %d", count)
+		}
+	})
+
+	db.Close()
+}
@@ -3,8 +3,6 @@ package storageengine
 import (
 	"os"
 	"sync"
-
-	"github.com/google/btree"
 )
 
 type ColumnType byte
@@ -14,21 +12,58 @@ const (
 	Tstring
 	Tfloat
 	Tbool
+	TTimestamp // time.Time with nanosecond precision
+	TDate      // calendar date as a time.Time at midnight UTC
+	TBytes     // []byte
+	TDecimal   // exact decimal with the scale of the column, see Decimal
+	TUUID      // UUID
+	TJSON      // JSON document, see JSON
+	TArray     // list of values of the column's Elem type
+	TVector    // []float32 of the column's Dim, see NearestNeighbors
 )
 
 type Column struct {
-	Name    string
-	Type    ColumnType
-	NotNull bool
+	Name     string
+	Type     ColumnType
+	NotNull  bool
+	Scale    uint8          // digits after the decimal point of a TDecimal column, or of the elements of a TArray column
+	Elem     ColumnType     // type of the elements of a TArray column
+	Dim      uint16         // number of elements of a TVector column
+	Distance VectorDistance // distance NearestNeighbors ranks a TVector column's values by
+	Default  interface{}    // value of inserts that leave the column out, and of rows written before it was added
+	id       uint32         // position in the row layout, never reused within a table
+	added    uint32         // schema version that added the column
+	dropped  uint32         // schema version that dropped the column, 0 while it exists
 }
 
 type Table struct {
-	ID          uint32
-	Name        string
-	Columns     []Column
-	PK          string
-	FirstPageID uint64
-	LastPageID  uint64
+	ID            uint32
+	Name          string
+	Columns       []Column
+	PK            string
+	FirstPageID   uint64
+	LastPageID    uint64
+	NextRowID     uint64 // high-water mark, row IDs are never reused
+	RowIndexRoot  uint64 // root of the B+tree mapping row IDs to their newest version
+	Indexes       []Index
+	SchemaVersion uint32   // bumped by every change to the row layout, rows record the version they were written with
+	dropped       []Column // dropped columns that rows of older versions still hold
+	pageID        uint64   // page holding the table definition
+}
+
+// Index is an index over one or more columns, stored as a B+tree.
+// The primary key is kept as a unique index with Primary set.
+type Index struct {
+	Name       string
+	Columns    []string
+	Unique     bool
+	Primary    bool
+	Vector     bool // IVF index over a TVector column, see CreateVectorIndex
+	RootPageID uint64
+
+	centroids     [][]float32     // centers of a vector index's lists
+	centroidChain overflowPointer // chain of index pages the centroids are stored on
+	probes        int             // lists a vector index search reads
 }
 type PageType byte
 
@@ -37,8 +72,35 @@ const (
 	PTTable
 	PTData
 	PTIndex
+	PTMeta
+	PTCatalog  // continuation of a table definition
+	PTOverflow // part of a value stored out of line
 )
 
+// Every page starts with a common header:
+//
+//	[0]     page type
+//	[1:5]   table ID
+//	[5:7]   row count
+//	[7:15]  next page ID
+//	[15:17] free offset
+//	[17:21] CRC32C checksum of the page
+const pageHeaderSize = 21
+
+// pageReader reads pages as seen by a snapshot or a transaction
+type pageReader interface {
+	readPage(pageID uint64) (*Page, error)
+	unpinPage(page *Page)
+}
+
+// rowSource reads pages and tables and decides which row versions are
+// visible, as seen by a snapshot or a transaction
+type rowSource interface {
+	pageReader
+	visible(xmin, xmax uint64) bool
+	table(name string) (*Table, bool)
+}
+
 type Page struct {
 	ID   uint64
 	Data []byte
@@ -50,15 +112,18 @@ type PageHeader struct {
 	RowCount   uint16
 	nextPageID uint64
 	FreeOffset uint16
+	Checksum   uint32
 }
 
 type Row struct {
 	Values map[string]interface{}
 	RowID  uint64
 }
+
+// RowPtr addresses a row version by its page and its slot on the page
 type RowPtr struct {
 	PageID uint64
-	Offset uint16
+	Slot   uint16
 }
 
 type RowIndex struct {
@@ -67,21 +132,67 @@ type RowIndex struct {
 	Ptr     RowPtr
 }
 
-func (ri *RowIndex) Less(than btree.Item) bool {
-	other := than.(*RowIndex)
-	if ri.TableID != other.TableID {
-		return ri.TableID < other.TableID
-	}
-	return ri.RowID < other.RowID
+type Database struct {
+	file          *os.File
+	wal           *writeAheadLog
+	pool          *bufferPool
+	pageSize      int
+	corruptPages  CorruptPagePolicy
+	readOnly      bool     // opened with Options.ReadOnly, there is no WAL
+	closed        bool     // Close has been called
+	quarantined   []uint64 // corrupt pages skipped while opening
+	nextPageID    uint64
+	mu            sync.RWMutex
+	writer        sync.Mutex // held by the active transaction
+	tables        map[string]*Table
+	tableIDMap    map[string]*Table
+	nextTableID   uint32
+	nextTxID      uint64
+	lastCommitted uint64                 // newest committed transaction
+	snapshots     map[*snapshot]struct{} // snapshots held by active readers
+	garbage       map[uint64]uint64      // page ID -> newest xmax of its dead row versions
+	indexGarbage  []indexGarbage         // index entries of dead row versions
+	vacuumNext    string                 // table an incremental vacuum continues with
+	vacuumFrom    uint64                 // data page it continues from, 0 for the end of the table
+	stopPruner    chan struct{}
+	prunerDone    sync.WaitGroup
 }
 
-type Database struct {
-	file        *os.File
-	pageSize    int
-	nextPageID  uint64
-	mu          sync.RWMutex
-	tables      map[string]*Table
-	tableIDMap  map[string]*Table
-	rowIndices  map[string]*btree.BTree
-	nextTableID uint32
+// Tx is a write transaction. Its page and index changes stay private
+// until Commit, and Rollback simply throws them away.
+type Tx struct {
+	db           *Database
+	id           uint64
+	snapshotID   uint64 // newest transaction committed when the transaction began
+	horizon      uint64 // no snapshot reads pages freed at or before this transaction
+	pages        map[uint64]*Page
+	pageOrder    []uint64
+	tables       map[string]*Table
+	tableIDMap   map[string]*Table
+	nextPageID   uint64
+	nextTableID  uint32
+	garbage      map[uint64]uint64
+	indexGarbage []indexGarbage
+	freed        map[uint64]bool // pages the transaction added to the free list
+	done         bool
+}
+
+// indexGarbage is an index entry that stopped matching its row when
+// transaction xmax changed or deleted it. Older snapshots may still find the
+// row through it, so it is only removed once xmax is behind the horizon.
+type indexGarbage struct {
+	tableID uint32
+	index   string
+	key     []byte
+	xmax    uint64
+}
+
+// snapshot is a read view of the database as of the newest committed transaction.
+// Committed tables are never modified in place, and index entries a snapshot
+// may need are only removed once it is released, so holding on to the tables
+// is enough to keep the view stable while writers move on.
+type snapshot struct {
+	db     *Database
+	id     uint64
+	tables map[string]*Table
 }
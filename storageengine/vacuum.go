@@ -0,0 +1,827 @@
+package storageengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Vacuum compacts a table. Dead row versions are removed, live rows are moved
+// from the end of the table's chain of data pages into free space near its
+// start, index entries that no longer match their row are dropped, the pages
+// left empty are freed and the free pages at the end of the file are cut off.
+//
+// Readers are never blocked, writers wait while rows are moved. A row that
+// moves keeps its old copy until every snapshot that may still read it is
+// gone, so space held by open snapshots is only reclaimed by a later vacuum.
+func (db *Database) Vacuum(tableName string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	err := db.autocommit(func(tx *Tx) error {
+		table, exists := tx.tables[tableName]
+		if !exists {
+			return fmt.Errorf("table not found: %s", tableName)
+		}
+		if _, err := tx.vacuumTable(table, 0, 0); err != nil {
+			return err
+		}
+		return tx.vacuumIndexes(table)
+	})
+	if err != nil {
+		return err
+	}
+	return db.finishVacuum()
+}
+
+// VacuumAll compacts every table and then shrinks the file
+func (db *Database) VacuumAll() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	for _, name := range db.ListTables() {
+		err := db.autocommit(func(tx *Tx) error {
+			table, exists := tx.tables[name]
+			if !exists {
+				return nil // Dropped in the meantime
+			}
+			if _, err := tx.vacuumTable(table, 0, 0); err != nil {
+				return err
+			}
+			return tx.vacuumIndexes(table)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to vacuum table %s: %w", name, err)
+		}
+	}
+	return db.finishVacuum()
+}
+
+// VacuumStep does a bounded part of a vacuum of the whole database: it works
+// through at most pages data pages in a short transaction of its own, so
+// writers only ever wait for a moment. It remembers where it stopped and
+// reports whether there is work left; the step that finishes the last table
+// also shrinks the file. Call it repeatedly, e.g. from a background loop.
+func (db *Database) VacuumStep(pages int) (more bool, err error) {
+	if db.readOnly {
+		return false, ErrReadOnly
+	}
+	if pages <= 0 {
+		return false, fmt.Errorf("a vacuum step needs at least one page")
+	}
+
+	var finished bool
+	err = db.autocommit(func(tx *Tx) error {
+		names := make([]string, 0, len(tx.tables))
+		for name := range tx.tables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		// Continue with the table the last step stopped in, or the next one
+		i := sort.SearchStrings(names, db.vacuumNext)
+		from := db.vacuumFrom
+		if i == len(names) || names[i] != db.vacuumNext {
+			from = 0
+		}
+		if i == len(names) {
+			finished = true
+			return nil
+		}
+
+		table := tx.tables[names[i]]
+		next, err := tx.vacuumTable(table, from, pages)
+		if err != nil {
+			return err
+		}
+		if next != 0 {
+			db.vacuumNext, db.vacuumFrom = table.Name, next
+			return nil
+		}
+
+		if err := tx.vacuumIndexes(table); err != nil {
+			return err
+		}
+		if i+1 == len(names) {
+			finished = true
+			return nil
+		}
+		db.vacuumNext, db.vacuumFrom = names[i+1], 0
+		return nil
+	})
+	if err != nil {
+		return true, err
+	}
+
+	if !finished {
+		// Old copies of rows moved by this step go as soon as nobody reads them
+		return true, db.pruneVersions()
+	}
+	db.writer.Lock()
+	db.vacuumNext, db.vacuumFrom = "", 0
+	db.writer.Unlock()
+	return false, db.finishVacuum()
+}
+
+// finishVacuum reclaims the row copies left behind by moving rows, frees the
+// pages they leave empty, moves the pages in use at the end of the file into
+// free pages before them and cuts the free pages off the end of the file
+func (db *Database) finishVacuum() error {
+	if err := db.pruneVersions(); err != nil {
+		return err
+	}
+
+	// The pages this leaves behind are free by the time the file is cut
+	if err := db.autocommit((*Tx).packPages); err != nil {
+		return fmt.Errorf("failed to move pages off the end of the file: %w", err)
+	}
+
+	var cut bool
+	err := db.autocommit(func(tx *Tx) error {
+		dropped, err := tx.shrinkFreeTail()
+		cut = dropped > 0
+		return err
+	})
+	if err != nil || !cut {
+		return err
+	}
+	return db.truncateFile()
+}
+
+// truncateFile makes the file end at the last page in use
+func (db *Database) truncateFile() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	// Pages past the end may still be waiting in the pool or the log
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
+
+	db.mu.RLock()
+	nextPageID := db.nextPageID
+	db.mu.RUnlock()
+
+	db.pool.discard(nextPageID)
+	if err := db.file.Truncate(int64(nextPageID) * int64(db.pageSize)); err != nil {
+		return fmt.Errorf("failed to truncate database file: %w", err)
+	}
+	return db.file.Sync()
+}
+
+// packPages moves the pages in use at the end of the file into the lowest
+// free pages, so that the end of the file is left free. Whatever points at a
+// moved page is updated. Snapshots that still read the old page keep finding
+// it there, a freed page is only reused once nobody can read it.
+func (tx *Tx) packPages() error {
+	end, err := tx.sortFreeList()
+	if err != nil || end >= tx.nextPageID {
+		return err
+	}
+
+	metaPage, err := tx.readPage(metaPageID)
+	if err != nil {
+		return fmt.Errorf("failed to read meta page: %w", err)
+	}
+	meta, err := decodeMeta(metaPage)
+	tx.unpinPage(metaPage)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(tx.tables))
+	byPage := make(map[uint64]*Table, len(tx.tables))
+	for name, table := range tx.tables {
+		names = append(names, name)
+		byPage[table.pageID] = table
+	}
+	sort.Strings(names)
+
+	head, err := tx.moveChain(meta.catalogHead, end, func(pageID uint64) (uint64, error) {
+		newID, err := tx.movePage(pageID)
+		if table, ok := byPage[pageID]; ok {
+			table.pageID = newID
+		}
+		return newID, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move catalog: %w", err)
+	}
+	if head != meta.catalogHead {
+		err := tx.updateMeta(func(meta *dbMeta) {
+			meta.catalogHead = head
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		if err := tx.packTable(tx.tables[name], end); err != nil {
+			return fmt.Errorf("failed to move pages of table %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// packTable moves a table's pages at or past end: the rest of its
+// definition, its data pages and the overflow chains of their records, the
+// centroids of its vector indexes and the nodes of its trees
+func (tx *Tx) packTable(table *Table, end uint64) error {
+	page, err := tx.readPage(table.pageID)
+	if err != nil {
+		return fmt.Errorf("failed to read table page: %w", err)
+	}
+	first := binary.LittleEndian.Uint64(page.Data[tableDefNextOffset : tableDefNextOffset+8])
+	tx.unpinPage(page)
+
+	head, err := tx.moveChain(first, end, tx.movePage)
+	if err != nil {
+		return err
+	}
+	if head != first {
+		page, err := tx.modifyPage(table.pageID)
+		if err != nil {
+			return fmt.Errorf("failed to read table page: %w", err)
+		}
+		binary.LittleEndian.PutUint64(page.Data[tableDefNextOffset:tableDefNextOffset+8], head)
+		if err := tx.writePage(page); err != nil {
+			return err
+		}
+	}
+
+	moved := false
+	head, err = tx.moveChain(table.FirstPageID, end, func(pageID uint64) (uint64, error) {
+		newID, err := tx.moveDataPage(table, pageID)
+		if pageID == table.LastPageID {
+			table.LastPageID = newID
+		}
+		moved = true
+		return newID, err
+	})
+	if err != nil {
+		return err
+	}
+	table.FirstPageID = head
+
+	pageIDs, err := tx.dataPageIDs(table)
+	if err != nil {
+		return err
+	}
+	for _, pageID := range pageIDs {
+		if err := tx.moveOverflow(table, pageID, end); err != nil {
+			return err
+		}
+	}
+
+	for i := range table.Indexes {
+		index := &table.Indexes[i]
+		if index.centroidChain.pageID == 0 {
+			continue
+		}
+		head, err := tx.moveChain(index.centroidChain.pageID, end, tx.movePage)
+		if err != nil {
+			return fmt.Errorf("failed to move centroids of index %s: %w", index.Name, err)
+		}
+		if head != index.centroidChain.pageID {
+			index.centroidChain.pageID, moved = head, true
+		}
+	}
+
+	root, err := tx.moveBPTree(table.RowIndexRoot, end, tx.movePage)
+	if err != nil {
+		return fmt.Errorf("failed to move row index: %w", err)
+	}
+	if root != table.RowIndexRoot {
+		table.RowIndexRoot, moved = root, true
+	}
+	for i := range table.Indexes {
+		index := &table.Indexes[i]
+		root, err := tx.moveBPTree(index.RootPageID, end, tx.movePage)
+		if err != nil {
+			return fmt.Errorf("failed to move index %s: %w", index.Name, err)
+		}
+		if root != index.RootPageID {
+			index.RootPageID, moved = root, true
+		}
+	}
+
+	if !moved {
+		return nil
+	}
+	return tx.writeTablePage(table)
+}
+
+// moveChain moves the pages of a chain linked through the next page ID in
+// their header that lie at or past end, and links the chain up again. It
+// returns the first page of the chain, which is new if that page moved.
+func (tx *Tx) moveChain(first uint64, end uint64, move func(pageID uint64) (uint64, error)) (uint64, error) {
+	head, prev := first, uint64(0)
+	for pageID := first; pageID != 0; {
+		page, err := tx.readPage(pageID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read page %d: %w", pageID, err)
+		}
+		next := binary.LittleEndian.Uint64(page.Data[7:15])
+		tx.unpinPage(page)
+
+		if pageID >= end {
+			newID, err := move(pageID)
+			if err != nil {
+				return 0, err
+			}
+			if prev == 0 {
+				head = newID
+			} else {
+				page, err := tx.modifyPage(prev)
+				if err != nil {
+					return 0, fmt.Errorf("failed to read page %d: %w", prev, err)
+				}
+				binary.LittleEndian.PutUint64(page.Data[7:15], newID)
+				if err := tx.writePage(page); err != nil {
+					return 0, err
+				}
+			}
+			pageID = newID
+		}
+		prev, pageID = pageID, next
+	}
+	return head, nil
+}
+
+// movePage copies a page to a free page and frees the old one. The pruner
+// looks for dead row versions on the copy instead.
+func (tx *Tx) movePage(pageID uint64) (uint64, error) {
+	page, err := tx.readPage(pageID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read page %d: %w", pageID, err)
+	}
+	target, err := tx.newPage()
+	if err == nil {
+		copy(target.Data, page.Data)
+	}
+	tx.unpinPage(page)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.writePage(target); err != nil {
+		return 0, err
+	}
+
+	tx.db.mu.RLock()
+	xmax, ok := tx.db.garbage[pageID]
+	tx.db.mu.RUnlock()
+	if ok || tx.garbage[pageID] != 0 {
+		tx.garbage[target.ID] = max(xmax, tx.garbage[pageID])
+	}
+	return target.ID, tx.freePage(pageID)
+}
+
+// moveDataPage moves a data page and points the row index at the rows'
+// newest versions on the copy
+func (tx *Tx) moveDataPage(table *Table, pageID uint64) (uint64, error) {
+	newID, err := tx.movePage(pageID)
+	if err != nil {
+		return 0, err
+	}
+
+	page, err := tx.readPage(newID)
+	if err != nil {
+		return 0, err
+	}
+	rowIDs := make(map[uint16]uint64)
+	for slot := uint16(0); slot < slotCount(page); slot++ {
+		offset := slotOffset(page, slot)
+		if offset == 0 {
+			continue
+		}
+		record, err := readRowRecord(page, offset)
+		if err != nil {
+			tx.unpinPage(page)
+			return 0, err
+		}
+		rowIDs[slot] = record.rowID
+	}
+	tx.unpinPage(page)
+
+	for slot, rowID := range rowIDs {
+		key := rowKey(rowID)
+		var current uint64
+		err := bpScan(tx, table.RowIndexRoot, key, prefixEnd(key), func(_ []byte, value uint64) bool {
+			current = value
+			return false
+		})
+		if err != nil {
+			return 0, err
+		}
+		if current != (RowPtr{PageID: pageID, Slot: slot}).pack() {
+			continue // An older version
+		}
+		root, err := tx.bpInsert(table.RowIndexRoot, key, RowPtr{PageID: newID, Slot: slot}.pack())
+		if err != nil {
+			return 0, fmt.Errorf("failed to update row index: %w", err)
+		}
+		table.RowIndexRoot = root
+	}
+	return newID, nil
+}
+
+// moveOverflow moves the overflow pages at or past end that the records on a
+// data page point at, including those of older versions, and updates the
+// records' pointers
+func (tx *Tx) moveOverflow(table *Table, pageID uint64, end uint64) error {
+	page, err := tx.readPage(pageID)
+	if err != nil {
+		return fmt.Errorf("failed to read data page %d: %w", pageID, err)
+	}
+	count := slotCount(page)
+	tx.unpinPage(page)
+
+	for slot := uint16(0); slot < count; slot++ {
+		page, err := tx.readPage(pageID)
+		if err != nil {
+			return fmt.Errorf("failed to read data page %d: %w", pageID, err)
+		}
+		offset := slotOffset(page, slot)
+		var payload []byte
+		if offset != 0 {
+			var record rowRecord
+			record, err = readRowRecord(page, offset)
+			payload = append([]byte(nil), record.payload...)
+		}
+		tx.unpinPage(page)
+		if err != nil {
+			return err
+		}
+		if offset == 0 {
+			continue
+		}
+
+		version, layout, values, err := decodeRow(payload, table)
+		if err != nil {
+			return err
+		}
+		changed := false
+		for i, col := range layout {
+			ptr, ok := values[i].(overflowPointer)
+			if !ok {
+				continue
+			}
+			head, err := tx.moveChain(ptr.pageID, end, tx.movePage)
+			if err != nil {
+				return fmt.Errorf("column %s: %w", col.Name, err)
+			}
+			if head != ptr.pageID {
+				ptr.pageID = head
+				values[i], changed = ptr, true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		// Pointers have a fixed size, the record keeps its length
+		encoded, err := encodeRow(version, layout, values)
+		if err != nil {
+			return err
+		}
+		if len(encoded) != len(payload) {
+			return fmt.Errorf("row on page %d changed size when its overflow pages moved", pageID)
+		}
+		page, err = tx.modifyPage(pageID)
+		if err != nil {
+			return fmt.Errorf("failed to read data page %d: %w", pageID, err)
+		}
+		copy(page.Data[int(offset)+rowHeaderSize:], encoded)
+		if err := tx.writePage(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dataPageIDs returns a table's chain of data pages in order
+func (tx *Tx) dataPageIDs(table *Table) ([]uint64, error) {
+	var pageIDs []uint64
+	for pageID := table.FirstPageID; pageID != 0; {
+		page, err := tx.readPage(pageID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read data page %d: %w", pageID, err)
+		}
+		next := binary.LittleEndian.Uint64(page.Data[7:15])
+		tx.unpinPage(page)
+
+		pageIDs = append(pageIDs, pageID)
+		pageID = next
+	}
+	return pageIDs, nil
+}
+
+// vacuumTable moves live rows from the end of a table's chain of data pages
+// into free space on the pages at its start, working backwards from the page
+// from, or from the end of the chain if from is 0 or gone. Every page it
+// visits is pruned first. It stops after limit source pages, if limit is not 0,
+// and returns the page to continue from, or 0 once the table is compact.
+//
+// The page new rows are added to is never a source, and rows that older
+// snapshots may still see in an older version stay where they are.
+func (tx *Tx) vacuumTable(table *Table, from uint64, limit int) (uint64, error) {
+	pageIDs, err := tx.dataPageIDs(table)
+	if err != nil {
+		return 0, err
+	}
+	root := table.RowIndexRoot
+
+	source := len(pageIDs) - 2
+	for i, pageID := range pageIDs[:max(source+1, 0)] {
+		if pageID == from {
+			source = i
+		}
+	}
+
+	emptied := make(map[uint64]bool)
+	pruned := make(map[uint64]bool)
+	prune := func(pageID uint64) error {
+		if pruned[pageID] {
+			return nil
+		}
+		pruned[pageID] = true
+		empty, err := tx.prunePage(pageID, tx.horizon)
+		if empty {
+			emptied[pageID] = true
+		}
+		return err
+	}
+
+	target, visited := 0, 0
+	next := uint64(0)
+	for ; source > target; source-- {
+		if limit > 0 && visited == limit {
+			next = pageIDs[source]
+			break
+		}
+		visited++
+
+		if err := prune(pageIDs[source]); err != nil {
+			return 0, err
+		}
+		for slot := uint16(0); ; slot++ {
+			moved, last, err := tx.moveRow(table, pageIDs[source], slot, func(size int) (*Page, error) {
+				// Find the first page before the source with room for the row
+				for ; target < source; target++ {
+					if err := prune(pageIDs[target]); err != nil {
+						return nil, err
+					}
+					page, err := tx.modifyPage(pageIDs[target])
+					if err != nil {
+						return nil, err
+					}
+					if canHold(page, size) {
+						delete(emptied, page.ID)
+						return page, nil
+					}
+				}
+				return nil, nil
+			})
+			if err != nil {
+				return 0, err
+			}
+			if last || (!moved && target >= source) {
+				break
+			}
+		}
+	}
+
+	var release []uint64
+	for pageID := range emptied {
+		release = append(release, pageID)
+	}
+	if table.RowIndexRoot != root {
+		if err := tx.writeTablePage(table); err != nil {
+			return 0, err
+		}
+	}
+	return next, tx.releaseDataPages(release)
+}
+
+// moveRow moves the record in a slot to a page returned by place, if it is the
+// newest version of its row and every snapshot sees it. The old record is
+// marked deleted by the transaction, so snapshots that already found it keep
+// reading it until the pruner removes it. last reports that the slot is past
+// the end of the page.
+func (tx *Tx) moveRow(table *Table, pageID uint64, slot uint16, place func(size int) (*Page, error)) (moved, last bool, err error) {
+	page, err := tx.readPage(pageID)
+	if err != nil {
+		return false, false, err
+	}
+	if slot >= slotCount(page) {
+		tx.unpinPage(page)
+		return false, true, nil
+	}
+	offset := slotOffset(page, slot)
+	var record rowRecord
+	if offset != 0 {
+		record, err = readRowRecord(page, offset)
+		record.payload = append([]byte(nil), record.payload...)
+	}
+	tx.unpinPage(page)
+	if err != nil {
+		return false, false, err
+	}
+	if offset == 0 || record.xmax != 0 || record.xmin > tx.horizon {
+		return false, false, nil
+	}
+
+	// Only the version the row index points at is moved
+	ptr := RowPtr{PageID: pageID, Slot: slot}
+	key := rowKey(record.rowID)
+	var current uint64
+	err = bpScan(tx, table.RowIndexRoot, key, prefixEnd(key), func(_ []byte, value uint64) bool {
+		current = value
+		return false
+	})
+	if err != nil || current != ptr.pack() {
+		return false, false, err
+	}
+
+	// Copying the overflow chains keeps the size of the record
+	target, err := place(int(record.size()))
+	if err != nil || target == nil {
+		return false, false, err
+	}
+
+	// The old record keeps its overflow chains until it is pruned
+	payload, err := tx.copyOverflow(table, record.payload)
+	if err != nil {
+		return false, false, err
+	}
+
+	// Every snapshot sees this version, none of them follows its link to older ones
+	data := make([]byte, rowHeaderSize+len(payload))
+	binary.LittleEndian.PutUint16(data[0:2], uint16(len(payload)))
+	binary.LittleEndian.PutUint64(data[2:10], record.xmin)
+	binary.LittleEndian.PutUint64(data[18:26], record.rowID)
+	copy(data[rowHeaderSize:], payload)
+	newPtr := RowPtr{PageID: target.ID, Slot: insertRecord(target, data)}
+	if err := tx.writePage(target); err != nil {
+		return false, false, err
+	}
+
+	root, err := tx.bpInsert(table.RowIndexRoot, key, newPtr.pack())
+	if err != nil {
+		return false, false, fmt.Errorf("failed to update row index: %w", err)
+	}
+	table.RowIndexRoot = root
+
+	return true, false, tx.deleteRowVersion(ptr)
+}
+
+// copyOverflow gives a row's values stored out of line chains of their own.
+// The row keeps the schema version it was written with, older snapshots may
+// read the copy.
+func (tx *Tx) copyOverflow(table *Table, payload []byte) ([]byte, error) {
+	version, layout, values, err := decodeRow(payload, table)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := false
+	for i, col := range layout {
+		ptr, ok := values[i].(overflowPointer)
+		if !ok {
+			continue
+		}
+		data := make([]byte, 0, ptr.length)
+		err := walkOverflow(tx, ptr, func(_ uint64, part []byte) {
+			data = append(data, part...)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col.Name, err)
+		}
+		if values[i], err = tx.writeOverflow(table.ID, data); err != nil {
+			return nil, err
+		}
+		copied = true
+	}
+
+	if !copied {
+		return payload, nil
+	}
+	return encodeRow(version, layout, values)
+}
+
+// vacuumIndexes removes the secondary index entries that no snapshot can
+// need anymore, such as those the pruner lost track of in a crash. An entry
+// goes when its row is gone or when every snapshot sees a newest version of
+// the row with another key. Trees whose nodes were left half empty are then
+// written anew, which gives their pages back.
+func (tx *Tx) vacuumIndexes(table *Table) error {
+	for i := range table.Indexes {
+		index := &table.Indexes[i]
+
+		var stale [][]byte
+		var scanErr error
+		err := bpScan(tx, index.RootPageID, nil, nil, func(key []byte, _ uint64) bool {
+			keep, err := tx.indexEntryNeeded(table, index, key)
+			if err != nil {
+				scanErr = err
+				return false
+			}
+			if !keep {
+				stale = append(stale, append([]byte(nil), key...))
+			}
+			return true
+		})
+		if err == nil {
+			err = scanErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to scan index %s: %w", index.Name, err)
+		}
+
+		for _, key := range stale {
+			if err := tx.bpDelete(index.RootPageID, key); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.compactTrees(table)
+}
+
+// compactTrees writes the row index and the indexes of a table anew where
+// that saves pages, see compactBPTree
+func (tx *Tx) compactTrees(table *Table) error {
+	changed := false
+	root, err := tx.compactBPTree(table.RowIndexRoot)
+	if err != nil {
+		return fmt.Errorf("failed to compact row index: %w", err)
+	}
+	if root != table.RowIndexRoot {
+		table.RowIndexRoot, changed = root, true
+	}
+
+	for i := range table.Indexes {
+		index := &table.Indexes[i]
+		root, err := tx.compactBPTree(index.RootPageID)
+		if err != nil {
+			return fmt.Errorf("failed to compact index %s: %w", index.Name, err)
+		}
+		if root != index.RootPageID {
+			index.RootPageID, changed = root, true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return tx.writeTablePage(table)
+}
+
+// indexEntryNeeded reports whether a snapshot may still find a row through an index entry
+func (tx *Tx) indexEntryNeeded(table *Table, index *Index, key []byte) (bool, error) {
+	rowID := indexKeyRowID(key)
+	rowKey := rowKey(rowID)
+
+	var value uint64
+	var found bool
+	err := bpScan(tx, table.RowIndexRoot, rowKey, prefixEnd(rowKey), func(_ []byte, v uint64) bool {
+		value, found = v, true
+		return false
+	})
+	if err != nil || !found {
+		return false, err
+	}
+
+	ptr := unpackRowPtr(value)
+	page, err := tx.readPage(ptr.PageID)
+	if err != nil {
+		return false, err
+	}
+	record, err := readSlot(page, ptr.Slot)
+	var row *Row
+	if err == nil {
+		row, err = tx.db.deserializeRow(record.payload, table)
+	}
+	tx.unpinPage(page)
+	if err != nil {
+		return false, err
+	}
+
+	// A snapshot may still see an older version with this key
+	if record.xmin > tx.horizon || (record.xmax != 0 && record.xmax > tx.horizon) {
+		return true, nil
+	}
+	if record.xmax != 0 {
+		return false, nil // Deleted for everybody
+	}
+
+	if err := tx.db.loadOverflow(tx, table, row); err != nil {
+		return false, err
+	}
+	current, err := indexKey(table, index, row.Values, rowID)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(current, key), nil
+}
@@ -0,0 +1,409 @@
+package storageengine
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestVacuum tests that vacuum packs live rows together and gives the space back to the file
+func TestVacuum(t *testing.T) {
+	dbPath := "vacuum_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+		{Name: "body", Type: Tstring, NotNull: false},
+	}
+	for _, name := range []string{"items", "notes"} {
+		if err := db.CreateTable(name, columns, "id"); err != nil {
+			t.Fatalf("Failed to create table %s: %v", name, err)
+		}
+		if err := db.CreateIndex(name, name+"_name", []string{"name"}, false); err != nil {
+			t.Fatalf("Failed to create index on %s: %v", name, err)
+		}
+	}
+
+	// fill inserts rows from..to into a table, every tenth with a body stored out of line
+	fill := func(t *testing.T, table string, from, to int) {
+		t.Helper()
+		for i := from; i <= to; i++ {
+			values := map[string]interface{}{
+				"id":   int64(i),
+				"name": fmt.Sprintf("%s %d %s", table, i, strings.Repeat("x", 100)),
+			}
+			if i%10 == 0 {
+				values["body"] = strings.Repeat(fmt.Sprint(i), 1000)
+			}
+			if err := db.Insert(table, values); err != nil {
+				t.Fatalf("Failed to insert row %d into %s: %v", i, table, err)
+			}
+		}
+	}
+
+	// keep says which rows survive the deletes
+	keep := func(id int64) bool {
+		return id%7 == 0
+	}
+
+	// checkRows verifies that exactly the kept rows are there, also through the index
+	checkRows := func(t *testing.T, table string, n int) {
+		t.Helper()
+		rows, err := db.SelectAll(table)
+		if err != nil {
+			t.Fatalf("Failed to select from %s: %v", table, err)
+		}
+		if len(rows) != n/7 {
+			t.Fatalf("Expected %d rows in %s, got %d", n/7, table, len(rows))
+		}
+		for _, row := range rows {
+			id := row.Values["id"].(int64)
+			if !keep(id) {
+				t.Fatalf("Expected row %d of %s to be deleted", id, table)
+			}
+			if id%10 == 0 && row.Values["body"] != strings.Repeat(fmt.Sprint(id), 1000) {
+				t.Fatalf("Expected row %d of %s to keep its body", id, table)
+			}
+
+			found, err := db.SelectWhere(table, "name", "=", row.Values["name"])
+			if err != nil || len(found) != 1 || found[0].Values["id"] != id {
+				t.Fatalf("Expected to find row %d of %s through its index, got %v, %v", id, table, found, err)
+			}
+		}
+	}
+
+	checkOK := func(t *testing.T) {
+		t.Helper()
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Failed to check database: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("Expected no problems, got %v", report.Problems)
+		}
+	}
+
+	fileSize := func(t *testing.T) int64 {
+		t.Helper()
+		info, err := os.Stat(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to stat database file: %v", err)
+		}
+		return info.Size()
+	}
+
+	// thin deletes most rows of a table, leaving live rows on every page
+	thin := func(t *testing.T, table string) {
+		t.Helper()
+		if _, err := db.Delete(table, func(row *Row) bool {
+			return !keep(row.Values["id"].(int64))
+		}); err != nil {
+			t.Fatalf("Failed to delete from %s: %v", table, err)
+		}
+	}
+
+	// Test: a table vacuum moves the rows of a thinned table onto fewer pages
+	t.Run("Table", func(t *testing.T) {
+		fill(t, "items", 1, 700)
+		thin(t, "items")
+		if err := db.pruneVersions(); err != nil {
+			t.Fatalf("Failed to prune: %v", err)
+		}
+		if err := db.checkpoint(); err != nil {
+			t.Fatalf("Failed to checkpoint: %v", err)
+		}
+		before := len(dataPages(t, db, "items"))
+		size := fileSize(t)
+
+		if err := db.Vacuum("items"); err != nil {
+			t.Fatalf("Failed to vacuum: %v", err)
+		}
+
+		if after := len(dataPages(t, db, "items")); after >= before/2 {
+			t.Fatalf("Expected vacuum to at least halve the %d data pages, got %d", before, after)
+		}
+		if got := fileSize(t); got > size/4 {
+			t.Fatalf("Expected the file to shrink to a quarter of %d bytes, got %d", size, got)
+		}
+		// Only the page the free list keeps for itself is left over
+		if free := freePages(t, db); free > 1 {
+			t.Fatalf("Expected at most 1 free page left in the file, got %d", free)
+		}
+		checkRows(t, "items", 700)
+		checkOK(t)
+
+		if err := db.Vacuum("missing"); err == nil {
+			t.Fatal("Expected an error vacuuming a missing table")
+		}
+	})
+
+	// Test: a snapshot taken before the vacuum still reads the rows it moved
+	t.Run("Snapshot", func(t *testing.T) {
+		fill(t, "notes", 1, 700)
+		thin(t, "notes")
+		if err := db.pruneVersions(); err != nil {
+			t.Fatalf("Failed to prune: %v", err)
+		}
+
+		snap := db.acquireSnapshot()
+		if err := db.VacuumAll(); err != nil {
+			db.releaseSnapshot(snap)
+			t.Fatalf("Failed to vacuum: %v", err)
+		}
+		rows, err := db.scanRows(snap, snap.tables["notes"], nil)
+		db.releaseSnapshot(snap)
+		if err != nil {
+			t.Fatalf("Failed to scan snapshot: %v", err)
+		}
+		if len(rows) != 100 {
+			t.Fatalf("Expected the snapshot to see 100 rows, got %d", len(rows))
+		}
+
+		// The copies the snapshot read are reclaimed by the next vacuum
+		if err := db.VacuumAll(); err != nil {
+			t.Fatalf("Failed to vacuum: %v", err)
+		}
+		checkRows(t, "notes", 700)
+		checkOK(t)
+	})
+
+	// Test: incremental steps reach the same result a few pages at a time
+	t.Run("Step", func(t *testing.T) {
+		fill(t, "items", 701, 1400)
+		thin(t, "items")
+		if err := db.pruneVersions(); err != nil {
+			t.Fatalf("Failed to prune: %v", err)
+		}
+		before := len(dataPages(t, db, "items"))
+
+		steps := 0
+		for more := true; more; steps++ {
+			if more, err = db.VacuumStep(2); err != nil {
+				t.Fatalf("Failed to vacuum step %d: %v", steps, err)
+			}
+
+			// Writers get in between steps
+			if err := db.UpdateByID("notes", 7, map[string]interface{}{"body": fmt.Sprint(steps)}); err != nil {
+				t.Fatalf("Failed to update between steps: %v", err)
+			}
+		}
+		if steps < 3 {
+			t.Fatalf("Expected the vacuum to take several steps, took %d", steps)
+		}
+
+		if after := len(dataPages(t, db, "items")); after >= before/2 {
+			t.Fatalf("Expected vacuum to at least halve the %d data pages, got %d", before, after)
+		}
+		checkRows(t, "items", 1400)
+		checkOK(t)
+
+		if _, err := db.VacuumStep(0); err == nil {
+			t.Fatal("Expected an error for a step of no pages")
+		}
+	})
+
+	// Test: the vacuumed file opens again
+	t.Run("Reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+		checkRows(t, "items", 1400)
+		checkRows(t, "notes", 700)
+		checkOK(t)
+	})
+}
+
+// freePages returns the number of free pages in the file, trunks of the free list included
+func freePages(t *testing.T, db *Database) int {
+	t.Helper()
+	tx := db.Begin()
+	defer tx.Rollback()
+
+	trunks, entries, err := tx.readFreeList()
+	if err != nil {
+		t.Fatalf("Failed to read free list: %v", err)
+	}
+	return len(trunks) + len(entries)
+}
+
+// dataPages returns the chain of data pages of a table
+func dataPages(t *testing.T, db *Database, table string) []uint64 {
+	t.Helper()
+	tx := db.Begin()
+	defer tx.Rollback()
+
+	pageIDs, err := tx.dataPageIDs(tx.tables[table])
+	if err != nil {
+		t.Fatalf("Failed to read data pages of %s: %v", table, err)
+	}
+	return pageIDs
+}
+
+// TestVacuumShrinksFile tests that vacuum gives back the pages of rows and
+// index entries deleted in bulk, leaving a file about as small as a fresh one
+func TestVacuumShrinksFile(t *testing.T) {
+	dbPath := "vacuum_shrink_test.db"
+	freshPath := "vacuum_fresh_test.db"
+	for _, path := range []string{dbPath, freshPath} {
+		defer os.Remove(path)
+		defer os.Remove(path + "-wal")
+	}
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+		{Name: "body", Type: Tstring, NotNull: false},
+	}
+	keep := func(id int64) bool {
+		return id%200 == 0
+	}
+
+	// create makes a database with an indexed table holding the given rows,
+	// every fourth kept row with a body stored out of line
+	create := func(t *testing.T, path string, ids func(yield func(int64) bool)) *Database {
+		t.Helper()
+		db, err := NewDatabase(path, 4096)
+		if err != nil {
+			t.Fatalf("Failed to create database: %v", err)
+		}
+		if err := db.CreateTable("events", columns, "id"); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+		if err := db.CreateIndex("events", "events_name", []string{"name"}, false); err != nil {
+			t.Fatalf("Failed to create index: %v", err)
+		}
+
+		tx := db.Begin()
+		for id := range ids {
+			values := map[string]interface{}{
+				"id":   id,
+				"name": fmt.Sprintf("event %d %s", id, strings.Repeat("x", 100)),
+			}
+			if id%800 == 0 {
+				values["body"] = strings.Repeat(fmt.Sprint(id), 1000)
+			}
+			if err := tx.Insert("events", values); err != nil {
+				tx.Rollback()
+				t.Fatalf("Failed to insert row %d: %v", id, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Failed to commit rows: %v", err)
+		}
+		return db
+	}
+
+	fileSize := func(t *testing.T, path string) int64 {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat database file: %v", err)
+		}
+		return info.Size()
+	}
+
+	db := create(t, dbPath, func(yield func(int64) bool) {
+		for id := int64(1); id <= 20000 && yield(id); id++ {
+		}
+	})
+	defer func() { db.Close() }()
+
+	if _, err := db.Delete("events", func(row *Row) bool {
+		return !keep(row.Values["id"].(int64))
+	}); err != nil {
+		t.Fatalf("Failed to delete rows: %v", err)
+	}
+	if err := db.checkpoint(); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	before := fileSize(t, dbPath)
+
+	if err := db.VacuumAll(); err != nil {
+		t.Fatalf("Failed to vacuum: %v", err)
+	}
+
+	fresh := create(t, freshPath, func(yield func(int64) bool) {
+		for id := int64(200); id <= 20000 && yield(id); id += 200 {
+		}
+	})
+	if err := fresh.Close(); err != nil {
+		t.Fatalf("Failed to close fresh database: %v", err)
+	}
+	want := fileSize(t, freshPath)
+
+	got := fileSize(t, dbPath)
+	if got > want+4*4096 {
+		t.Fatalf("Expected the vacuumed file of %d bytes to be within 4 pages of a fresh one of %d bytes, got %d", before, want, got)
+	}
+
+	// Another vacuum finds nothing left to give back
+	if err := db.VacuumAll(); err != nil {
+		t.Fatalf("Failed to vacuum again: %v", err)
+	}
+	if again := fileSize(t, dbPath); again > got {
+		t.Fatalf("Expected a second vacuum to keep the file at %d bytes, got %d", got, again)
+	}
+
+	checkRows := func(t *testing.T) {
+		t.Helper()
+		rows, err := db.SelectAll("events")
+		if err != nil {
+			t.Fatalf("Failed to select rows: %v", err)
+		}
+		if len(rows) != 100 {
+			t.Fatalf("Expected 100 rows, got %d", len(rows))
+		}
+		for _, row := range rows {
+			id := row.Values["id"].(int64)
+			if !keep(id) {
+				t.Fatalf("Expected row %d to be deleted", id)
+			}
+			if id%800 == 0 && row.Values["body"] != strings.Repeat(fmt.Sprint(id), 1000) {
+				t.Fatalf("Expected row %d to keep its body", id)
+			}
+			found, err := db.SelectWhere("events", "name", "=", row.Values["name"])
+			if err != nil || len(found) != 1 || found[0].Values["id"] != id {
+				t.Fatalf("Expected to find row %d through its index, got %v, %v", id, found, err)
+			}
+			byPK, err := db.SelectByPK("events", id)
+			if err != nil || byPK.Values["id"] != id {
+				t.Fatalf("Expected to find row %d by its primary key, got %v, %v", id, byPK, err)
+			}
+		}
+
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Failed to check database: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("Expected no problems, got %v", report.Problems)
+		}
+	}
+	checkRows(t)
+
+	// The moved pages are found again after a restart
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	var err error
+	if db, err = NewDatabase(dbPath, 4096); err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	checkRows(t)
+	if err := db.Insert("events", map[string]interface{}{"id": int64(20001), "name": "after"}); err != nil {
+		t.Fatalf("Failed to insert after vacuum: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package storageengine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Values of the newer column types are read back as these Go types:
+//
+//	TTimestamp  time.Time in UTC, with nanosecond precision
+//	TDate       time.Time at midnight UTC
+//	TBytes      []byte
+//	TDecimal    Decimal with the scale of the column
+//	TUUID       UUID
+//	TJSON       JSON
+//	TArray      []interface{} of the element type's values
+//	TVector     []float32
+//
+// Writes also accept a few other forms, see the to* conversions below.
+
+// Timestamps are stored as nanoseconds since the Unix epoch, which covers
+// the years 1678 to 2262
+var (
+	minTimestamp = time.Unix(0, math.MinInt64)
+	maxTimestamp = time.Unix(0, math.MaxInt64)
+)
+
+// toTimestamp returns a time as UTC nanoseconds since the Unix epoch
+func toTimestamp(value interface{}) (int64, error) {
+	t, ok := value.(time.Time)
+	if !ok {
+		return 0, fmt.Errorf("expected time.Time value")
+	}
+	if t.Before(minTimestamp) || t.After(maxTimestamp) {
+		return 0, fmt.Errorf("timestamp %v is outside of the years 1678 to 2262", t)
+	}
+	return t.UnixNano(), nil
+}
+
+// fromTimestamp returns the time of a stored timestamp
+func fromTimestamp(nanos int64) time.Time {
+	return time.Unix(0, nanos).UTC()
+}
+
+// toDate returns the calendar date of a time, in its own location, as days
+// since the Unix epoch
+func toDate(value interface{}) (int32, error) {
+	t, ok := value.(time.Time)
+	if !ok {
+		return 0, fmt.Errorf("expected time.Time value")
+	}
+	year, month, day := t.Date()
+	days := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60)
+	if days < math.MinInt32 || days > math.MaxInt32 {
+		return 0, fmt.Errorf("date %v is out of range", t)
+	}
+	return int32(days), nil
+}
+
+// fromDate returns midnight UTC of a stored date
+func fromDate(days int32) time.Time {
+	return time.Unix(int64(days)*24*60*60, 0).UTC()
+}
+
+// maxDecimalScale bounds the digits after the decimal point of a TDecimal
+// column, so one unit still fits an int64
+const maxDecimalScale = 18
+
+// Decimal is an exact decimal number with the value Coef × 10^-Scale, for
+// amounts such as money that floats cannot hold exactly
+type Decimal struct {
+	Coef  int64
+	Scale uint8
+}
+
+// NewDecimal returns the decimal coef × 10^-scale
+func NewDecimal(coef int64, scale uint8) Decimal {
+	return Decimal{Coef: coef, Scale: scale}
+}
+
+// ParseDecimal parses a decimal such as "-12.50". The scale is the number of
+// digits after the point.
+func ParseDecimal(s string) (Decimal, error) {
+	digits := strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	whole, frac, _ := strings.Cut(digits, ".")
+	if whole == "" && frac == "" || len(frac) > maxDecimalScale || strings.ContainsAny(whole+frac, "+-") {
+		return Decimal{}, fmt.Errorf("invalid decimal: %q", s)
+	}
+
+	coef, ok := new(big.Int).SetString(whole+frac, 10)
+	if !ok {
+		return Decimal{}, fmt.Errorf("invalid decimal: %q", s)
+	}
+	if strings.HasPrefix(s, "-") {
+		coef.Neg(coef)
+	}
+	if !coef.IsInt64() {
+		return Decimal{}, fmt.Errorf("decimal %s is out of range", s)
+	}
+	return Decimal{Coef: coef.Int64(), Scale: uint8(len(frac))}, nil
+}
+
+// String formats the decimal with all of its scale's digits
+func (d Decimal) String() string {
+	s := new(big.Int).Abs(big.NewInt(d.Coef)).String()
+	if d.Scale > 0 {
+		if len(s) <= int(d.Scale) {
+			s = strings.Repeat("0", int(d.Scale)-len(s)+1) + s
+		}
+		s = s[:len(s)-int(d.Scale)] + "." + s[len(s)-int(d.Scale):]
+	}
+	if d.Coef < 0 {
+		return "-" + s
+	}
+	return s
+}
+
+// Cmp compares two decimals by value, whatever their scale:
+// -1 if d < other, 0 if they are equal, 1 if d > other
+func (d Decimal) Cmp(other Decimal) int {
+	return d.rat().Cmp(other.rat())
+}
+
+func (d Decimal) rat() *big.Rat {
+	denom := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d.Scale)), nil)
+	return new(big.Rat).SetFrac(big.NewInt(d.Coef), denom)
+}
+
+// toDecimal returns a decimal as a coefficient with the given scale. Values
+// with more digits after the point are rejected rather than rounded.
+func toDecimal(value interface{}, scale uint8) (int64, error) {
+	var d Decimal
+	switch v := value.(type) {
+	case Decimal:
+		d = v
+	case string:
+		var err error
+		if d, err = ParseDecimal(v); err != nil {
+			return 0, err
+		}
+	default:
+		// Floats are not exact, only whole numbers are taken as they are
+		if _, isFloat := value.(float64); isFloat {
+			return 0, fmt.Errorf("expected decimal value")
+		}
+		n, ok := toInt64(value)
+		if !ok {
+			return 0, fmt.Errorf("expected decimal value")
+		}
+		d = Decimal{Coef: n}
+	}
+
+	coef := new(big.Rat).Mul(d.rat(), new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)))
+	if !coef.IsInt() {
+		return 0, fmt.Errorf("decimal %s has more than %d digits after the point", d, scale)
+	}
+	if !coef.Num().IsInt64() {
+		return 0, fmt.Errorf("decimal %s is out of range for a scale of %d", d, scale)
+	}
+	return coef.Num().Int64(), nil
+}
+
+// UUID is a 128-bit universally unique identifier
+type UUID [16]byte
+
+// NewUUID returns a random (version 4) UUID
+func NewUUID() (UUID, error) {
+	var u UUID
+	if _, err := rand.Read(u[:]); err != nil {
+		return UUID{}, err
+	}
+	u[6] = u[6]&0x0F | 0x40
+	u[8] = u[8]&0x3F | 0x80
+	return u, nil
+}
+
+// ParseUUID parses a UUID in its canonical form, such as
+// "123e4567-e89b-12d3-a456-426614174000"
+func ParseUUID(s string) (UUID, error) {
+	var u UUID
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return UUID{}, fmt.Errorf("invalid UUID: %q", s)
+	}
+	digits := s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:36]
+	if _, err := hex.Decode(u[:], []byte(digits)); err != nil {
+		return UUID{}, fmt.Errorf("invalid UUID: %q", s)
+	}
+	return u, nil
+}
+
+// String formats the UUID in its canonical form
+func (u UUID) String() string {
+	s := hex.EncodeToString(u[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+// toUUID accepts a UUID, its 16 bytes or its canonical string form
+func toUUID(value interface{}) (UUID, error) {
+	switch v := value.(type) {
+	case UUID:
+		return v, nil
+	case [16]byte:
+		return UUID(v), nil
+	case string:
+		return ParseUUID(v)
+	}
+	return UUID{}, fmt.Errorf("expected UUID value")
+}
+
+// checkColumnType checks the type of a new column
+func checkColumnType(col Column) error {
+	if col.Type > TVector {
+		return fmt.Errorf("column %s has unknown type %d", col.Name, col.Type)
+	}
+	if col.Type == TArray && (col.Elem == TJSON || col.Elem >= TArray) {
+		return fmt.Errorf("array column %s cannot hold elements of type %d", col.Name, col.Elem)
+	}
+	if (col.Type == TDecimal || col.Type == TArray && col.Elem == TDecimal) && col.Scale > maxDecimalScale {
+		return fmt.Errorf("column %s has a scale of %d, the maximum is %d", col.Name, col.Scale, maxDecimalScale)
+	}
+	if col.Type == TVector && col.Dim == 0 {
+		return fmt.Errorf("vector column %s needs at least one dimension", col.Name)
+	}
+	if col.Type == TVector && col.Distance > CosineDistance {
+		return fmt.Errorf("vector column %s has unknown distance %d", col.Name, col.Distance)
+	}
+	return nil
+}
+
+// normalizeValue checks a value for a column and converts it to the Go type
+// the column's values are read back as
+func normalizeValue(col Column, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if err := validateValueType(value, col); err != nil {
+		return nil, err
+	}
+
+	data, err := appendValue(nil, col, value)
+	if err != nil {
+		return nil, err
+	}
+	val, _, err := readValue(data, col)
+	return val, err
+}
@@ -0,0 +1,287 @@
+package storageengine
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestValueTypes tests storing, indexing and comparing timestamps, dates, bytes, decimals and UUIDs
+func TestValueTypes(t *testing.T) {
+	dbPath := "values_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "created", Type: TTimestamp, NotNull: true},
+		{Name: "day", Type: TDate},
+		{Name: "data", Type: TBytes},
+		{Name: "price", Type: TDecimal, Scale: 2, Default: "0.00"},
+		{Name: "ref", Type: TUUID},
+		{Name: "attachment", Type: TBytes},
+	}
+	if err := db.CreateTable("orders", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	base := time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.FixedZone("CET", 3600))
+	refs := make([]UUID, 20)
+	for i := range refs {
+		if refs[i], err = NewUUID(); err != nil {
+			t.Fatalf("Failed to generate UUID: %v", err)
+		}
+	}
+	for i := 1; i <= 20; i++ {
+		values := map[string]interface{}{
+			"id":      int64(i),
+			"created": base.Add(time.Duration(i) * time.Hour),
+			"day":     base.AddDate(0, 0, i%5),
+			"data":    []byte{byte(i), 0x00, byte(i)},
+			"price":   NewDecimal(int64(i)*125, 1), // 12.5 per id
+			"ref":     refs[i-1],
+		}
+		if i == 20 {
+			values["attachment"] = bytes.Repeat([]byte{0xAB}, 3000) // stored out of line
+		}
+		if err := db.Insert("orders", values); err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+
+	checkOK := func(t *testing.T) {
+		t.Helper()
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Failed to check database: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("Expected no problems, got %v", report.Problems)
+		}
+	}
+
+	// checkRow verifies that a row reads back with the Go types of its columns
+	checkRow := func(t *testing.T, row *Row) {
+		t.Helper()
+		id := row.Values["id"].(int64)
+		created, ok := row.Values["created"].(time.Time)
+		if !ok || !created.Equal(base.Add(time.Duration(id)*time.Hour)) || created.Location() != time.UTC {
+			t.Fatalf("Expected row %d to read its timestamp in UTC, got %v", id, row.Values["created"])
+		}
+		if day := row.Values["day"]; day != time.Date(2024, 3, 1+int(id%5), 0, 0, 0, 0, time.UTC) {
+			t.Fatalf("Expected row %d to read its date at midnight UTC, got %v", id, day)
+		}
+		if price := row.Values["price"]; price != NewDecimal(id*1250, 2) {
+			t.Fatalf("Expected row %d to read its price at the column scale, got %v", id, price)
+		}
+		if ref := row.Values["ref"]; ref != refs[id-1] {
+			t.Fatalf("Expected row %d to read its UUID, got %v", id, ref)
+		}
+		data, ok := row.Values["data"].([]byte)
+		if !ok || !bytes.Equal(data, []byte{byte(id), 0x00, byte(id)}) {
+			t.Fatalf("Expected row %d to read its bytes, got %v", id, row.Values["data"])
+		}
+		if attachment, _ := row.Values["attachment"].([]byte); id == 20 && !bytes.Equal(attachment, bytes.Repeat([]byte{0xAB}, 3000)) {
+			t.Fatalf("Expected row %d to read its bytes stored out of line, got %d bytes", id, len(attachment))
+		}
+	}
+
+	// query runs a SelectWhere and checks the number of rows it returns
+	query := func(t *testing.T, column, op string, value interface{}, want int) {
+		t.Helper()
+		rows, err := db.SelectWhere("orders", column, op, value)
+		if err != nil {
+			t.Fatalf("Failed to select %s %s %v: %v", column, op, value, err)
+		}
+		if len(rows) != want {
+			t.Fatalf("Expected %d rows where %s %s %v, got %d", want, column, op, value, len(rows))
+		}
+		for _, row := range rows {
+			checkRow(t, row)
+		}
+	}
+
+	// queries is run with and without indexes on the columns
+	queries := func(t *testing.T) {
+		t.Helper()
+		query(t, "created", ">", base.Add(15*time.Hour), 5)
+		query(t, "created", "=", base.Add(3*time.Hour).UTC(), 1)
+		query(t, "day", "=", time.Date(2024, 3, 3, 23, 59, 0, 0, time.UTC), 4)
+		query(t, "day", "<", time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC), 8)
+		query(t, "data", "=", []byte{7, 0, 7}, 1)
+		query(t, "data", ">=", []byte{19}, 2)
+		query(t, "attachment", "=", bytes.Repeat([]byte{0xAB}, 3000), 1)
+		query(t, "price", "<=", "50", 4)
+		query(t, "price", ">", NewDecimal(23750, 2), 1)
+		query(t, "price", "=", 25, 1)
+		query(t, "ref", "=", refs[4].String(), 1)
+		query(t, "ref", "!=", refs[4], 19)
+	}
+
+	// Test: values read back as their Go types and compare by value
+	t.Run("Scan", func(t *testing.T) {
+		rows, err := db.SelectAll("orders")
+		if err != nil || len(rows) != 20 {
+			t.Fatalf("Expected 20 rows, got %d, %v", len(rows), err)
+		}
+		for _, row := range rows {
+			checkRow(t, row)
+		}
+		queries(t)
+		checkOK(t)
+	})
+
+	// Test: indexes on the new types give the same answers as scans
+	t.Run("Index", func(t *testing.T) {
+		for _, column := range []string{"created", "day", "data", "price", "ref"} {
+			if err := db.CreateIndex("orders", "orders_"+column, []string{column}, false); err != nil {
+				t.Fatalf("Failed to create index on %s: %v", column, err)
+			}
+		}
+		queries(t)
+
+		if err := db.CreateIndex("orders", "orders_ref_unique", []string{"ref"}, true); err != nil {
+			t.Fatalf("Failed to create unique index: %v", err)
+		}
+		err := db.Insert("orders", map[string]interface{}{"id": int64(21), "created": base, "ref": refs[0].String()})
+		if err == nil {
+			t.Fatal("Expected a duplicate UUID to be rejected")
+		}
+		checkOK(t)
+	})
+
+	// Test: values of the wrong type or out of range are rejected
+	t.Run("Invalid", func(t *testing.T) {
+		invalid := map[string]interface{}{
+			"created": "2024-03-01",
+			"day":     int64(19000),
+			"data":    "text",
+			"price":   1.5,
+			"ref":     "not-a-uuid",
+		}
+		for column, value := range invalid {
+			values := map[string]interface{}{"id": int64(30), "created": base, column: value}
+			if err := db.Insert("orders", values); err == nil {
+				t.Fatalf("Expected %v to be rejected for column %s", value, column)
+			}
+		}
+
+		values := map[string]interface{}{"id": int64(30), "created": base, "price": "1.005"}
+		if err := db.Insert("orders", values); err == nil {
+			t.Fatal("Expected a decimal with more digits than the scale to be rejected")
+		}
+		values = map[string]interface{}{"id": int64(30), "created": time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC)}
+		if err := db.Insert("orders", values); err == nil {
+			t.Fatal("Expected a timestamp past 2262 to be rejected")
+		}
+		if _, err := db.SelectWhere("orders", "created", ">", 5); err == nil {
+			t.Fatal("Expected a query value of the wrong type to be rejected")
+		}
+		err := db.AddColumn("orders", Column{Name: "tax", Type: TDecimal, Scale: maxDecimalScale + 1})
+		if err == nil {
+			t.Fatal("Expected a scale above the maximum to be rejected")
+		}
+
+		// Floats of any size are accepted by integer columns only when they are whole
+		if err := db.CreateTable("counters", []Column{{Name: "n", Type: TInteger}}, ""); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+		if err := db.Insert("counters", map[string]interface{}{"n": float32(3)}); err != nil {
+			t.Fatalf("Failed to insert a whole float32: %v", err)
+		}
+		if err := db.Insert("counters", map[string]interface{}{"n": float32(3.5)}); err == nil {
+			t.Fatal("Expected a fractional float32 to be rejected")
+		}
+		for _, value := range []interface{}{uint64(math.MaxUint64), float64(1 << 63), math.Inf(1), math.NaN()} {
+			if err := db.Insert("counters", map[string]interface{}{"n": value}); err == nil {
+				t.Fatalf("Expected %v to be rejected rather than wrapped", value)
+			}
+		}
+		if _, err := db.SelectByPK("orders", 2.5); err == nil {
+			t.Fatal("Expected a fractional primary key to be rejected rather than truncated")
+		}
+		if rows, err := db.SelectWhere("counters", "n", "=", int64(3)); err != nil || len(rows) != 1 {
+			t.Fatalf("Expected the float32 to read back as 3, got %d rows, %v", len(rows), err)
+		}
+		checkOK(t)
+	})
+
+	// Test: the column types, scale and defaults survive reopening
+	t.Run("Reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+		queries(t)
+
+		if err := db.Insert("orders", map[string]interface{}{"id": int64(40), "created": base}); err != nil {
+			t.Fatalf("Failed to insert without a price: %v", err)
+		}
+		row, err := db.SelectByPK("orders", int64(40))
+		if err != nil {
+			t.Fatalf("Failed to select row: %v", err)
+		}
+		if row.Values["price"] != NewDecimal(0, 2) {
+			t.Fatalf("Expected the default price, got %v", row.Values["price"])
+		}
+		checkOK(t)
+	})
+}
+
+// TestValueConversions tests parsing and formatting decimals and UUIDs
+func TestValueConversions(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Decimal
+	}{
+		{"12.50", NewDecimal(1250, 2)},
+		{"-0.05", NewDecimal(-5, 2)},
+		{"7", NewDecimal(7, 0)},
+		{".5", NewDecimal(5, 1)},
+	} {
+		d, err := ParseDecimal(tc.in)
+		if err != nil || d != tc.want {
+			t.Fatalf("Expected %q to parse as %v, got %v, %v", tc.in, tc.want, d, err)
+		}
+		if tc.in != ".5" && d.String() != tc.in {
+			t.Fatalf("Expected %v to format as %q, got %q", d, tc.in, d.String())
+		}
+	}
+	for _, in := range []string{"", ".", "1.2.3", "--1", "1e5", "99999999999999999999"} {
+		if _, err := ParseDecimal(in); err == nil {
+			t.Fatalf("Expected %q to be rejected", in)
+		}
+	}
+	if NewDecimal(150, 2).Cmp(NewDecimal(15, 1)) != 0 || NewDecimal(-1, 0).Cmp(NewDecimal(1, 3)) >= 0 {
+		t.Fatal("Expected decimals to compare by value")
+	}
+
+	u, err := NewUUID()
+	if err != nil {
+		t.Fatalf("Failed to generate UUID: %v", err)
+	}
+	parsed, err := ParseUUID(u.String())
+	if err != nil || parsed != u {
+		t.Fatalf("Expected %s to parse back, got %v, %v", u, parsed, err)
+	}
+	if u[6]>>4 != 4 {
+		t.Fatalf("Expected a version 4 UUID, got %s", u)
+	}
+	for _, in := range []string{"", "123e4567e89b12d3a456426614174000", fmt.Sprintf("%s0", u)[1:], "123e4567-e89b-12d3-a456-42661417400g"} {
+		if _, err := ParseUUID(in); err == nil {
+			t.Fatalf("Expected %q to be rejected", in)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// TVector columns hold vectors of the column's Dim float32 elements, such as
+// embeddings, and are searched by distance with NearestNeighbors. They are
+// stored like other variable length values, the data being the elements as
+// little-endian float32s, and cannot be compared or indexed like other
+// columns; CreateVectorIndex builds an index for the search instead.
+//
+// Vectors are written as []float32 or []float64 and read back as []float32.
+// Every element must be finite.
+
+// VectorDistance is the distance between the vectors of a TVector column
+type VectorDistance byte
+
+const (
+	L2Distance     VectorDistance = iota // Euclidean distance
+	CosineDistance                       // 1 - the cosine of the angle between the vectors, which cannot be zero
+)
+
+// toVector returns the elements of a value written to a vector column
+func toVector(col Column, value interface{}) ([]float32, error) {
+	var vec []float32
+	switch v := value.(type) {
+	case []float32:
+		vec = v
+	case []float64:
+		vec = make([]float32, len(v))
+		for i, f := range v {
+			vec[i] = float32(f)
+		}
+	default:
+		return nil, fmt.Errorf("expected []float32 value")
+	}
+
+	if len(vec) != int(col.Dim) {
+		return nil, fmt.Errorf("vector has %d dimensions, column %s has %d", len(vec), col.Name, col.Dim)
+	}
+	var norm float64
+	for i, f := range vec {
+		if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+			return nil, fmt.Errorf("vector element %d is not a finite float32", i)
+		}
+		norm += float64(f) * float64(f)
+	}
+	if col.Distance == CosineDistance && norm == 0 {
+		return nil, fmt.Errorf("column %s uses cosine distance, which is undefined for a zero vector", col.Name)
+	}
+	return vec, nil
+}
+
+// encodeVector returns the data a vector is stored as
+func encodeVector(col Column, value interface{}) ([]byte, error) {
+	vec, err := toVector(col, value)
+	if err != nil {
+		return nil, fmt.Errorf("column %s: %w", col.Name, err)
+	}
+	data := make([]byte, 0, 4*len(vec))
+	for _, f := range vec {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(f))
+	}
+	return data, nil
+}
+
+// decodeVector returns the vector stored as data
+func decodeVector(col Column, data []byte) ([]float32, error) {
+	if len(data) != 4*int(col.Dim) {
+		return nil, fmt.Errorf("vector in column %s has %d bytes, expected %d", col.Name, len(data), 4*int(col.Dim))
+	}
+	vec := make([]float32, col.Dim)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return vec, nil
+}
+
+// vectorDistance returns the distance between two vectors of the same length
+func vectorDistance(distance VectorDistance, a, b []float32) float64 {
+	if distance == CosineDistance {
+		var dot, normA, normB float64
+		for i := range a {
+			dot += float64(a[i]) * float64(b[i])
+			normA += float64(a[i]) * float64(a[i])
+			normB += float64(b[i]) * float64(b[i])
+		}
+		if normA == 0 || normB == 0 {
+			return 1
+		}
+		return 1 - dot/math.Sqrt(normA*normB)
+	}
+
+	var sum float64
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+// Neighbor is a row found by NearestNeighbors and the distance of its vector
+// from the query
+type Neighbor struct {
+	Row      *Row
+	Distance float64
+}
+
+// NearestNeighbors returns the k rows whose vectors in a column are nearest
+// to query by the column's distance, nearest first. Rows at the same distance
+// come in row ID order and rows without a vector are left out.
+//
+// Without a vector index every row is compared with the query, which gives
+// the exact answer. With one, only the rows in the lists nearest to the query
+// are, which is much faster but may miss some of the true neighbors.
+func (db *Database) NearestNeighbors(tableName string, column string, query []float32, k int) ([]Neighbor, error) {
+	snap := db.acquireSnapshot()
+	defer db.releaseSnapshot(snap)
+
+	return db.nearestNeighbors(snap, tableName, column, query, k)
+}
+
+// NearestNeighbors returns the k rows nearest to query, including the
+// transaction's own changes
+func (tx *Tx) NearestNeighbors(tableName string, column string, query []float32, k int) ([]Neighbor, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.db.nearestNeighbors(tx, tableName, column, query, k)
+}
+
+// nearestNeighbors returns the k rows visible to src nearest to query
+func (db *Database) nearestNeighbors(src rowSource, tableName string, column string, query []float32, k int) ([]Neighbor, error) {
+	table, exists := src.table(tableName)
+	if !exists {
+		return nil, fmt.Errorf("table not found: %s", tableName)
+	}
+	col, exists := table.column(column)
+	if !exists {
+		return nil, fmt.Errorf("column not found: %s", column)
+	}
+	if col.Type != TVector {
+		return nil, fmt.Errorf("column %s is not a vector column", column)
+	}
+	query, err := toVector(*col, query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query vector: %w", err)
+	}
+	if k <= 0 {
+		return nil, fmt.Errorf("number of neighbors must be positive, got %d", k)
+	}
+
+	for i := range table.Indexes {
+		if index := &table.Indexes[i]; index.Vector && index.Columns[0] == column {
+			return db.searchVectorIndex(src, table, index, col, query, k)
+		}
+	}
+
+	var neighbors []Neighbor
+	err = db.scanRowIndex(src, table, 0, math.MaxUint64, func(_ *RowIndex, row *Row) bool {
+		if vec, ok := row.Values[column].([]float32); ok {
+			neighbors = keepNearest(neighbors, Neighbor{Row: row, Distance: vectorDistance(col.Distance, query, vec)}, k)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return neighbors, nil
+}
+
+// keepNearest adds a neighbor to a list of at most k, sorted by distance and
+// then row ID, if it is nearer than the ones there
+func keepNearest(neighbors []Neighbor, n Neighbor, k int) []Neighbor {
+	i := sort.Search(len(neighbors), func(i int) bool {
+		other := neighbors[i]
+		return other.Distance > n.Distance || other.Distance == n.Distance && other.Row.RowID > n.Row.RowID
+	})
+	if i >= k {
+		return neighbors
+	}
+	if len(neighbors) < k {
+		neighbors = append(neighbors, Neighbor{})
+	}
+	copy(neighbors[i+1:], neighbors[i:])
+	neighbors[i] = n
+	return neighbors
+}
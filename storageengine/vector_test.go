@@ -0,0 +1,308 @@
+package storageengine
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestVectorColumns tests storing vectors and searching them with and without a vector index
+func TestVectorColumns(t *testing.T) {
+	dbPath := "vector_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "embedding", Type: TVector, Dim: 8},
+		{Name: "direction", Type: TVector, Dim: 3, Distance: CosineDistance},
+		{Name: "large", Type: TVector, Dim: 1500},
+	}
+	if err := db.CreateTable("items", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// Points scattered around a few centers, as embeddings tend to be
+	rng := rand.New(rand.NewSource(1))
+	centers := make([][]float32, 10)
+	for i := range centers {
+		centers[i] = make([]float32, 8)
+		for d := range centers[i] {
+			centers[i][d] = float32(rng.NormFloat64() * 10)
+		}
+	}
+	point := func() []float32 {
+		center := centers[rng.Intn(len(centers))]
+		vec := make([]float32, len(center))
+		for d := range vec {
+			vec[d] = center[d] + float32(rng.NormFloat64())
+		}
+		return vec
+	}
+
+	vectors := make(map[int64][]float32)
+	for i := 1; i <= 600; i++ {
+		values := map[string]interface{}{
+			"id":        int64(i),
+			"direction": []float64{float64(i % 7), 1, 0},
+		}
+		if i%50 != 0 {
+			vectors[int64(i)] = point()
+			values["embedding"] = vectors[int64(i)]
+		}
+		if i == 1 {
+			large := make([]float32, 1500) // stored out of line
+			for d := range large {
+				large[d] = float32(d)
+			}
+			values["large"] = large
+		}
+		if err := db.Insert("items", values); err != nil {
+			t.Fatalf("Failed to insert row %d: %v", i, err)
+		}
+	}
+
+	queries := make([][]float32, 20)
+	for i := range queries {
+		queries[i] = point()
+	}
+
+	checkOK := func(t *testing.T) {
+		t.Helper()
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Failed to check database: %v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("Expected no problems, got %v", report.Problems)
+		}
+	}
+
+	// search returns the IDs of the k rows nearest to query
+	search := func(t *testing.T, query []float32, k int) []int64 {
+		t.Helper()
+		neighbors, err := db.NearestNeighbors("items", "embedding", query, k)
+		if err != nil {
+			t.Fatalf("Failed to search: %v", err)
+		}
+		ids := make([]int64, len(neighbors))
+		for i, n := range neighbors {
+			ids[i] = n.Row.Values["id"].(int64)
+			if i > 0 && n.Distance < neighbors[i-1].Distance {
+				t.Fatalf("Expected neighbors nearest first, got %v after %v", n.Distance, neighbors[i-1].Distance)
+			}
+		}
+		return ids
+	}
+
+	// exact ranks the vectors inserted above by their distance from query
+	exact := func(query []float32, k int) []int64 {
+		var ids []int64
+		for id := range vectors {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			di := vectorDistance(L2Distance, query, vectors[ids[i]])
+			dj := vectorDistance(L2Distance, query, vectors[ids[j]])
+			return di < dj || di == dj && ids[i] < ids[j]
+		})
+		return ids[:min(k, len(ids))]
+	}
+
+	// recall returns the share of the true 10 nearest rows that searches find
+	recall := func(t *testing.T) float64 {
+		t.Helper()
+		var found int
+		for _, query := range queries {
+			want := make(map[int64]bool)
+			for _, id := range exact(query, 10) {
+				want[id] = true
+			}
+			for _, id := range search(t, query, 10) {
+				if want[id] {
+					found++
+				}
+			}
+		}
+		return float64(found) / float64(10*len(queries))
+	}
+
+	// Test: without an index the search compares every row and is exact
+	t.Run("Exact", func(t *testing.T) {
+		for _, query := range queries {
+			if got, want := search(t, query, 10), exact(query, 10); !reflect.DeepEqual(got, want) {
+				t.Fatalf("Expected %v, got %v", want, got)
+			}
+		}
+		if got := search(t, queries[0], 1000); len(got) != len(vectors) {
+			t.Fatalf("Expected every row with a vector, got %d", len(got))
+		}
+
+		row, err := db.SelectByPK("items", int64(3))
+		if err != nil {
+			t.Fatalf("Failed to select row: %v", err)
+		}
+		if !reflect.DeepEqual(row.Values["embedding"], vectors[3]) {
+			t.Fatalf("Expected the vector to read back as []float32, got %#v", row.Values["embedding"])
+		}
+		if !reflect.DeepEqual(row.Values["direction"], []float32{3, 1, 0}) {
+			t.Fatalf("Expected a []float64 to read back as []float32, got %#v", row.Values["direction"])
+		}
+		row, _ = db.SelectByPK("items", int64(1))
+		if large := row.Values["large"].([]float32); len(large) != 1500 || large[1499] != 1499 {
+			t.Fatal("Expected the vector stored out of line to read back whole")
+		}
+
+		// Cosine distance ignores the length of the vectors
+		neighbors, err := db.NearestNeighbors("items", "direction", []float32{30, 10, 0}, 3)
+		if err != nil {
+			t.Fatalf("Failed to search by cosine distance: %v", err)
+		}
+		for _, n := range neighbors {
+			if n.Row.Values["id"].(int64)%7 != 3 || math.Abs(n.Distance) > 1e-6 {
+				t.Fatalf("Expected rows pointing the same way at distance 0, got row %v at %v", n.Row.Values["id"], n.Distance)
+			}
+		}
+		if ids := []int64{neighbors[0].Row.Values["id"].(int64), neighbors[1].Row.Values["id"].(int64)}; ids[0] != 3 || ids[1] != 10 {
+			t.Fatalf("Expected ties in row ID order, got %v", ids)
+		}
+		checkOK(t)
+	})
+
+	// Test: invalid vectors, columns and searches are rejected
+	t.Run("Invalid", func(t *testing.T) {
+		invalid := map[string]interface{}{
+			"embedding": []float32{1, 2, 3},
+			"direction": []float32{0, 0, 0},
+			"large":     "vector",
+		}
+		for column, value := range invalid {
+			if err := db.Insert("items", map[string]interface{}{"id": int64(1000), column: value}); err == nil {
+				t.Fatalf("Expected %v to be rejected for column %s", value, column)
+			}
+		}
+		nan := []float32{1, 2, 3, 4, 5, 6, 7, float32(math.NaN())}
+		if err := db.Insert("items", map[string]interface{}{"id": int64(1000), "embedding": nan}); err == nil {
+			t.Fatal("Expected a NaN element to be rejected")
+		}
+
+		if err := db.AddColumn("items", Column{Name: "empty", Type: TVector}); err == nil {
+			t.Fatal("Expected a vector column without dimensions to be rejected")
+		}
+		if _, err := db.SelectWhere("items", "embedding", "=", vectors[3]); err == nil {
+			t.Fatal("Expected comparing vectors to be rejected")
+		}
+		if err := db.CreateIndex("items", "items_embedding", []string{"embedding"}, false); err == nil {
+			t.Fatal("Expected a B+tree index on a vector column to be rejected")
+		}
+		if err := db.CreateVectorIndex("items", "items_id", "id", VectorIndexOptions{}); err == nil {
+			t.Fatal("Expected a vector index on an integer column to be rejected")
+		}
+		if _, err := db.NearestNeighbors("items", "embedding", []float32{1}, 5); err == nil {
+			t.Fatal("Expected a query of the wrong dimension to be rejected")
+		}
+		if _, err := db.NearestNeighbors("items", "embedding", queries[0], 0); err == nil {
+			t.Fatal("Expected asking for no neighbors to be rejected")
+		}
+		checkOK(t)
+	})
+
+	// Test: a vector index reading every list is exact, reading a few is close
+	t.Run("Index", func(t *testing.T) {
+		if err := db.CreateVectorIndex("items", "items_all", "embedding", VectorIndexOptions{Lists: 16, Probes: 16}); err != nil {
+			t.Fatalf("Failed to create vector index: %v", err)
+		}
+		for _, query := range queries {
+			if got, want := search(t, query, 10), exact(query, 10); !reflect.DeepEqual(got, want) {
+				t.Fatalf("Expected an index reading every list to give %v, got %v", want, got)
+			}
+		}
+		if err := db.DropIndex("items", "items_all"); err != nil {
+			t.Fatalf("Failed to drop vector index: %v", err)
+		}
+		checkOK(t)
+
+		if err := db.CreateVectorIndex("items", "items_embedding", "embedding", VectorIndexOptions{}); err != nil {
+			t.Fatalf("Failed to create vector index: %v", err)
+		}
+		if r := recall(t); r < 0.9 {
+			t.Fatalf("Expected a recall of at least 0.9, got %v", r)
+		}
+
+		// Rows written after the index was built are found through it
+		vectors[1000] = queries[0]
+		if err := db.Insert("items", map[string]interface{}{"id": int64(1000), "embedding": queries[0]}); err != nil {
+			t.Fatalf("Failed to insert row: %v", err)
+		}
+		if got := search(t, queries[0], 1); len(got) != 1 || got[0] != 1000 {
+			t.Fatalf("Expected the new row to be nearest, got %v", got)
+		}
+		vectors[1000] = queries[1]
+		row, err := db.SelectByPK("items", int64(1000))
+		if err != nil {
+			t.Fatalf("Failed to select row: %v", err)
+		}
+		if err := db.UpdateByID("items", row.RowID, map[string]interface{}{"embedding": queries[1]}); err != nil {
+			t.Fatalf("Failed to update row: %v", err)
+		}
+		if got := search(t, queries[1], 1); len(got) != 1 || got[0] != 1000 {
+			t.Fatalf("Expected the updated row to be nearest, got %v", got)
+		}
+		if got := search(t, queries[0], 1); len(got) == 1 && got[0] == 1000 {
+			t.Fatal("Expected the row's old vector to be gone")
+		}
+		checkOK(t)
+	})
+
+	// Test: the column definitions and the index's lists survive reopening
+	t.Run("Reopen", func(t *testing.T) {
+		before := make([][]int64, len(queries))
+		for i, query := range queries {
+			before[i] = search(t, query, 10)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		db, err = NewDatabase(dbPath, 4096)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+		for i, query := range queries {
+			if got := search(t, query, 10); !reflect.DeepEqual(got, before[i]) {
+				t.Fatalf("Expected %v after reopening, got %v", before[i], got)
+			}
+		}
+		checkOK(t)
+	})
+
+	// Test: truncating keeps the index and dropping frees its pages
+	t.Run("Drop", func(t *testing.T) {
+		if err := db.TruncateTable("items"); err != nil {
+			t.Fatalf("Failed to truncate table: %v", err)
+		}
+		if got := search(t, queries[0], 10); len(got) != 0 {
+			t.Fatalf("Expected no rows after truncating, got %v", got)
+		}
+		if err := db.Insert("items", map[string]interface{}{"id": int64(1), "embedding": queries[2]}); err != nil {
+			t.Fatalf("Failed to insert row: %v", err)
+		}
+		if got := search(t, queries[2], 10); len(got) != 1 || got[0] != 1 {
+			t.Fatalf("Expected the new row through the index, got %v", got)
+		}
+		checkOK(t)
+
+		if err := db.DropTable("items"); err != nil {
+			t.Fatalf("Failed to drop table: %v", err)
+		}
+		checkOK(t)
+	})
+}
@@ -0,0 +1,376 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A vector index is an inverted file (IVF) index. CreateVectorIndex clusters
+// the column's vectors into lists with k-means, and every row goes into the
+// list whose centroid is nearest to its vector. A search only reads the rows
+// of the lists whose centroids are nearest to the query.
+//
+// The lists are kept in a B+tree like the entries of other indexes, keyed by
+// the list number as a big-endian uint16 followed by the row ID, so that
+// every list is a range of keys. Rows without a vector go into
+// nullVectorList, which no search reads. The centroids are stored on a chain
+// of PTIndex pages, see writeChain, and fixed when the index is built: rows
+// written later go into the list of their nearest centroid, so an index
+// built before most of the data was loaded is worth rebuilding.
+
+// VectorIndexOptions tune a vector index. Zero values pick the defaults.
+type VectorIndexOptions struct {
+	Lists  int // number of lists, by default the square root of the number of rows
+	Probes int // lists a search reads, by default a quarter of the lists
+}
+
+const (
+	maxVectorLists     = 4096           // bounds the lists of a vector index
+	nullVectorList     = math.MaxUint16 // list of the rows without a vector
+	maxTrainingVectors = 10000          // vectors k-means is run on, a larger table is sampled
+	kmeansIterations   = 20             // bounds the rounds of k-means
+)
+
+// CreateVectorIndex builds an index for NearestNeighbors over a vector
+// column in a transaction of its own
+func (db *Database) CreateVectorIndex(tableName string, indexName string, column string, opts VectorIndexOptions) error {
+	return db.autocommit(func(tx *Tx) error {
+		return tx.CreateVectorIndex(tableName, indexName, column, opts)
+	})
+}
+
+// CreateVectorIndex builds an index for NearestNeighbors over a vector
+// column as part of the transaction. The lists are trained on the rows the
+// table holds now.
+func (tx *Tx) CreateVectorIndex(tableName string, indexName string, column string, opts VectorIndexOptions) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	table, exists := tx.tables[tableName]
+	if !exists {
+		return fmt.Errorf("table not found: %s", tableName)
+	}
+
+	if err := checkName("index", indexName); err != nil {
+		return err
+	}
+	if _, exists := table.index(indexName); exists {
+		return fmt.Errorf("index already exists: %s", indexName)
+	}
+
+	col, exists := table.column(column)
+	if !exists {
+		return fmt.Errorf("column not found: %s", column)
+	}
+	if col.Type != TVector {
+		return fmt.Errorf("column %s is not a vector column", column)
+	}
+	if opts.Lists < 0 || opts.Lists > maxVectorLists {
+		return fmt.Errorf("vector index %s cannot have %d lists, the maximum is %d", indexName, opts.Lists, maxVectorLists)
+	}
+	if opts.Probes < 0 {
+		return fmt.Errorf("vector index %s cannot read %d lists", indexName, opts.Probes)
+	}
+
+	matches, err := tx.matchRows(table, nil)
+	if err != nil {
+		return err
+	}
+	var vectors [][]float32
+	for _, match := range matches {
+		if vec, ok := match.row.Values[column].([]float32); ok {
+			vectors = append(vectors, vec)
+		}
+	}
+	centroids := trainCentroids(*col, vectors, opts.Lists)
+
+	probes := opts.Probes
+	if probes == 0 {
+		probes = len(centroids) / 4
+	}
+	probes = max(1, min(probes, len(centroids)))
+
+	rootPageID, err := tx.createBPTree(table.ID)
+	if err != nil {
+		return err
+	}
+	index := Index{
+		Name:       indexName,
+		Columns:    []string{column},
+		Vector:     true,
+		RootPageID: rootPageID,
+		centroids:  centroids,
+		probes:     probes,
+	}
+	if len(centroids) > 0 {
+		var data []byte
+		for _, centroid := range centroids {
+			if data, err = appendVectorData(data, *col, centroid); err != nil {
+				return err
+			}
+		}
+		if index.centroidChain, err = tx.writeChain(PTIndex, table.ID, data); err != nil {
+			return fmt.Errorf("failed to store the centroids of index %s: %w", indexName, err)
+		}
+	}
+
+	table.Indexes = append(table.Indexes, index)
+	for _, match := range matches {
+		if err := tx.insertIndexEntry(table, &table.Indexes[len(table.Indexes)-1], match.row.Values, match.index.RowID); err != nil {
+			return err
+		}
+	}
+
+	return tx.writeTablePage(table)
+}
+
+// appendVectorData appends the data a vector is stored as
+func appendVectorData(buf []byte, col Column, vec []float32) ([]byte, error) {
+	data, err := encodeVector(col, vec)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, data...), nil
+}
+
+// trainCentroids clusters vectors into lists with k-means and returns the
+// centroid of every list. The initial centroids are evenly spaced vectors,
+// so the same rows always give the same lists. For cosine distance the
+// vectors and centroids are normalized, which makes the mean the direction
+// nearest to a list's vectors.
+func trainCentroids(col Column, vectors [][]float32, lists int) [][]float32 {
+	if len(vectors) == 0 {
+		return nil
+	}
+	if lists == 0 {
+		lists = int(math.Sqrt(float64(len(vectors))))
+	}
+	lists = max(1, min(lists, len(vectors), maxVectorLists))
+
+	points := vectors
+	if len(points) > maxTrainingVectors {
+		points = make([][]float32, maxTrainingVectors)
+		for i := range points {
+			points[i] = vectors[i*len(vectors)/maxTrainingVectors]
+		}
+	}
+	if col.Distance == CosineDistance {
+		normalized := make([][]float32, len(points))
+		for i, p := range points {
+			normalized[i] = append([]float32(nil), p...)
+			normalizeVector(normalized[i])
+		}
+		points = normalized
+	}
+
+	centroids := make([][]float32, lists)
+	for j := range centroids {
+		centroids[j] = append([]float32(nil), points[j*len(points)/lists]...)
+	}
+
+	assigned := make([]int, len(points))
+	for i := range assigned {
+		assigned[i] = -1
+	}
+	for range kmeansIterations {
+		changed := false
+		for i, p := range points {
+			if j := nearestCentroid(col.Distance, centroids, p); j != assigned[i] {
+				assigned[i] = j
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+
+		sums := make([][]float64, lists)
+		counts := make([]int, lists)
+		for i, p := range points {
+			j := assigned[i]
+			if sums[j] == nil {
+				sums[j] = make([]float64, len(p))
+			}
+			for d, f := range p {
+				sums[j][d] += float64(f)
+			}
+			counts[j]++
+		}
+		for j, sum := range sums {
+			if counts[j] == 0 {
+				continue // An empty list keeps its centroid
+			}
+			centroid := make([]float32, len(sum))
+			for d := range centroid {
+				centroid[d] = float32(sum[d] / float64(counts[j]))
+			}
+			if col.Distance == CosineDistance && !normalizeVector(centroid) {
+				continue
+			}
+			centroids[j] = centroid
+		}
+	}
+	return centroids
+}
+
+// normalizeVector scales a vector to a length of one. It reports false for
+// a zero vector, which is left alone.
+func normalizeVector(vec []float32) bool {
+	var norm float64
+	for _, f := range vec {
+		norm += float64(f) * float64(f)
+	}
+	if norm == 0 {
+		return false
+	}
+	norm = math.Sqrt(norm)
+	for i := range vec {
+		vec[i] = float32(float64(vec[i]) / norm)
+	}
+	return true
+}
+
+// nearestCentroid returns the list whose centroid is nearest to a vector
+func nearestCentroid(distance VectorDistance, centroids [][]float32, vec []float32) int {
+	nearest, best := 0, math.Inf(1)
+	for j, centroid := range centroids {
+		if d := vectorDistance(distance, vec, centroid); d < best {
+			nearest, best = j, d
+		}
+	}
+	return nearest
+}
+
+// vectorIndexPrefix returns the list a row goes into in a vector index.
+// Without centroids, in an index built on an empty table, every row goes
+// into list 0.
+func vectorIndexPrefix(table *Table, index *Index, values map[string]interface{}) ([]byte, bool, error) {
+	col, exists := table.column(index.Columns[0])
+	if !exists {
+		return nil, false, fmt.Errorf("column not found: %s", index.Columns[0])
+	}
+	value := values[col.Name]
+	if value == nil {
+		return binary.BigEndian.AppendUint16(nil, nullVectorList), true, nil
+	}
+	vec, err := toVector(*col, value)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid value for column %s: %w", col.Name, err)
+	}
+
+	var list int
+	if len(index.centroids) > 0 {
+		list = nearestCentroid(col.Distance, index.centroids, vec)
+	}
+	return binary.BigEndian.AppendUint16(nil, uint16(list)), false, nil
+}
+
+// searchVectorIndex returns the k rows visible to src nearest to query among
+// those in the lists whose centroids are nearest to it. As in indexScan,
+// entries may be stale, so rows are read through the row index and ranked by
+// the vector of the version src sees.
+func (db *Database) searchVectorIndex(src rowSource, table *Table, index *Index, col *Column, query []float32, k int) ([]Neighbor, error) {
+	lists := []int{0}
+	if len(index.centroids) > 0 {
+		distances := make([]float64, len(index.centroids))
+		lists = make([]int, len(index.centroids))
+		for j, centroid := range index.centroids {
+			distances[j] = vectorDistance(col.Distance, query, centroid)
+			lists[j] = j
+		}
+		sort.SliceStable(lists, func(a, b int) bool {
+			return distances[lists[a]] < distances[lists[b]]
+		})
+		lists = lists[:max(1, min(index.probes, len(lists)))]
+	}
+
+	var neighbors []Neighbor
+	var scanErr error
+	seen := make(map[uint64]bool)
+	for _, list := range lists {
+		prefix := binary.BigEndian.AppendUint16(nil, uint16(list))
+		err := bpScan(src, index.RootPageID, prefix, prefixEnd(prefix), func(_ []byte, rowID uint64) bool {
+			if seen[rowID] {
+				return true
+			}
+			seen[rowID] = true
+
+			_, row, err := db.lookupRow(src, table, rowID)
+			if err != nil {
+				scanErr = err
+				return false
+			}
+			if row == nil {
+				return true
+			}
+			if vec, ok := row.Values[col.Name].([]float32); ok {
+				neighbors = keepNearest(neighbors, Neighbor{Row: row, Distance: vectorDistance(col.Distance, query, vec)}, k)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if scanErr != nil {
+			return nil, scanErr
+		}
+	}
+	return neighbors, nil
+}
+
+// loadCentroids reads the centroids of a vector index from their chain
+func loadCentroids(src pageReader, table *Table, index *Index) error {
+	if index.centroidChain.pageID == 0 {
+		return nil
+	}
+	col, exists := table.column(index.Columns[0])
+	if !exists || col.Type != TVector {
+		return fmt.Errorf("vector index %s is over %s, which is not a vector column", index.Name, index.Columns[0])
+	}
+
+	data := make([]byte, 0, index.centroidChain.length)
+	err := walkChain(src, PTIndex, index.centroidChain, func(_ uint64, part []byte) {
+		data = append(data, part...)
+	})
+	if err != nil {
+		return fmt.Errorf("centroids of index %s: %w", index.Name, err)
+	}
+
+	size := 4 * int(col.Dim)
+	if len(data)%size != 0 {
+		return fmt.Errorf("centroids of index %s take %d bytes, which is no multiple of a vector", index.Name, len(data))
+	}
+	index.centroids = make([][]float32, 0, len(data)/size)
+	for offset := 0; offset < len(data); offset += size {
+		centroid, err := decodeVector(*col, data[offset:offset+size])
+		if err != nil {
+			return err
+		}
+		index.centroids = append(index.centroids, centroid)
+	}
+	return nil
+}
+
+// freeCentroids frees the chain the centroids of a vector index are stored on
+func (tx *Tx) freeCentroids(index *Index) error {
+	if index.centroidChain.pageID == 0 {
+		return nil
+	}
+
+	var pageIDs []uint64
+	err := walkChain(tx, PTIndex, index.centroidChain, func(pageID uint64, _ []byte) {
+		pageIDs = append(pageIDs, pageID)
+	})
+	if err != nil {
+		return fmt.Errorf("centroids of index %s: %w", index.Name, err)
+	}
+	for _, pageID := range pageIDs {
+		if err := tx.freePage(pageID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
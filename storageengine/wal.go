@@ -0,0 +1,175 @@
+package storageengine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// WAL record types
+const (
+	walPageRecord   byte = 1
+	walCommitRecord byte = 2
+)
+
+// walRecordHeaderSize is type (1) + page ID (8) + payload length (4)
+const walRecordHeaderSize = 13
+
+// walCheckpointSize is the log size after which pages are synced and the log is reset
+const walCheckpointSize = 4 << 20
+
+// writeAheadLog is a redo log of full page images.
+//
+// Every batch of page changes is appended as one page record per page followed
+// by a commit record, and the log is fsynced before the data file is touched.
+// On open, complete batches are replayed into the data file; a batch without
+// its commit record (a torn tail) is discarded.
+type writeAheadLog struct {
+	file *os.File
+	path string
+	size int64
+}
+
+// openWAL opens or creates the log file at path
+func openWAL(path string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &writeAheadLog{
+		file: file,
+		path: path,
+		size: info.Size(),
+	}, nil
+}
+
+// appendBatch logs page images followed by a commit record and syncs the log
+func (w *writeAheadLog) appendBatch(pages []*Page) error {
+	var buf []byte
+	for _, page := range pages {
+		buf = appendWALRecord(buf, walPageRecord, page.ID, page.Data)
+	}
+	buf = appendWALRecord(buf, walCommitRecord, 0, nil)
+
+	if _, err := w.file.WriteAt(buf, w.size); err != nil {
+		return fmt.Errorf("failed to append to wal: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal: %w", err)
+	}
+
+	w.size += int64(len(buf))
+	return nil
+}
+
+// appendWALRecord encodes a single record as [type][pageID][len][payload][crc]
+func appendWALRecord(buf []byte, recordType byte, pageID uint64, payload []byte) []byte {
+	start := len(buf)
+
+	var header [walRecordHeaderSize]byte
+	header[0] = recordType
+	binary.LittleEndian.PutUint64(header[1:9], pageID)
+	binary.LittleEndian.PutUint32(header[9:13], uint32(len(payload)))
+
+	buf = append(buf, header[:]...)
+	buf = append(buf, payload...)
+
+	checksum := crc32.ChecksumIEEE(buf[start:])
+	return binary.LittleEndian.AppendUint32(buf, checksum)
+}
+
+// replay calls apply for every page of every committed batch in log order.
+// It returns the number of batches replayed.
+func (w *writeAheadLog) replay(apply func(page *Page) error) (int, error) {
+	reader := io.NewSectionReader(w.file, 0, w.size)
+
+	var batch []*Page
+	batches := 0
+
+	for {
+		recordType, pageID, payload, err := readWALRecord(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, errTornWALRecord) {
+				// Anything after the last commit record never committed
+				return batches, nil
+			}
+			return batches, err
+		}
+
+		switch recordType {
+		case walPageRecord:
+			batch = append(batch, &Page{ID: pageID, Data: payload})
+		case walCommitRecord:
+			for _, page := range batch {
+				if err := apply(page); err != nil {
+					return batches, fmt.Errorf("failed to replay page %d: %w", page.ID, err)
+				}
+			}
+			batch = batch[:0]
+			batches++
+		default:
+			return batches, nil
+		}
+	}
+}
+
+var errTornWALRecord = errors.New("torn wal record")
+
+// readWALRecord reads and verifies the next record from the log
+func readWALRecord(r io.Reader) (byte, uint64, []byte, error) {
+	var header [walRecordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, 0, nil, errTornWALRecord
+		}
+		return 0, 0, nil, err
+	}
+
+	recordType := header[0]
+	pageID := binary.LittleEndian.Uint64(header[1:9])
+	length := binary.LittleEndian.Uint32(header[9:13])
+
+	body := make([]byte, int(length)+4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, errTornWALRecord
+	}
+
+	payload := body[:length]
+	checksum := binary.LittleEndian.Uint32(body[length:])
+
+	hash := crc32.NewIEEE()
+	hash.Write(header[:])
+	hash.Write(payload)
+	if hash.Sum32() != checksum {
+		return 0, 0, nil, errTornWALRecord
+	}
+
+	return recordType, pageID, payload, nil
+}
+
+// reset discards the log contents once they are durable in the data file
+func (w *writeAheadLog) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate wal: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal: %w", err)
+	}
+	w.size = 0
+	return nil
+}
+
+// close closes the log file
+func (w *writeAheadLog) close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,108 @@
+package storageengine
+
+import (
+	"os"
+	"testing"
+)
+
+// crash closes the database files without checkpointing, as a killed process would
+func crash(t *testing.T, db *Database) {
+	t.Helper()
+	if err := db.closeFiles(); err != nil {
+		t.Fatalf("Failed to close files: %v", err)
+	}
+}
+
+// TestWALRecovery tests that committed rows survive a crash before the data file is synced
+func TestWALRecovery(t *testing.T) {
+	dbPath := "wal_test.db"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+
+	db, err := NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	columns := []Column{
+		{Name: "id", Type: TInteger, NotNull: true},
+		{Name: "name", Type: Tstring, NotNull: true},
+	}
+	if err := db.CreateTable("users", columns, "id"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := db.checkpoint(); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+
+	// Remember the data file as it was at the checkpoint
+	checkpointed, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to read database file: %v", err)
+	}
+
+	// Enough rows to fill the first page and link a second one, committed in
+	// batches small enough to stay below the checkpoint size
+	const numRows = 300
+	for i := 1; i <= numRows; i += 10 {
+		tx := db.Begin()
+		for j := i; j < i+10; j++ {
+			err := tx.Insert("users", map[string]interface{}{
+				"id":   int64(j),
+				"name": "user",
+			})
+			if err != nil {
+				t.Fatalf("Failed to insert row %d: %v", j, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+	}
+	if db.wal.size == 0 {
+		t.Fatal("Expected the committed batches to still be in the wal")
+	}
+	crash(t, db)
+
+	// Pretend none of the data file writes after the checkpoint reached the disk
+	if err := os.WriteFile(dbPath, checkpointed, 0666); err != nil {
+		t.Fatalf("Failed to restore database file: %v", err)
+	}
+
+	// Append a torn batch that must be ignored on replay
+	wal, err := openWAL(dbPath + "-wal")
+	if err != nil {
+		t.Fatalf("Failed to open wal: %v", err)
+	}
+	torn := appendWALRecord(nil, walPageRecord, 1, make([]byte, 4096))
+	if _, err := wal.file.WriteAt(torn[:100], wal.size); err != nil {
+		t.Fatalf("Failed to write torn record: %v", err)
+	}
+	wal.close()
+
+	db, err = NewDatabase(dbPath, 4096)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	count, err := db.GetRowCount("users")
+	if err != nil {
+		t.Fatalf("Failed to get row count: %v", err)
+	}
+	if count != numRows {
+		t.Fatalf("Expected %d rows after recovery, got %d", numRows, count)
+	}
+
+	user, err := db.SelectByID("users", numRows)
+	if err != nil {
+		t.Fatalf("Failed to select last row: %v", err)
+	}
+	if user.Values["id"] != int64(numRows) {
+		t.Fatalf("Expected id %d, got %v", numRows, user.Values["id"])
+	}
+
+	if db.wal.size != 0 {
+		t.Fatalf("Expected wal to be reset after recovery, got size %d", db.wal.size)
+	}
+}